@@ -0,0 +1,287 @@
+package main
+
+import (
+	"common"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+			broker-auth.go
+
+	Questo modulo autentica e autorizza le richieste all'API REST del broker. Le credenziali vengono inviate
+		nell'header "Authorization: Bearer <credenziale>" e determinano il ruolo del chiamante:
+	 - admin: la chiave AdminKey della configurazione locale, può eseguire qualsiasi richiesta (configurazione,
+	   lista dei subscriber, statistiche e amministrazione)
+	 - publisher: la chiave PublisherKey, può registrarsi e inviare messaggi alla coda globale del broker
+	 - subscriber: il token ottenuto alla registrazione (o alla ripresa), firmato con AuthSecret, può agire solo
+	   sulle risorse del proprio subscriber ID e ricevere dalla propria coda. Il token scade dopo TokenTTL secondi
+	   ed è rinnovato dalla ripresa e da ogni heartbeat; non è più valido se il subscriber è stato rimosso
+	Il check alive e la registrazione di un subscriber non richiedono credenziali; le richieste senza credenziali
+		valide ricevono 401, quelle non permesse al ruolo del chiamante 403.
+	Se AuthSecret non è impostato l'autenticazione è disabilitata.
+	Con il mutual TLS (TLSClientCAFile) le risorse dei publisher richiedono anche un certificato client valido, che
+		in assenza dell'header Authorization identifica il chiamante come publisher.
+
+*/
+
+//Ruoli dei chiamanti dell'API REST
+const (
+	roleAdmin      = "admin"
+	rolePublisher  = "publisher"
+	roleSubscriber = "subscriber"
+)
+
+const subscriberTokenPrefix = "sub." //Prefisso dei token dei subscriber (sub.<subID>.<scadenza>.<firma>)
+
+//Chiamante autenticato
+type caller struct {
+	role    string //Ruolo del chiamante
+	subject string //Subscriber ID (solo per il ruolo subscriber)
+}
+
+//Chiave del contesto della richiesta in cui authMiddleware memorizza il chiamante autenticato
+type callerContextKey struct{}
+
+//Regola di autorizzazione di una risorsa per i ruoli diversi da admin
+type accessRule func(c caller, r *http.Request) bool
+
+//Risorse accessibili senza credenziali (metodo e template del percorso)
+var publicRoutes = map[string]bool{
+	"GET /":           true,
+	"PUT /subscriber": true,
+}
+
+//Risorse dei publisher, che con il mutual TLS richiedono un certificato client
+var publisherRoutes = map[string]bool{
+	"GET /publisher":              true,
+	"POST /queue/{queue}/message": true,
+}
+
+//Regole di autorizzazione per publisher e subscriber. Le risorse non elencate sono riservate al ruolo admin
+var accessRules = map[string]accessRule{
+	"GET /publisher":                          allowRole(rolePublisher),
+	"POST /queue/{queue}/message":             allowGlobalQueue,
+	"GET /queue/{queue}/message":              allowOwnQueue,
+	"DELETE /queue/{queue}/message/{receipt}": allowOwnQueue,
+	"POST /subscriber/{id}/position":          allowOwnSubscriber,
+	"PUT /subscriber/{id}/topic":              allowOwnSubscriber,
+	"DELETE /subscriber/{id}/topic":           allowOwnSubscriber,
+	"DELETE /subscriber/{id}":                 allowOwnSubscriber,
+	"POST /subscriber/{id}/resume":            allowOwnSubscriber,
+	"POST /subscriber/{id}/heartbeat":         allowOwnSubscriber,
+}
+
+//Indica se l'autenticazione è abilitata
+func authEnabled() bool {
+	return common.Config.AuthSecret != ""
+}
+
+//Indica se il mutual TLS è abilitato
+func mutualTLSEnabled() bool {
+	return common.Config.TLSClientCAFile != ""
+}
+
+//Indica se la richiesta è stata inviata con un certificato client verificato
+func hasClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+//Middleware che verifica le credenziali e i permessi di ogni richiesta prima di eseguirla
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		route := routeKey(r)
+		if mutualTLSEnabled() && publisherRoutes[route] && !hasClientCertificate(r) {
+			common.Warning("[BROKER] Richiesta " + route + " senza certificato client da " + r.RemoteAddr)
+			http.Error(w, "Client certificate required.", http.StatusUnauthorized)
+			return
+		}
+
+		if !authEnabled() || publicRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, ok := authenticate(r)
+		if !ok {
+			common.Warning("[BROKER] Richiesta " + route + " senza credenziali valide da " + r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing or invalid credentials.", http.StatusUnauthorized)
+			return
+		}
+
+		//Il token di un subscriber rimosso non è più valido, anche se non ancora scaduto
+		if c.role == roleSubscriber {
+			_, err := subscriberStore.GetSubscriber(c.subject)
+			if err == errSubscriberNotFound {
+				common.Warning("[BROKER] Richiesta " + route + " con il token del subscriber rimosso " + c.subject + " da " + r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Missing or invalid credentials.", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				common.Warning("[BROKER] Impossibile verificare il subscriber " + c.subject + ": " + err.Error())
+				http.Error(w, "Unable to verify credentials.", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		if c.role != roleAdmin {
+			rule := accessRules[route]
+			if rule == nil || !rule(c, r) {
+				common.Warning("[BROKER] Richiesta " + route + " non permessa al ruolo " + c.role + " (" + r.RemoteAddr + ")")
+				http.Error(w, "Operation not permitted.", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, c)))
+	})
+}
+
+//Chiamante autenticato di una richiesta (ok è false se la richiesta non è stata autenticata)
+func requestCaller(r *http.Request) (c caller, ok bool) {
+	c, ok = r.Context().Value(callerContextKey{}).(caller)
+	return c, ok
+}
+
+//Metodo e template del percorso della risorsa richiesta (ad esempio "DELETE /subscriber/{id}")
+func routeKey(r *http.Request) string {
+
+	template := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if t, err := route.GetPathTemplate(); err == nil {
+			template = t
+		}
+	}
+
+	return r.Method + " " + template
+}
+
+//Ricava il chiamante dalle credenziali della richiesta
+func authenticate(r *http.Request) (c caller, ok bool) {
+
+	header := r.Header.Get("Authorization")
+
+	//Con il mutual TLS il certificato client sostituisce la chiave dei publisher
+	if header == "" && mutualTLSEnabled() && hasClientCertificate(r) {
+		return caller{role: rolePublisher}, true
+	}
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return caller{}, false
+	}
+	credential := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if credential == "" {
+		return caller{}, false
+	}
+
+	if keyEquals(credential, common.Config.AdminKey) {
+		return caller{role: roleAdmin}, true
+	}
+	if keyEquals(credential, common.Config.PublisherKey) {
+		return caller{role: rolePublisher}, true
+	}
+
+	subID, ok := verifySubscriberToken(credential)
+	if !ok {
+		return caller{}, false
+	}
+
+	return caller{role: roleSubscriber, subject: subID}, true
+}
+
+//Confronto delle chiavi in tempo costante, per non rivelarne il contenuto attraverso i tempi di risposta
+func keyEquals(credential string, key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(key)) == 1
+}
+
+//Token di un subscriber, valido per TokenTTL secondi ("" se l'autenticazione è disabilitata)
+func subscriberToken(subID string) string {
+
+	if !authEnabled() {
+		return ""
+	}
+
+	expiresAt := time.Now().Add(time.Duration(common.Config.TokenTTL) * time.Second).Unix()
+	return signSubscriberToken(subID, expiresAt)
+}
+
+//Token di un subscriber con la scadenza indicata (secondi Unix)
+func signSubscriberToken(subID string, expiresAt int64) string {
+
+	claims := subID + "." + strconv.FormatInt(expiresAt, 10)
+	return subscriberTokenPrefix + claims + "." + subscriberSignature(claims)
+}
+
+//Firma HMAC-SHA256 del subscriber ID e della scadenza del token
+func subscriberSignature(claims string) string {
+
+	mac := hmac.New(sha256.New, []byte(common.Config.AuthSecret))
+	mac.Write([]byte(roleSubscriber + ":" + claims))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Verifica la firma e la scadenza di un token e ne ricava il subscriber ID
+func verifySubscriberToken(token string) (subID string, ok bool) {
+
+	if !strings.HasPrefix(token, subscriberTokenPrefix) {
+		return "", false
+	}
+
+	//Il subscriber ID può contenere punti: firma e scadenza sono gli ultimi due campi del token
+	body := strings.TrimPrefix(token, subscriberTokenPrefix)
+	separator := strings.LastIndex(body, ".")
+	if separator <= 0 {
+		return "", false
+	}
+
+	claims, signature := body[:separator], body[separator+1:]
+	if !hmac.Equal([]byte(signature), []byte(subscriberSignature(claims))) {
+		return "", false
+	}
+
+	separator = strings.LastIndex(claims, ".")
+	if separator <= 0 {
+		return "", false
+	}
+
+	expiresAt, err := strconv.ParseInt(claims[separator+1:], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return "", false
+	}
+
+	return claims[:separator], true
+}
+
+//Permette la richiesta ai chiamanti con il ruolo indicato
+func allowRole(role string) accessRule {
+	return func(c caller, r *http.Request) bool {
+		return c.role == role
+	}
+}
+
+//Permette ai publisher l'invio di messaggi alla sola coda globale del broker
+func allowGlobalQueue(c caller, r *http.Request) bool {
+	return c.role == rolePublisher && mux.Vars(r)["queue"] == currentConfig().GlobalSqsQueue
+}
+
+//Permette ad un subscriber la ricezione dalla sola propria coda
+func allowOwnQueue(c caller, r *http.Request) bool {
+	return c.role == roleSubscriber && queueSubscriberID(mux.Vars(r)["queue"]) == c.subject
+}
+
+//Permette ad un subscriber le richieste sul solo proprio subscriber ID
+func allowOwnSubscriber(c caller, r *http.Request) bool {
+	return c.role == roleSubscriber && mux.Vars(r)["id"] == c.subject
+}
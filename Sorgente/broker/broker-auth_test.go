@@ -0,0 +1,123 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Configurazione locale con l'autenticazione abilitata, ripristinata al termine del test
+func enableAuth(t *testing.T, secret string) {
+
+	saved := common.Config
+	t.Cleanup(func() { common.Config = saved })
+
+	common.Config.AuthSecret = secret
+	common.Config.AdminKey = "admin-key-0123456789"
+	common.Config.PublisherKey = "publisher-key-0123456789"
+	common.Config.TokenTTL = 3600
+}
+
+//Verifica della firma e della scadenza dei token dei subscriber
+func TestVerifySubscriberToken(t *testing.T) {
+
+	enableAuth(t, "secret-0123456789abcdef")
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+	valid := signSubscriberToken("a", future)
+	signature := valid[strings.LastIndex(valid, ".")+1:]
+
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+		wantID string
+		wantOk bool
+	}{
+		{"valid", valid, "", "a", true},
+		{"issued by subscriberToken", subscriberToken("a"), "", "a", true},
+		{"subscriber ID with dots", signSubscriberToken("a.b.c", future), "", "a.b.c", true},
+		{"expired", signSubscriberToken("a", past), "", "", false},
+		{"expiring now", signSubscriberToken("a", time.Now().Unix()), "", "", false},
+		{"signed with another secret", valid, "another-secret-0123456789", "", false},
+		{"tampered subscriber ID", "sub.b." + strconv.FormatInt(future, 10) + "." + signature, "", "", false},
+		{"extended expiry", "sub.a." + strconv.FormatInt(future+3600, 10) + "." + signature, "", "", false},
+		{"tampered signature", valid[:len(valid)-1] + "x", "", "", false},
+		{"without signature", "sub.a." + strconv.FormatInt(future, 10), "", "", false},
+		{"missing prefix", strings.TrimPrefix(valid, subscriberTokenPrefix), "", "", false},
+		{"legacy token without expiry", "sub.a." + subscriberSignature("a"), "", "", false},
+		{"non-numeric expiry", "sub.a.never." + subscriberSignature("a.never"), "", "", false},
+		{"empty subscriber ID", "sub." + strconv.FormatInt(future, 10) + "." + subscriberSignature(strconv.FormatInt(future, 10)), "", "", false},
+		{"empty", "", "", "", false},
+		{"prefix only", subscriberTokenPrefix, "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			if test.secret != "" {
+				secret := common.Config.AuthSecret
+				common.Config.AuthSecret = test.secret
+				defer func() { common.Config.AuthSecret = secret }()
+			}
+
+			subID, ok := verifySubscriberToken(test.token)
+			if ok != test.wantOk || subID != test.wantID {
+				t.Fatalf("verifySubscriberToken(%q) = (%q, %v), want (%q, %v)", test.token, subID, ok, test.wantID, test.wantOk)
+			}
+		})
+	}
+}
+
+//Il token di un subscriber vale solo finché il subscriber è registrato
+func TestAuthMiddlewareSubscriberToken(t *testing.T) {
+
+	enableAuth(t, "secret-0123456789abcdef")
+
+	memory := newMemorySubscriberStore()
+	if err, _ := memory.AddSubscriber(common.SubscriberEntry{SubID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		store      SubscriberStore
+		subID      string
+		token      string
+		wantStatus int
+	}{
+		{"registered", memory, "a", signSubscriberToken("a", time.Now().Add(time.Hour).Unix()), http.StatusOK},
+		{"removed", memory, "b", signSubscriberToken("b", time.Now().Add(time.Hour).Unix()), http.StatusUnauthorized},
+		{"expired", memory, "a", signSubscriberToken("a", time.Now().Add(-time.Hour).Unix()), http.StatusUnauthorized},
+		{"other subscriber", memory, "b", signSubscriberToken("a", time.Now().Add(time.Hour).Unix()), http.StatusForbidden},
+		{"storage error", failingSubscriberStore{SubscriberStore: memory, err: errors.New("throttled")}, "a",
+			signSubscriberToken("a", time.Now().Add(time.Hour).Unix()), http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			subscriberStore = test.store
+
+			router := mux.NewRouter()
+			router.HandleFunc("/subscriber/{id}/heartbeat", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+			router.Use(authMiddleware)
+
+			r := httptest.NewRequest("POST", "/subscriber/"+test.subID+"/heartbeat", nil)
+			r.Header.Set("Authorization", "Bearer "+test.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
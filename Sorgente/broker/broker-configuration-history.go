@@ -0,0 +1,169 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+			broker-configuration-history.go
+
+	Questo modulo mantiene lo storico delle modifiche ai parametri di configurazione. Ogni modifica (con
+		PUT /configuration, con un ripristino o da parte del broker stesso) viene memorizzata come una nuova versione
+		del parametro, con il valore precedente, il nuovo valore, l'istante e l'autore della modifica.
+		Se la modifica non può essere registrata nello storico, il parametro viene riportato al valore precedente.
+	L'autore è il ruolo del chiamante autenticato (vedere broker-auth.go) seguito dall'indirizzo del client, oppure
+		il solo indirizzo se l'autenticazione è disabilitata. L'header X-Actor della richiesta viene aggiunto tra
+		parentesi come nota informativa (ad esempio "admin@10.0.0.5 (mario)") e non sostituisce l'autore.
+	Un ripristino (POST /configuration/{name}/rollback) riporta il parametro al valore che aveva dopo la versione
+		indicata (la versione 0 è il valore precedente alla prima modifica registrata) e forza l'aggiornamento
+		della configurazione del broker.
+
+*/
+
+const configHistoryTable = "configuration-history" //Nome della tabella DynamoDB dello storico della configurazione
+const configActorHeader = "X-Actor"                 //Header HTTP con una nota sull'autore di una modifica della configurazione
+const maxActorNoteLength = 64                       //Lunghezza massima della nota dell'header X-Actor
+const brokerActor = "broker"                        //Autore delle modifiche effettuate dal broker
+
+//Operazioni registrate nello storico
+const (
+	configOperationUpdate   = "update"
+	configOperationRollback = "rollback"
+)
+
+//Struct per una versione di un parametro di configurazione
+type ConfigChange struct {
+	FieldName       string //Nome del parametro
+	Version         int    //Numero progressivo della modifica (a partire da 1)
+	OldValue        string //Valore precedente alla modifica
+	NewValue        string //Valore dopo la modifica
+	Timestamp       string //Istante della modifica
+	Actor           string //Autore della modifica
+	Operation       string //"update" oppure "rollback"
+	RestoredVersion int    //Versione ripristinata (solo per le operazioni di rollback)
+}
+
+var errConfigVersionNotFound = errors.New("configuration version not found")
+
+//Autore di una modifica della configurazione richiesta con l'API REST
+func configActor(r *http.Request) string {
+
+	actor, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		actor = r.RemoteAddr
+	}
+
+	if c, ok := requestCaller(r); ok {
+		actor = c.role + "@" + actor
+	}
+
+	if note := strings.TrimSpace(r.Header.Get(configActorHeader)); note != "" {
+		if len(note) > maxActorNoteLength {
+			note = note[:maxActorNoteLength]
+		}
+		actor += " (" + note + ")"
+	}
+
+	return actor
+}
+
+//Aggiorna un parametro di configurazione e registra la modifica nello storico
+func changeConfigurationParameter(fieldName string, fieldValue string, actor string, operation string, restoredVersion int) (change ConfigChange, retErr error) {
+
+	oldValue, err := configStore.UpdateParameter(fieldName, fieldValue)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'aggiornamento del parametro di configurazione. " + err.Error())
+		return ConfigChange{}, err
+	}
+
+	common.Info("[BROKER] Parametro aggiornato")
+
+	change, err = configStore.AddChange(ConfigChange{
+		FieldName:       fieldName,
+		OldValue:        oldValue,
+		NewValue:        fieldValue,
+		Timestamp:       time.Now().Format(time.RFC3339),
+		Actor:           actor,
+		Operation:       operation,
+		RestoredVersion: restoredVersion,
+	})
+	if err != nil {
+		common.Fatal("[BROKER] Errore nella registrazione della modifica di " + fieldName + " nello storico. " + err.Error())
+
+		//Una modifica non registrata nello storico viene annullata, riportando il parametro al valore precedente
+		_, rollbackErr := configStore.UpdateParameter(fieldName, oldValue)
+		if rollbackErr != nil {
+			common.Fatal("[BROKER] Impossibile annullare la modifica di " + fieldName + " non registrata nello storico. " + rollbackErr.Error())
+			return ConfigChange{}, errors.New("parameter updated but history not recorded: " + err.Error())
+		}
+		common.Warning("[BROKER] Modifica di " + fieldName + " annullata")
+
+		return ConfigChange{}, errors.New("history not recorded, parameter not updated: " + err.Error())
+	}
+
+	common.Info("[BROKER] Modifica di " + fieldName + " registrata come versione " + strconv.Itoa(change.Version) + " (autore " + actor + ")")
+
+	return change, nil
+}
+
+//Ritorna lo storico delle modifiche di un parametro, in ordine di versione
+func configurationHistory(fieldName string) (changes []ConfigChange, retErr error) {
+
+	changes, err := configStore.GetChanges(fieldName)
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'ottenimento dello storico di " + fieldName + ". " + err.Error())
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+//Riporta un parametro al valore che aveva dopo la versione data e aggiorna la configurazione del broker
+func rollbackConfigurationParameter(fieldName string, version int, actor string) (change ConfigChange, retErr error) {
+
+	changes, err := configurationHistory(fieldName)
+	if err != nil {
+		return ConfigChange{}, err
+	}
+
+	//Valore da ripristinare: la versione 0 è il valore precedente alla prima modifica
+	var value string
+	found := false
+	for _, c := range changes {
+		if version == 0 && c.Version == 1 {
+			value, found = c.OldValue, true
+		} else if c.Version == version {
+			value, found = c.NewValue, true
+		}
+	}
+	if !found {
+		return ConfigChange{}, errConfigVersionNotFound
+	}
+
+	//Il valore deve essere valido anche per lo schema corrente
+	err = validateConfigEntry(ConfigEntry{FieldName: fieldName, FieldValue: value})
+	if err != nil {
+		return ConfigChange{}, err
+	}
+
+	common.Info("[BROKER] Ripristino di " + fieldName + " alla versione " + strconv.Itoa(version) + " (" + value + ")")
+
+	change, err = changeConfigurationParameter(fieldName, value, actor, configOperationRollback, version)
+	if err != nil {
+		return ConfigChange{}, err
+	}
+
+	//Aggiornamento forzato della configurazione del broker
+	err = retreiveConfig()
+	if err != nil {
+		return change, err
+	}
+
+	return change, nil
+}
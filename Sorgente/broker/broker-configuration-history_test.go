@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Storage della configurazione in cui la registrazione nello storico fallisce
+type failingHistoryStore struct {
+	*memoryConfigStore
+}
+
+func (store failingHistoryStore) AddChange(change ConfigChange) (stored ConfigChange, retErr error) {
+	return ConfigChange{}, errors.New("history unavailable")
+}
+
+//Una modifica viene mantenuta solo se registrata nello storico
+func TestChangeConfigurationParameter(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		failHistory  bool
+		parameter    string
+		wantErr      bool
+		wantValue    string
+		wantVersions int
+	}{
+		{"recorded", false, "mq_threshold", false, "0.9", 1},
+		{"history fails", true, "mq_threshold", true, "0.7", 0},
+		{"unknown parameter", false, "missing", true, "0.7", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			memory := &memoryConfigStore{
+				configs: []ConfigEntry{{FieldName: "mq_threshold", FieldValue: "0.7"}},
+				history: make(map[string][]ConfigChange),
+			}
+			configStore = memory
+			if test.failHistory {
+				configStore = failingHistoryStore{memory}
+			}
+
+			change, err := changeConfigurationParameter(test.parameter, "0.9", "admin", configOperationUpdate, 0)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && (change.OldValue != "0.7" || change.NewValue != "0.9" || change.Version != 1) {
+				t.Fatalf("unexpected change %+v", change)
+			}
+
+			if value := memory.configs[0].FieldValue; value != test.wantValue {
+				t.Fatalf("mq_threshold = %s, want %s", value, test.wantValue)
+			}
+			if versions := len(memory.history["mq_threshold"]); versions != test.wantVersions {
+				t.Fatalf("%d versions recorded, want %d", versions, test.wantVersions)
+			}
+		})
+	}
+}
+
+//L'autore di una modifica è il chiamante autenticato, e l'header X-Actor è solo una nota
+func TestConfigActor(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		caller *caller
+		note   string
+		want   string
+	}{
+		{"authentication disabled", nil, "", "10.0.0.5"},
+		{"admin", &caller{role: roleAdmin}, "", "admin@10.0.0.5"},
+		{"note does not replace the caller", &caller{role: roleAdmin}, "mario", "admin@10.0.0.5 (mario)"},
+		{"note without authentication", nil, "admin", "10.0.0.5 (admin)"},
+		{"long note is truncated", &caller{role: roleAdmin}, strings.Repeat("x", 100), "admin@10.0.0.5 (" + strings.Repeat("x", maxActorNoteLength) + ")"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest("PUT", "/configuration", nil)
+			r.RemoteAddr = "10.0.0.5:41234"
+			if test.note != "" {
+				r.Header.Set(configActorHeader, test.note)
+			}
+			if test.caller != nil {
+				r = r.WithContext(context.WithValue(r.Context(), callerContextKey{}, *test.caller))
+			}
+
+			if actor := configActor(r); actor != test.want {
+				t.Fatalf("actor %q, want %q", actor, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"common"
+	"strconv"
+	"strings"
+)
+
+/*
+			broker-configuration-schema.go
+
+	Questo modulo descrive i parametri della tabella di configurazione: per ogni parametro sono indicati il tipo,
+		l'intervallo (o l'insieme) dei valori ammessi, il valore di default, una descrizione e se la modifica viene
+		applicata al caricamento successivo della configurazione (hot reload) oppure solo al riavvio del broker.
+	Lo schema è usato per validare i valori prima di scriverli (PUT /configuration), per costruire la configurazione
+		del broker e viene fornito alla dashboard con GET /configuration/schema.
+
+*/
+
+//Tipi dei parametri di configurazione
+const (
+	paramInt    = "int"
+	paramFloat  = "float"
+	paramString = "string"
+)
+
+//Descrizione di un parametro di configurazione
+type ConfigParameter struct {
+	Name         string   //Nome del parametro (FieldName sulla tabella)
+	Type         string   //Tipo del valore: "int", "float" o "string"
+	Min          *float64 `json:",omitempty"` //Valore minimo (per i tipi numerici)
+	ExclusiveMin bool     `json:",omitempty"` //Il valore deve essere strettamente maggiore di Min
+	Max          *float64 `json:",omitempty"` //Valore massimo (per i tipi numerici)
+	Values       []string `json:",omitempty"` //Valori ammessi (per le stringhe)
+	Default      string   //Valore usato se il parametro non è presente sulla tabella
+	Description  string   //Descrizione del parametro
+	HotReload    bool     //La modifica viene applicata senza riavviare il broker
+
+	get func(conf *BrokerConfig) string        //Legge il valore dalla configurazione
+	set func(conf *BrokerConfig, value string) //Assegna un valore già validato alla configurazione
+}
+
+//Errore di validazione di un parametro di configurazione (valore non valido o parametro sconosciuto)
+type configValidationError struct {
+	message string
+}
+
+func (err *configValidationError) Error() string {
+	return err.message
+}
+
+//Crea un errore di validazione con il messaggio dato
+func invalidConfig(message string) error {
+	return &configValidationError{message: message}
+}
+
+//Ritorna un puntatore al limite dato, per i campi Min e Max
+func bound(value float64) *float64 {
+	return &value
+}
+
+//Parametro intero, memorizzato nel campo ritornato da field
+func intParameter(param ConfigParameter, field func(conf *BrokerConfig) *int) ConfigParameter {
+
+	param.Type = paramInt
+	param.get = func(conf *BrokerConfig) string { return strconv.Itoa(*field(conf)) }
+	param.set = func(conf *BrokerConfig, value string) { *field(conf), _ = strconv.Atoi(value) }
+
+	return param
+}
+
+//Parametro decimale, memorizzato nel campo ritornato da field
+func floatParameter(param ConfigParameter, field func(conf *BrokerConfig) *float64) ConfigParameter {
+
+	param.Type = paramFloat
+	param.get = func(conf *BrokerConfig) string { return strconv.FormatFloat(*field(conf), 'f', -1, 64) }
+	param.set = func(conf *BrokerConfig, value string) { *field(conf), _ = strconv.ParseFloat(value, 64) }
+
+	return param
+}
+
+//Parametro stringa, memorizzato nel campo ritornato da field
+func stringParameter(param ConfigParameter, field func(conf *BrokerConfig) *string) ConfigParameter {
+
+	param.Type = paramString
+	param.get = func(conf *BrokerConfig) string { return *field(conf) }
+	param.set = func(conf *BrokerConfig, value string) { *field(conf) = value }
+
+	return param
+}
+
+//Schema dei parametri di configurazione, nell'ordine in cui vengono mostrati
+var configSchema = []ConfigParameter{
+	intParameter(ConfigParameter{Name: "delay_sqs_request", Min: bound(0), Default: "20", HotReload: true,
+		Description: "Maximum time (in seconds) between two receive requests on the broker queue"},
+		func(conf *BrokerConfig) *int { return &conf.DelaySqsRequest }),
+	intParameter(ConfigParameter{Name: "delay_load_config", Min: bound(1), Default: "120", HotReload: true,
+		Description: "Time (in seconds) between two reloads of the configuration"},
+		func(conf *BrokerConfig) *int { return &conf.DelayLoadConfig }),
+	floatParameter(ConfigParameter{Name: "mq_threshold", Min: bound(0), Default: "0.7", HotReload: true,
+		Description: "Maximum number of people per square meter before a position is reported as crowded"},
+		func(conf *BrokerConfig) *float64 { return &conf.MqThreshold }),
+	intParameter(ConfigParameter{Name: "positive_radius", Min: bound(0), Default: "2500", HotReload: true,
+		Description: "Radius (in grid blocks of grid_block_size meters) used to notify subscribers when a positive case is reported"},
+		func(conf *BrokerConfig) *int { return &conf.PositiveRadius }),
+	stringParameter(ConfigParameter{Name: "subTableName", Default: "subscriber", HotReload: false,
+		Description: "Name of the table that stores the subscribers"},
+		func(conf *BrokerConfig) *string { return &conf.SubTableName }),
+	stringParameter(ConfigParameter{Name: "globalSqsQueue", Default: "none", HotReload: true,
+		Description: "URL of the queue the broker receives messages from (\"none\" creates a new queue)"},
+		func(conf *BrokerConfig) *string { return &conf.GlobalSqsQueue }),
+	stringParameter(ConfigParameter{Name: "deadLetterTableName", Default: defaultDeadLetterTableName, HotReload: false,
+		Description: "Name of the table that stores the messages that could not be delivered"},
+		func(conf *BrokerConfig) *string { return &conf.DeadLetterTableName }),
+	intParameter(ConfigParameter{Name: "index_cell_size", Min: bound(1), Default: strconv.Itoa(defaultIndexCellSize), HotReload: true,
+		Description: "Side (in grid blocks) of the cells of the subscriber spatial index"},
+		func(conf *BrokerConfig) *int { return &conf.IndexCellSize }),
+	intParameter(ConfigParameter{Name: "index_refresh_delay", Min: bound(1), Default: strconv.Itoa(defaultIndexRefreshDelay), HotReload: true,
+		Description: "Time (in seconds) between two rebuilds of the subscriber spatial index, i.e. how long changes made through other brokers can go unseen"},
+		func(conf *BrokerConfig) *int { return &conf.IndexRefreshDelay }),
+	stringParameter(ConfigParameter{Name: "distance_mode", Values: []string{distanceEuclidean, distanceManhattan, distanceSquare}, Default: distanceEuclidean, HotReload: true,
+		Description: "Metric used for the forwarding radius"},
+		func(conf *BrokerConfig) *string { return &conf.DistanceMode }),
+	floatParameter(ConfigParameter{Name: "grid_origin_lat", Min: bound(-maxGridLatitude), Max: bound(maxGridLatitude), Default: "0", HotReload: false,
+		Description: "Latitude of the origin of the grid of blocks"},
+		func(conf *BrokerConfig) *float64 { return &conf.Grid.OriginLat }),
+	floatParameter(ConfigParameter{Name: "grid_origin_lon", Min: bound(-180), Max: bound(180), Default: "0", HotReload: false,
+		Description: "Longitude of the origin of the grid of blocks"},
+		func(conf *BrokerConfig) *float64 { return &conf.Grid.OriginLon }),
+	floatParameter(ConfigParameter{Name: "grid_block_size", Min: bound(0), ExclusiveMin: true, Default: strconv.FormatFloat(defaultGridBlockSize, 'f', -1, 64), HotReload: false,
+		Description: "Side (in meters) of a block of the grid"},
+		func(conf *BrokerConfig) *float64 { return &conf.Grid.BlockSize }),
+	intParameter(ConfigParameter{Name: "fanout_workers", Min: bound(1), Default: strconv.Itoa(defaultFanoutWorkers), HotReload: true,
+		Description: "Maximum number of goroutines used to forward messages to the subscribers"},
+		func(conf *BrokerConfig) *int { return &conf.FanoutWorkers }),
+	intParameter(ConfigParameter{Name: "fanout_batch_size", Min: bound(1), Max: bound(common.MaxBatchSize), Default: strconv.Itoa(defaultFanoutBatchSize), HotReload: true,
+		Description: "Maximum number of messages sent to a queue with a single request"},
+		func(conf *BrokerConfig) *int { return &conf.FanoutBatchSize }),
+	stringParameter(ConfigParameter{Name: "dedupTableName", Default: defaultDedupTableName, HotReload: false,
+		Description: "Name of the table that stores the identifiers of the forwarded messages"},
+		func(conf *BrokerConfig) *string { return &conf.DedupTableName }),
+	intParameter(ConfigParameter{Name: "dedup_ttl", Min: bound(1), Default: strconv.Itoa(defaultDedupTTL), HotReload: true,
+		Description: "Time (in seconds) a forwarded message is remembered to discard duplicates"},
+		func(conf *BrokerConfig) *int { return &conf.DedupTTL }),
+	intParameter(ConfigParameter{Name: "subscriber_ttl", Min: bound(0), Default: strconv.Itoa(defaultSubscriberTTL), HotReload: true,
+		Description: "Time (in seconds) without heartbeats or position updates after which a subscriber and its queue are removed (0 never removes them)"},
+		func(conf *BrokerConfig) *int { return &conf.SubscriberTTL }),
+	intParameter(ConfigParameter{Name: "reaper_delay", Min: bound(1), Default: strconv.Itoa(defaultReaperDelay), HotReload: true,
+		Description: "Time (in seconds) between two searches of the expired subscribers"},
+		func(conf *BrokerConfig) *int { return &conf.ReaperDelay }),
+	stringParameter(ConfigParameter{Name: "queuePrefix", Default: defaultQueuePrefix, HotReload: false,
+		Description: "Prefix of the names of the subscriber queues, used to list them during the reconciliation"},
+		func(conf *BrokerConfig) *string { return &conf.QueuePrefix }),
+	intParameter(ConfigParameter{Name: "reconcile_delay", Min: bound(0), Default: strconv.Itoa(defaultReconcileDelay), HotReload: true,
+		Description: "Time (in seconds) between two reconciliations of the subscriber table with the queues (0 disables the periodic reconciliation)"},
+		func(conf *BrokerConfig) *int { return &conf.ReconcileDelay }),
+	stringParameter(ConfigParameter{Name: "reconcile_mode", Values: []string{reconcileReport, reconcileRepair}, Default: reconcileReport, HotReload: true,
+		Description: "Whether the periodic reconciliation only reports the inconsistencies or also repairs them"},
+		func(conf *BrokerConfig) *string { return &conf.ReconcileMode }),
+}
+
+//Ritorna la descrizione del parametro con il nome dato
+func lookupConfigParameter(name string) (param ConfigParameter, found bool) {
+
+	for _, param := range configSchema {
+		if param.Name == name {
+			return param, true
+		}
+	}
+
+	return ConfigParameter{}, false
+}
+
+//Verifica che il valore rispetti il tipo e i limiti del parametro
+func (param ConfigParameter) validate(value string) (retErr error) {
+
+	var number float64
+	var err error
+
+	switch param.Type {
+	case paramInt:
+		var integer int
+		integer, err = strconv.Atoi(value)
+		number = float64(integer)
+	case paramFloat:
+		number, err = strconv.ParseFloat(value, 64)
+	case paramString:
+		if value == "" {
+			return invalidConfig("invalid value for " + param.Name + ": must not be empty")
+		}
+		if len(param.Values) > 0 && !containsString(param.Values, value) {
+			return invalidConfig("invalid value for " + param.Name + ": must be one of " + strings.Join(param.Values, ", "))
+		}
+		return nil
+	}
+
+	if err != nil || (param.Min != nil && (number < *param.Min || (param.ExclusiveMin && number == *param.Min))) ||
+		(param.Max != nil && number > *param.Max) {
+		return invalidConfig("invalid value for " + param.Name + ": must be " + param.rangeDescription())
+	}
+
+	return nil
+}
+
+//Descrizione dei valori ammessi da un parametro numerico, usata nei messaggi di errore
+func (param ConfigParameter) rangeDescription() string {
+
+	kind := "an integer"
+	if param.Type == paramFloat {
+		kind = "a number"
+	}
+
+	format := func(value float64) string { return strconv.FormatFloat(value, 'f', -1, 64) }
+
+	switch {
+	case param.Min != nil && param.Max != nil:
+		return kind + " between " + format(*param.Min) + " and " + format(*param.Max)
+	case param.Min != nil && param.ExclusiveMin:
+		return kind + " greater than " + format(*param.Min)
+	case param.Min != nil:
+		return kind + " greater than or equal to " + format(*param.Min)
+	case param.Max != nil:
+		return kind + " less than or equal to " + format(*param.Max)
+	}
+
+	return kind
+}
+
+//Verifica un parametro di configurazione prima della sua scrittura
+func validateConfigEntry(entry ConfigEntry) (retErr error) {
+
+	param, found := lookupConfigParameter(entry.FieldName)
+	if !found {
+		return invalidConfig("unknown configuration parameter " + entry.FieldName)
+	}
+
+	return param.validate(entry.FieldValue)
+}
+
+//Verifica se una lista contiene la stringa data
+func containsString(values []string, value string) bool {
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,17 +1,21 @@
 package main
 import (
 	"common"
-	"errors"
-	"fmt"
-	"reflect"
-	"strconv"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
 			broker-configuration.go
 
 	Questo modulo si occupa di recuperare e fornire i parametri di configurazione. Questi valori
-		sono poi accessibili all'interno di tutto l'applicativo
+		sono poi accessibili all'interno di tutto l'applicativo attraverso currentConfig()
+	La configurazione è un'istanza immutabile di BrokerConfig, sostituita atomicamente ad ogni caricamento: chi
+		la legge ottiene sempre un insieme coerente di parametri, anche mentre viene caricata una nuova configurazione.
+		I componenti che devono reagire alle modifiche (ad esempio al cambio di un intervallo) si registrano
+		con onConfigChange.
 
 */
 
@@ -25,12 +29,174 @@ type ConfigEntry struct {
 const configTable = "configuration" //Costante per il nome della tabella su DynamoDB
 
 
-var delay_sqs_request	string	//Il tempo che intercorre tra una richiesta SQS ed un'altra
-var delay_load_config	string	//Il tempo che intercorre per il fetch della nuova configurazione
-var mq_threshold		float64	//Il limite massimo di persone al metro quadro
-var positive_radius		int		//il raggio per mandare un messaggio quando si riscontra un positivo
-var subTableName 		string  //Nome della tabella dove vengono gestite le sottoscrizioni
-var globalSqsQueue 		string  //Nome della coda SQS usata dai broker per ricevere i messaggi
+//Parametri di configurazione del broker. Ogni caricamento della configurazione crea una nuova istanza che
+//sostituisce atomicamente la precedente: un'istanza non viene mai modificata dopo la pubblicazione, per cui può
+//essere letta da più goroutine senza sincronizzazione
+type BrokerConfig struct {
+	DelaySqsRequest		int			//delay_sqs_request: il tempo (in secondi) che intercorre tra una richiesta SQS ed un'altra
+	DelayLoadConfig		int			//delay_load_config: il tempo (in secondi) che intercorre per il fetch della nuova configurazione
+	MqThreshold			float64		//mq_threshold: il limite massimo di persone al metro quadro
+	PositiveRadius		int			//positive_radius: il raggio per mandare un messaggio quando si riscontra un positivo
+	SubTableName		string		//subTableName: nome della tabella dove vengono gestite le sottoscrizioni
+	GlobalSqsQueue		string		//globalSqsQueue: nome della coda SQS usata dai broker per ricevere i messaggi
+	DeadLetterTableName	string		//deadLetterTableName: nome della tabella dove vengono memorizzati i messaggi non consegnati
+	IndexCellSize		int			//index_cell_size: lato (in blocchi) delle celle dell'indice spaziale dei subscriber
+	IndexRefreshDelay	int			//index_refresh_delay: il tempo che intercorre tra una ricostruzione dell'indice spaziale e un'altra
+	DistanceMode		string		//distance_mode: metrica usata per il raggio di inoltro ("euclidean", "manhattan" o "square")
+	Grid				gridConfig	//grid_origin_lat, grid_origin_lon, grid_block_size: griglia dei blocchi
+	FanoutWorkers		int			//fanout_workers: numero massimo di goroutine usate per inoltrare i messaggi ai subscriber
+	FanoutBatchSize		int			//fanout_batch_size: numero massimo di messaggi inviati ad una coda con una sola richiesta
+	DedupTableName		string		//dedupTableName: nome della tabella dove vengono memorizzati i messaggi già inoltrati
+	DedupTTL			int			//dedup_ttl: il tempo (in secondi) per cui un messaggio inoltrato viene ricordato
+	SubscriberTTL		int			//subscriber_ttl: il tempo (in secondi) di inattività dopo cui un subscriber viene rimosso (0 = mai)
+	ReaperDelay			int			//reaper_delay: il tempo che intercorre tra due ricerche dei subscriber inattivi
+	QueuePrefix			string		//queuePrefix: prefisso del nome delle code dei subscriber
+	ReconcileDelay		int			//reconcile_delay: il tempo che intercorre tra due riconciliazioni tra subscriber e code (0 = mai)
+	ReconcileMode		string		//reconcile_mode: "report" (solo segnalazione) o "repair" (correzione) per la riconciliazione periodica
+}
+
+var brokerConfig atomic.Value		//Configurazione corrente (*BrokerConfig)
+var configMutex sync.Mutex			//Serializza la sostituzione della configurazione e la notifica delle modifiche
+var configListeners []func(old *BrokerConfig, updated *BrokerConfig)	//Funzioni chiamate ad ogni modifica della configurazione
+
+
+//Ritorna la configurazione corrente (da non modificare). Per usare valori coerenti tra loro conviene leggere la
+//configurazione una sola volta per operazione
+func currentConfig() *BrokerConfig {
+
+	conf, _ := brokerConfig.Load().(*BrokerConfig)
+	if conf == nil {
+		return defaultConfig()
+	}
+
+	return conf
+}
+
+//Configurazione con i valori di default di tutti i parametri (vedere broker-configuration-schema.go)
+func defaultConfig() *BrokerConfig {
+
+	conf := &BrokerConfig{}
+	for _, param := range configSchema {
+		param.set(conf, param.Default)
+	}
+
+	return conf
+}
+
+//Registra una funzione chiamata (dalla goroutine che ha caricato la configurazione) ad ogni modifica della configurazione
+func onConfigChange(listener func(old *BrokerConfig, updated *BrokerConfig)) {
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	configListeners = append(configListeners, listener)
+}
+
+//Ritorna un canale su cui viene inviata una notifica quando una modifica della configurazione soddisfa changed
+//(le notifiche non ancora ricevute non si accumulano)
+func configWakeup(changed func(old *BrokerConfig, updated *BrokerConfig) bool) <-chan struct{} {
+
+	wakeup := make(chan struct{}, 1)
+
+	onConfigChange(func(old *BrokerConfig, updated *BrokerConfig) {
+		if changed(old, updated) {
+			select {
+			case wakeup <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	return wakeup
+}
+
+//Attende per la durata data o fino ad una notifica su wakeup, ritornando false se il contesto viene annullato
+func sleepUntilWakeup(ctx context.Context, wakeup <-chan struct{}, duration time.Duration) bool {
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-wakeup:
+		common.Info("[BROKER] Attesa interrotta dalla modifica della configurazione")
+	case <-ctx.Done():
+		return false
+	}
+
+	return true
+}
+
+//Sostituisce la configurazione corrente e, se è cambiata, lo notifica alle funzioni registrate
+func setConfig(conf *BrokerConfig) {
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	old, _ := brokerConfig.Load().(*BrokerConfig)
+	brokerConfig.Store(conf)
+
+	if old == nil || *old == *conf {
+		return
+	}
+
+	for _, listener := range configListeners {
+		listener(old, conf)
+	}
+}
+
+
+//Interfaccia per lo storage dei parametri di configurazione
+type ConfigStore interface {
+	GetParameters() (configs []ConfigEntry, retErr error)                                //Ottiene tutti i parametri
+	UpdateParameter(fieldName string, fieldValue string) (oldValue string, retErr error) //Aggiorna un parametro esistente, ritornando il valore precedente
+	AddChange(change ConfigChange) (stored ConfigChange, retErr error)                   //Registra una modifica nello storico assegnandole la versione successiva
+	GetChanges(fieldName string) (changes []ConfigChange, retErr error)                  //Ottiene lo storico di un parametro, in ordine di versione
+}
+
+var configStore ConfigStore //Storage della configurazione utilizzato dal broker
+
+
+//Inizializza lo storage della configurazione: la tabella DynamoDB oppure, in modalità locale, una tabella in memoria
+func initConfigStore() (retErr error) {
+
+	if common.Config.Mode != "local" {
+		configStore = &dynamoConfigStore{}
+		return nil
+	}
+
+	store, err := newMemoryConfigStore(common.Config.ConfigTableFile)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel caricamento della configurazione da " + common.Config.ConfigTableFile + ". " + err.Error())
+		return err
+	}
+	configStore = store
+
+	common.Info("[BROKER] Configurazione caricata da " + common.Config.ConfigTableFile)
+
+	return nil
+}
+
+
+// La funzione esegue una query sullo storage per la configurazione
+func makeConfigQuery() (configs []ConfigEntry, retErr error) {
+
+	configs, err := configStore.GetParameters()
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'esecuzione della Query\n" + err.Error())
+		return nil, err
+	}
+
+	common.Info("[BROKER] Query eseguita con successo")
+
+	return configs, nil
+}
+
+
+//Aggiornamento di un parametro di configurazione da parte di actor (registrato nello storico)
+func updateConfigurationParameter(fieldName string, fieldValue string, actor string) (change ConfigChange, retErr error) {
+	return changeConfigurationParameter(fieldName, fieldValue, actor, configOperationUpdate, 0)
+}
 
 
 // Funzione che recupera le informazioni di configurazione dal database di DynamoDB
@@ -57,56 +223,56 @@ func retreiveConfig() (retErr error) {
 }
 
 
-// La funzione assegna i parametri ottenuti dalla query alle rispettive varabili
+// La funzione crea una nuova configurazione con i parametri ottenuti dalla query e la rende la configurazione corrente.
+//Se un parametro non è valido la configurazione corrente non viene modificata, mentre i parametri sconosciuti vengono
+//ignorati. I parametri che non supportano l'hot reload mantengono il valore caricato all'avvio
 func assignParameters(configs []ConfigEntry) (retErr error) {
 
-	var err error
-
-	for _, conf := range configs {
-
-		switch conf.FieldName {
-
-			case "delay_sqs_request":
-				delay_sqs_request = conf.FieldValue
-			case "delay_load_config":
-				delay_load_config = conf.FieldValue
-			case "subTableName":
-				subTableName = conf.FieldValue
-			case "positive_radius":
-				positive_radius, err = strconv.Atoi(conf.FieldValue)
-				if err != nil {
-					common.Fatal("[BROKER] Errore nel parsing del POSITIVE_RADIUS value, interruzione del programma\n" + err.Error())
-					return err
-				}
-			case "mq_threshold":
-				mq_threshold, err = strconv.ParseFloat(conf.FieldValue, 64)
-				if err != nil {
-					common.Fatal("[BROKER] Errore nel parsing del MQ_THRESHOLD value, interruzione del programma\n" + err.Error())
-					return err
-				}
-			case "globalSqsQueue":
-				globalSqsQueue = conf.FieldValue
-			default:
-				common.Fatal("La entry " + conf.FieldName + " non è valida, termino il programma")
-				return errors.New("entry inesistente")
+	//I parametri non presenti sulla tabella assumono il valore di default
+	conf := defaultConfig()
+
+	for _, entry := range configs {
+
+		param, found := lookupConfigParameter(entry.FieldName)
+		if !found {
+			common.Warning("[BROKER] La entry " + entry.FieldName + " non è un parametro di configurazione, viene ignorata")
+			continue
 		}
 
+		err := param.validate(entry.FieldValue)
+		if err != nil {
+			common.Fatal("[BROKER] Valore di " + entry.FieldName + " non valido (" + entry.FieldValue + "), configurazione non aggiornata")
+			return err
+		}
+
+		param.set(conf, entry.FieldValue)
 	}
 
-	if globalSqsQueue == "none"{
-		globalSqsQueue, _ = createQueue("broker-reiceive")
-		_ = updateConfigurationParameter("globalSqsQueue", globalSqsQueue)
+	//Dopo il primo caricamento le modifiche ai parametri che non supportano l'hot reload sono applicate al riavvio
+	old, _ := brokerConfig.Load().(*BrokerConfig)
+	if old != nil {
+		for _, param := range configSchema {
+			if !param.HotReload && param.get(conf) != param.get(old) {
+				common.Warning("[BROKER] Il nuovo valore di " + param.Name + " (" + param.get(conf) + ") verrà applicato al riavvio del broker")
+				param.set(conf, param.get(old))
+			}
+		}
+	}
+
+	if conf.GlobalSqsQueue == "none"{
+		conf.GlobalSqsQueue, _ = createQueue("broker-reiceive")
+		_, _ = updateConfigurationParameter("globalSqsQueue", conf.GlobalSqsQueue, brokerActor)
 	}
 
 	//Controllo se tutte le variabili di configurazione sono corrette
 	common.Info("[BROKER] Parametri ottenuti")
-	common.Info(" |   Variabile delay_sqs_request "		+ delay_sqs_request 				+ " : " + reflect.TypeOf(delay_sqs_request).String())
-	common.Info(" |   Variabile delay_load_config "		+ delay_load_config 				+ " : " + reflect.TypeOf(delay_load_config).String())
-	common.Info(" |   Variabile subTableName " 			+ subTableName 						+ " : " + reflect.TypeOf(subTableName).String())
-	common.Info(" |   Variabile mq_threshold " 			+ fmt.Sprintf("%f", mq_threshold) 	+ " : " + reflect.TypeOf(mq_threshold).String())
-	common.Info(" |   Variabile positive_radius "		+ strconv.Itoa(positive_radius)		+ " : " + reflect.TypeOf(positive_radius).String())
-	common.Info(" |   Variabile globalSqsQueue " 		+ globalSqsQueue 					+ " : " + reflect.TypeOf(globalSqsQueue).String())
+	for _, param := range configSchema {
+		common.Info(" |   Variabile " + param.Name + " " + param.get(conf) + " : " + param.Type)
+	}
 	common.Info(" +-------------------------------------------------------------------------------------------------------\n\n")
 
+	//Pubblicazione della nuova configurazione
+	setConfig(conf)
+
 	return nil
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"common"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+/*
+			broker-dead-letter.go
+
+	Questo modulo gestisce i messaggi che il broker non è riuscito ad inoltrare (attributi non validi, errori
+		dello storage, ...). Invece di essere eliminati, questi messaggi vengono spostati nella coda dei messaggi
+		non consegnati (dead letter) insieme al motivo del fallimento. Da qui possono essere consultati, reinviati
+		sulla coda del broker (redrive) oppure eliminati attraverso l'API REST di amministrazione.
+	Un messaggio già instradato, il cui invio è fallito solo verso alcune code dei subscriber, viene reinviato
+		direttamente a quelle code, senza passare dalla coda del broker: le altre lo hanno già ricevuto.
+	La coda è realizzata con un DeadLetterStore: una tabella DynamoDB (deadLetterTableName) oppure, se i
+		subscriber vengono memorizzati in memoria, una mappa in memoria.
+
+*/
+
+//Messaggio non consegnato
+type DeadLetter struct {
+	LetterID      string            //Identificativo del messaggio non consegnato
+	Body          string            //Testo del messaggio originale
+	Attributes    map[string]string //Attributi del messaggio originale
+	GroupID       string            //Gruppo del messaggio originale (code FIFO)
+	SentTimestamp int64             //Istante di invio del messaggio originale (in millisecondi)
+	FailedAt      int64             //Istante del fallimento (in millisecondi)
+	Reason        string            //Motivo del fallimento
+	Redrives      int               //Numero di reinvii già effettuati
+	MessageID     string            //Identificativo del messaggio (vedere broker-dedup.go), riassegnato al reinvio
+	Queues        []string          //Code dei subscriber a cui l'invio è fallito, vuoto se il messaggio non è stato instradato
+}
+
+//Interfaccia per lo storage dei messaggi non consegnati
+type DeadLetterStore interface {
+	AddDeadLetter(letter DeadLetter) (retErr error)                 //Aggiunge un messaggio non consegnato
+	GetDeadLetter(letterID string) (letter DeadLetter, retErr error) //Ottiene un messaggio dato il suo identificativo
+	GetDeadLetters() (letters []DeadLetter, retErr error)            //Ottiene tutti i messaggi, ordinati per istante del fallimento
+	RemoveDeadLetter(letterID string) (retErr error)                 //Rimuove un messaggio
+}
+
+const defaultDeadLetterTableName = "dead-letter" //Nome di default della tabella DynamoDB dei messaggi non consegnati
+
+var deadLetterStore DeadLetterStore //Storage dei messaggi non consegnati utilizzato dal broker
+
+//Errore ritornato quando il messaggio cercato non esiste
+var errDeadLetterNotFound = errors.New("no dead letter found")
+
+//Inizializza lo storage dei messaggi non consegnati (dello stesso tipo dello storage dei subscriber)
+func initDeadLetterStore() {
+
+	storeType := common.Config.SubscriberStore
+	if storeType == "" && common.Config.Mode == "local" {
+		storeType = "memory"
+	}
+
+	if storeType == "memory" {
+		deadLetterStore = newMemoryDeadLetterStore()
+	} else {
+		deadLetterStore = &dynamoDeadLetterStore{}
+	}
+}
+
+//Genera un identificativo casuale per un messaggio non consegnato
+func newDeadLetterID() string {
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+//Sposta un messaggio che non è stato possibile inoltrare nella coda dei messaggi non consegnati, con il suo
+//identificativo e, per un messaggio instradato, le code a cui l'invio è fallito
+func moveToDeadLetter(message common.QueueMessage, messageID string, queues []string, reason error) (retErr error) {
+
+	//Gli attributi vengono copiati, per non modificare il messaggio del chiamante
+	attributes := make(map[string]string, len(message.Attributes))
+	for key, value := range message.Attributes {
+		attributes[key] = value
+	}
+
+	letter := DeadLetter{
+		LetterID:      newDeadLetterID(),
+		Body:          message.Body,
+		Attributes:    attributes,
+		GroupID:       message.GroupID,
+		SentTimestamp: message.SentTimestamp,
+		FailedAt:      time.Now().UnixNano() / int64(time.Millisecond),
+		Reason:        reason.Error(),
+		MessageID:     messageID,
+		Queues:        queues,
+	}
+
+	//Il numero di reinvii viene mantenuto negli attributi del messaggio reinviato
+	if redrives, err := strconv.Atoi(message.Attributes[redriveAttribute]); err == nil {
+		letter.Redrives = redrives
+		delete(letter.Attributes, redriveAttribute)
+	}
+
+	err := deadLetterStore.AddDeadLetter(letter)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel salvataggio del messaggio non consegnato. " + err.Error())
+		return err
+	}
+
+	common.Warning("[BROKER] Messaggio spostato nella coda dei messaggi non consegnati (" + letter.LetterID + "): " + letter.Reason)
+	sendLogMessage("Messaggio non consegnato (" + letter.LetterID + "): " + letter.Reason)
+
+	return nil
+}
+
+const redriveAttribute = "Redrives"     //Attributo che contiene il numero di reinvii di un messaggio
+const redriveGroupID = "redrivegroupID" //Gruppo dei messaggi reinviati di cui non è noto il gruppo originale
+
+//Reinvia un messaggio non consegnato sulla coda del broker e lo rimuove dalla coda dei messaggi non consegnati
+func redriveDeadLetter(letterID string) (retErr error) {
+
+	letter, err := deadLetterStore.GetDeadLetter(letterID)
+	if err != nil {
+		return err
+	}
+
+	if len(letter.Queues) > 0 {
+		return redriveToQueues(letter)
+	}
+
+	attributes := make(map[string]string)
+	for key, value := range letter.Attributes {
+		attributes[key] = value
+	}
+	attributes[redriveAttribute] = strconv.Itoa(letter.Redrives + 1)
+
+	//Il messaggio reinviato mantiene il proprio identificativo, anche se di un publisher precedente (vedere broker-dedup.go)
+	if letter.MessageID != "" {
+		attributes["MessageID"] = letter.MessageID
+	}
+
+	//Il messaggio viene reinviato nel gruppo del publisher originale, mantenendone l'ordinamento FIFO
+	groupID := letter.GroupID
+	if groupID == "" {
+		groupID = redriveGroupID
+	}
+
+	err = common.MessageTransport.SendMessage(currentConfig().GlobalSqsQueue, common.QueueMessage{
+		Body:            letter.Body,
+		Attributes:      attributes,
+		GroupID:         groupID,
+		DeduplicationID: "redrive" + letter.LetterID + strconv.Itoa(letter.Redrives+1),
+	})
+	if err != nil {
+		common.Warning("[BROKER] Errore nel reinvio del messaggio " + letterID + ". " + err.Error())
+		return err
+	}
+
+	err = deadLetterStore.RemoveDeadLetter(letterID)
+	if err != nil {
+		common.Warning("[BROKER] Errore nella rimozione del messaggio reinviato " + letterID + ". " + err.Error())
+		return err
+	}
+
+	common.Info("[BROKER] Messaggio " + letterID + " reinviato sulla coda del broker")
+
+	return nil
+}
+
+//Reinvia un messaggio instradato alle sole code dei subscriber a cui l'invio era fallito. Le code a cui l'invio
+//fallisce di nuovo restano nella coda dei messaggi non consegnati
+func redriveToQueues(letter DeadLetter) (retErr error) {
+
+	message, err := common.DecodeMessage(common.QueueMessage{Body: letter.Body, Attributes: letter.Attributes, GroupID: letter.GroupID, SentTimestamp: letter.SentTimestamp})
+	if err != nil {
+		common.Warning("[BROKER] Errore nella decodifica del messaggio " + letter.LetterID + ". " + err.Error())
+		return err
+	}
+	message.MessageID = letter.MessageID
+
+	var remaining []string
+	for _, url := range letter.Queues {
+		err = common.MessageTransport.SendMessage(url, queueMessageFor(message, url))
+		if err != nil {
+			common.Warning("[BROKER] Errore nel reinvio del messaggio " + letter.LetterID + " alla coda " + url + ". " + err.Error())
+			remaining = append(remaining, url)
+			retErr = errors.New("sending to queue " + url + " failed: " + err.Error())
+		}
+	}
+
+	if len(remaining) > 0 {
+		letter.Queues = remaining
+		letter.Redrives++
+		letter.FailedAt = time.Now().UnixNano() / int64(time.Millisecond)
+		letter.Reason = retErr.Error()
+
+		err = deadLetterStore.AddDeadLetter(letter)
+		if err != nil {
+			common.Warning("[BROKER] Errore nell'aggiornamento del messaggio non consegnato " + letter.LetterID + ". " + err.Error())
+		}
+		return retErr
+	}
+
+	err = deadLetterStore.RemoveDeadLetter(letter.LetterID)
+	if err != nil {
+		common.Warning("[BROKER] Errore nella rimozione del messaggio reinviato " + letter.LetterID + ". " + err.Error())
+		return err
+	}
+
+	common.Info("[BROKER] Messaggio " + letter.LetterID + " reinviato a " + strconv.Itoa(len(letter.Queues)) + " code dei subscriber")
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"testing"
+)
+
+//Un messaggio inviato solo ad alcune code viene reinviato alle sole code a cui l'invio era fallito
+func TestRedriveToFailedQueues(t *testing.T) {
+
+	brokerQueue, queues := setupFanout(t, map[string]bool{"a": true, "b": false})
+	memory := common.MessageTransport.(*common.MemoryTransport)
+
+	message := common.Message{Version: common.MessageVersion, MessageID: "m1", Type: common.MessageEmergency, ID: "Ufficio", Topic: "Uffici", Text: "test"}
+	if err := memory.SendMessage(brokerQueue, message.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	received, _ := memory.ReceiveMessages(brokerQueue, 10, 0)
+	processMessages(brokerQueue, received)
+
+	letters, _ := deadLetterStore.GetDeadLetters()
+	if len(letters) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(letters))
+	}
+	letterID := letters[0].LetterID
+
+	steps := []struct {
+		name       string
+		createB    bool
+		wantErr    bool
+		redrives   int
+		deliveredA int
+		deliveredB int
+	}{
+		{"queue still missing", false, true, 1, 1, 0},
+		{"queue available", true, false, 0, 0, 1},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+
+			if step.createB {
+				if _, err := memory.CreateQueue("b"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := redriveDeadLetter(letterID)
+			if (err != nil) != step.wantErr {
+				t.Fatalf("error = %v, want error %v", err, step.wantErr)
+			}
+
+			letter, err := deadLetterStore.GetDeadLetter(letterID)
+			if step.wantErr && (err != nil || letter.Redrives != step.redrives || len(letter.Queues) != 1 || letter.Queues[0] != queues["b"]) {
+				t.Fatalf("dead letter %+v (%v), want %d redrives for %s", letter, err, step.redrives, queues["b"])
+			}
+			if !step.wantErr && err != errDeadLetterNotFound {
+				t.Fatalf("dead letter not removed: %v", err)
+			}
+
+			for subID, want := range map[string]int{"a": step.deliveredA, "b": step.deliveredB} {
+				delivered, _ := memory.ReceiveMessages(queues[subID], 10, 0)
+				if len(delivered) != want {
+					t.Fatalf("subscriber %s received %d messages, want %d", subID, len(delivered), want)
+				}
+				for _, queueMessage := range delivered {
+					if queueMessage.Attributes["MessageID"] != "m1" {
+						t.Fatalf("redriven message has ID %q, want m1", queueMessage.Attributes["MessageID"])
+					}
+					_ = memory.DeleteMessage(queues[subID], queueMessage.ReceiptHandle)
+				}
+			}
+		})
+	}
+}
+
+//Un messaggio reinviato sulla coda del broker mantiene il proprio identificativo, anche se ha un nuovo istante di
+//invio e il numero di reinvii tra gli attributi
+func TestRedriveKeepsMessageKey(t *testing.T) {
+
+	legacy := map[string]string{"ID": "Ufficio", "Topic": "Uffici", "Positive": "0", "PeopleNum": "3", "Mq": "50", "PositionX": "1", "PositionY": "2", "Radius": "0"}
+	invalid := map[string]string{"ID": "Ufficio", "Topic": "Uffici", "PositionX": "x"}
+	current := common.Message{Version: common.MessageVersion, MessageID: "m1", Type: common.MessageService, ID: "Ufficio", Topic: "Uffici"}.Encode().Attributes
+
+	tests := []struct {
+		name       string
+		attributes map[string]string
+	}{
+		{"legacy message", legacy},
+		{"message that cannot be decoded", invalid},
+		{"message with an ID", current},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			brokerQueue, _ := setupFanout(t, map[string]bool{})
+			conf := defaultConfig()
+			conf.GlobalSqsQueue = brokerQueue
+			setConfig(conf)
+			defer setConfig(defaultConfig())
+
+			original := common.QueueMessage{Body: "test", Attributes: test.attributes, GroupID: "g", SentTimestamp: 1000}
+			decoded, _ := common.DecodeMessage(original)
+			key := messageKey(decoded, original)
+
+			//Due reinvii successivi, il secondo con il numero di reinvii tra gli attributi
+			for redrive := 1; redrive <= 2; redrive++ {
+				if err := moveToDeadLetter(original, key, nil, errors.New("routing failed")); err != nil {
+					t.Fatal(err)
+				}
+				letters, _ := deadLetterStore.GetDeadLetters()
+				if len(letters) != 1 {
+					t.Fatalf("%d dead letters, want 1", len(letters))
+				}
+				if err := redriveDeadLetter(letters[0].LetterID); err != nil {
+					t.Fatal(err)
+				}
+
+				received, _ := common.MessageTransport.ReceiveMessages(brokerQueue, 10, 0)
+				if len(received) != 1 {
+					t.Fatalf("%d messages redriven, want 1", len(received))
+				}
+				_ = common.MessageTransport.DeleteMessage(brokerQueue, received[0].ReceiptHandle)
+
+				redriven, _ := common.DecodeMessage(received[0])
+				if redrivenKey := messageKey(redriven, received[0]); redrivenKey != key {
+					t.Fatalf("redrive %d: key %s, want %s", redrive, redrivenKey, key)
+				}
+				original = received[0]
+			}
+		})
+	}
+}
+
+//Lo spostamento nella coda dei messaggi non consegnati non modifica il messaggio ricevuto
+func TestMoveToDeadLetterKeepsMessage(t *testing.T) {
+
+	setupFanout(t, map[string]bool{})
+
+	message := common.QueueMessage{Body: "test", Attributes: map[string]string{"ID": "Ufficio", redriveAttribute: "1"}}
+	if err := moveToDeadLetter(message, "m1", nil, errors.New("routing failed")); err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Attributes[redriveAttribute] != "1" || len(message.Attributes) != 2 {
+		t.Fatalf("message attributes changed to %v", message.Attributes)
+	}
+	letters, _ := deadLetterStore.GetDeadLetters()
+	if len(letters) != 1 || letters[0].Redrives != 1 || letters[0].Attributes[redriveAttribute] != "" {
+		t.Fatalf("dead letters %+v, want one with 1 redrive and no redrive attribute", letters)
+	}
+}
+
+//Un messaggio viene reinviato nel gruppo FIFO originale, oppure in quello dei reinvii se non è noto
+func TestRedriveGroupID(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		groupID string
+		want    string
+	}{
+		{"original group", "UfficiogroupID", "UfficiogroupID"},
+		{"unknown group", "", redriveGroupID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			brokerQueue, _ := setupFanout(t, map[string]bool{})
+			conf := defaultConfig()
+			conf.GlobalSqsQueue = brokerQueue
+			setConfig(conf)
+			defer setConfig(defaultConfig())
+
+			message := common.QueueMessage{Body: "test", Attributes: map[string]string{"ID": "Ufficio"}, GroupID: test.groupID}
+			if err := moveToDeadLetter(message, "m1", nil, errors.New("routing failed")); err != nil {
+				t.Fatal(err)
+			}
+			letters, _ := deadLetterStore.GetDeadLetters()
+			if err := redriveDeadLetter(letters[0].LetterID); err != nil {
+				t.Fatal(err)
+			}
+
+			received, _ := common.MessageTransport.ReceiveMessages(brokerQueue, 10, 0)
+			if len(received) != 1 || received[0].GroupID != test.want {
+				t.Fatalf("redriven %+v, want group %s", received, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"common"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+			broker-dedup.go
+
+	Questo modulo rende idempotente l'inoltro dei messaggi. Se il broker termina (o l'eliminazione fallisce) dopo
+		aver inoltrato un messaggio ma prima di averlo eliminato dalla propria coda, il messaggio viene ricevuto di
+		nuovo: per non notificarlo una seconda volta ai subscriber, il broker memorizza per dedup_ttl secondi
+		l'identificativo dei messaggi inoltrati in un DedupStore e scarta quelli già presenti.
+	L'identificativo è il MessageID assegnato dal publisher oppure, per i publisher precedenti, un hash del
+		contenuto e dell'istante di invio del messaggio (che non cambia tra una ricezione e l'altra). Un messaggio
+		reinviato dalla coda dei messaggi non consegnati ha un nuovo istante di invio: l'identificativo originale
+		viene quindi salvato con il messaggio non consegnato e riassegnato come MessageID al reinvio. Lo stesso
+		identificativo è usato come DeduplicationID sulle code dei subscriber, per cui anche un messaggio ricevuto
+		di nuovo prima della memorizzazione (entro l'intervallo di deduplicazione delle code FIFO) non viene duplicato.
+	Lo storage è scelto nella configurazione locale (campo "DedupStore"): "memory" (default) oppure "dynamodb"
+		(tabella dedupTableName, con scadenza degli elementi sull'attributo ExpiresAt), che sopravvive ai riavvii.
+
+*/
+
+//Interfaccia per lo storage degli identificativi dei messaggi già inoltrati
+type DedupStore interface {
+	Seen(messageID string) (seen bool, retErr error)                //Verifica se il messaggio è già stato inoltrato (e non è scaduto)
+	MarkSeen(messageID string, expiresAt time.Time) (retErr error) //Memorizza un messaggio inoltrato fino all'istante expiresAt
+}
+
+const defaultDedupTableName = "dedup" //Nome di default della tabella DynamoDB dei messaggi già inoltrati
+const defaultDedupTTL = 3600          //Tempo di default (in secondi) per cui un messaggio inoltrato viene ricordato
+
+var dedupStore DedupStore //Storage dei messaggi già inoltrati utilizzato dal broker
+
+//Inizializza lo storage dei messaggi già inoltrati secondo la configurazione locale
+func initDedupStore() (retErr error) {
+
+	switch common.Config.DedupStore {
+	case "", "memory":
+		dedupStore = newMemoryDedupStore()
+	case "dynamodb":
+		dedupStore = &dynamoDedupStore{}
+	default:
+		common.Fatal("[BROKER] Storage dei messaggi inoltrati \"" + common.Config.DedupStore + "\" non supportato")
+		return errors.New("unknown dedup store " + common.Config.DedupStore)
+	}
+
+	return nil
+}
+
+//Identificativo di un messaggio ricevuto, usato per la deduplicazione
+func messageKey(message common.Message, queueMessage common.QueueMessage) string {
+
+	if message.MessageID != "" {
+		return message.MessageID
+	}
+
+	//Messaggio non decodificabile, con l'identificativo riassegnato dal reinvio
+	if messageID := queueMessage.Attributes["MessageID"]; messageID != "" {
+		return messageID
+	}
+
+	//Messaggio di un publisher precedente: hash del contenuto, ordinando gli attributi (escluso il numero di reinvii,
+	//che cambia ad ogni reinvio). Ogni campo è preceduto dalla sua lunghezza, in modo che contenuti diversi non
+	//producano la stessa sequenza di byte
+	var names []string
+	for name := range queueMessage.Attributes {
+		if name != redriveAttribute {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		writeHashField(hash, name)
+		writeHashField(hash, queueMessage.Attributes[name])
+	}
+	writeHashField(hash, queueMessage.GroupID)
+	writeHashField(hash, strconv.FormatInt(queueMessage.SentTimestamp, 10))
+	writeHashField(hash, queueMessage.Body)
+
+	return "h" + hex.EncodeToString(hash.Sum(nil))
+}
+
+//Aggiunge all'hash un campo preceduto dalla sua lunghezza
+func writeHashField(hash io.Writer, field string) {
+	_, _ = io.WriteString(hash, strconv.Itoa(len(field))+":"+field)
+}
+
+//Verifica se un messaggio è già stato inoltrato. In caso di errore dello storage il messaggio viene inoltrato
+//(eventuali duplicati sono comunque scartati dalle code FIFO)
+func alreadyForwarded(messageID string) bool {
+
+	seen, err := dedupStore.Seen(messageID)
+	if err != nil {
+		common.Warning("[BROKER] Errore nella verifica dei messaggi inoltrati. " + err.Error())
+		return false
+	}
+
+	return seen
+}
+
+//Memorizza un messaggio come inoltrato per dedup_ttl secondi
+func markForwarded(messageID string) {
+
+	err := dedupStore.MarkSeen(messageID, time.Now().Add(time.Duration(currentConfig().DedupTTL)*time.Second))
+	if err != nil {
+		common.Warning("[BROKER] Errore nella memorizzazione del messaggio inoltrato " + messageID + ". " + err.Error())
+	}
+}
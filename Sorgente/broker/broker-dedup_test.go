@@ -0,0 +1,131 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"testing"
+	"time"
+)
+
+//Identificativo usato per la deduplicazione dei messaggi ricevuti
+func TestMessageKey(t *testing.T) {
+
+	base := common.QueueMessage{Body: "testo", GroupID: "g", SentTimestamp: 1000, Attributes: map[string]string{"ID": "Ufficio", "Topic": "Uffici"}}
+
+	tests := []struct {
+		name      string
+		messageID string
+		other     common.QueueMessage //Messaggio confrontato con base
+		same      bool                //true se i due messaggi devono avere lo stesso identificativo
+	}{
+		{"same content", "", base, true},
+		{"attributes in another order", "", common.QueueMessage{Body: "testo", GroupID: "g", SentTimestamp: 1000, Attributes: map[string]string{"Topic": "Uffici", "ID": "Ufficio"}}, true},
+		{"sent at another time", "", common.QueueMessage{Body: "testo", GroupID: "g", SentTimestamp: 1001, Attributes: base.Attributes}, false},
+		{"another body", "", common.QueueMessage{Body: "testo2", GroupID: "g", SentTimestamp: 1000, Attributes: base.Attributes}, false},
+		{"attribute value moved to the name", "", common.QueueMessage{Body: "testo", GroupID: "g", SentTimestamp: 1000, Attributes: map[string]string{"ID=Ufficio\nTopic": "Uffici"}}, false},
+		{"redrive count is ignored", "", common.QueueMessage{Body: "testo", GroupID: "g", SentTimestamp: 1000, Attributes: map[string]string{"ID": "Ufficio", "Topic": "Uffici", redriveAttribute: "2"}}, true},
+		{"message ID ignores the content", "m1", common.QueueMessage{Body: "altro"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			message := common.Message{MessageID: test.messageID}
+			key, otherKey := messageKey(message, base), messageKey(message, test.other)
+
+			if (key == otherKey) != test.same {
+				t.Fatalf("keys %s and %s, want same %v", key, otherKey, test.same)
+			}
+			if test.messageID != "" && key != test.messageID {
+				t.Fatalf("key %s, want the message ID %s", key, test.messageID)
+			}
+		})
+	}
+}
+
+//I messaggi vengono ricordati fino alla scadenza
+func TestMemoryDedupStore(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		seen      bool
+	}{
+		{"not expired", time.Hour, true},
+		{"expired", -time.Second, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			store := newMemoryDedupStore()
+			if err := store.MarkSeen("m1", time.Now().Add(test.expiresIn)); err != nil {
+				t.Fatal(err)
+			}
+
+			if seen, _ := store.Seen("m1"); seen != test.seen {
+				t.Fatalf("seen = %v, want %v", seen, test.seen)
+			}
+			if seen, _ := store.Seen("m2"); seen {
+				t.Fatal("message never forwarded reported as seen")
+			}
+		})
+	}
+}
+
+//Storage dei messaggi non consegnati in cui il salvataggio fallisce
+type failingDeadLetterStore struct {
+	DeadLetterStore
+}
+
+func (store failingDeadLetterStore) AddDeadLetter(letter DeadLetter) (retErr error) {
+	return errors.New("dead letter store unavailable")
+}
+
+//Un messaggio viene memorizzato come inoltrato se inviato a tutte le code o spostato nella coda dei messaggi non
+//consegnati (da cui viene reinviato solo alle code fallite), e non viene inoltrato di nuovo
+func TestProcessMessagesDedup(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		subscribers    map[string]bool
+		failDeadLetter bool
+		forwarded      bool
+	}{
+		{"all sends succeeded", map[string]bool{"a": true, "b": true}, false, true},
+		{"one send failed", map[string]bool{"a": true, "b": false}, false, true},
+		{"dead letter not stored", map[string]bool{"a": true, "b": false}, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			brokerQueue, queues := setupFanout(t, test.subscribers)
+			if test.failDeadLetter {
+				deadLetterStore = failingDeadLetterStore{deadLetterStore}
+			}
+			message := common.Message{Version: common.MessageVersion, MessageID: "m1", Type: common.MessageEmergency, ID: "Ufficio", Topic: "Uffici", Text: "test"}
+
+			//Lo stesso messaggio ricevuto due volte, in due ReceiveMessage successive
+			for i := 0; i < 2; i++ {
+				if err := common.MessageTransport.SendMessage(brokerQueue, message.Encode()); err != nil {
+					t.Fatal(err)
+				}
+				received, _ := common.MessageTransport.ReceiveMessages(brokerQueue, 10, 0)
+				processMessages(brokerQueue, received)
+			}
+
+			if seen, _ := dedupStore.Seen("m1"); seen != test.forwarded {
+				t.Fatalf("marked as forwarded = %v, want %v", seen, test.forwarded)
+			}
+
+			//Con il messaggio memorizzato la seconda ricezione viene scartata
+			if test.forwarded {
+				delivered, _ := common.MessageTransport.ReceiveMessages(queues["a"], 10, 0)
+				if len(delivered) != 1 {
+					t.Fatalf("subscriber received %d messages, want 1", len(delivered))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+/*
+			broker-fanout.go
+
+	Questo modulo gestisce l'inoltro ai subscriber dei messaggi ricevuti dal broker con una ReceiveMessage.
+	L'elaborazione avviene in tre fasi, ognuna eseguita da un gruppo di al massimo fanout_workers goroutine:
+	 1. instradamento: ogni messaggio viene decodificato e vengono selezionate le code dei subscriber interessati
+	 2. invio: i messaggi vengono raggruppati per coda di destinazione e inviati a gruppi di fanout_batch_size
+	    (SendMessageBatch). Tutti i messaggi di una stessa coda vengono inviati dallo stesso worker, nell'ordine
+	    di ricezione, in modo da mantenere l'ordinamento FIFO per ogni subscriber
+	 3. conferma: i messaggi elaborati vengono eliminati dalla coda del broker, mentre quelli che non è stato
+	    possibile instradare o inviare a tutte le code di destinazione vengono prima spostati nella coda dei
+	    messaggi non consegnati
+	Se l'invio ad una coda fallisce perché il subscriber è stato rimosso (ad esempio attraverso un altro broker, prima
+		che l'indice spaziale venisse aggiornato), la coda viene ignorata. Negli altri casi i messaggi successivi per la stessa coda non vengono inviati (per non
+		alterarne l'ordine) e vengono anch'essi spostati nella coda dei messaggi non consegnati. Per ogni messaggio
+		vengono registrate le sole code a cui l'invio è fallito: il reinvio (vedere broker-dead-letter.go) avviene
+		solo verso queste, in modo da non duplicare il messaggio sulle code a cui è già stato consegnato.
+	I messaggi già inoltrati (ricevuti di nuovo dopo un riavvio o un'eliminazione fallita, vedere broker-dedup.go)
+	vengono eliminati senza essere inoltrati di nuovo.
+
+*/
+
+const defaultFanoutWorkers = 8    //Numero di default di worker per l'inoltro dei messaggi
+const defaultFanoutBatchSize = 10 //Numero di default di messaggi inviati con una sola richiesta
+
+//Esito dell'instradamento di un messaggio ricevuto
+type routedMessage struct {
+	message   common.Message
+	queueUrl  []string
+	err       error
+	sendErr   error    //Errore nell'invio ad almeno una delle code di destinazione
+	failed    []string //Code di destinazione a cui l'invio è fallito
+	duplicate bool  //Messaggio già inoltrato
+}
+
+//Esegue jobs operazioni con al massimo workers goroutine, attendendone il termine
+func runWorkers(workers int, jobs int, work func(job int)) {
+
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > jobs {
+		workers = jobs
+	}
+
+	jobQueue := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobQueue {
+				work(job)
+			}
+		}()
+	}
+
+	for job := 0; job < jobs; job++ {
+		jobQueue <- job
+	}
+	close(jobQueue)
+
+	wg.Wait()
+}
+
+//Inoltra ai subscriber i messaggi ricevuti ed elimina dalla coda del broker quelli elaborati, che vengono ritornati
+func processMessages(receiveQueue string, received []common.QueueMessage) (processed []common.QueueMessage) {
+
+	conf := currentConfig()
+	workers := conf.FanoutWorkers
+	batchSize := conf.FanoutBatchSize
+
+	//Instradamento dei messaggi
+	routed := make([]routedMessage, len(received))
+
+	runWorkers(workers, len(received), func(i int) {
+		message, queueUrl, err := routeMessage(conf, received[i])
+
+		//Il MessageID identifica il messaggio anche sulle code dei subscriber e nella coda dei messaggi non consegnati
+		message.MessageID = messageKey(message, received[i])
+		if err != nil {
+			routed[i] = routedMessage{message: message, err: err}
+			return
+		}
+
+		routed[i] = routedMessage{message: message, queueUrl: queueUrl, duplicate: alreadyForwarded(message.MessageID)}
+	})
+
+	//Raggruppamento dei messaggi per coda di destinazione, nell'ordine di ricezione
+	var queues []string
+	outgoing := make(map[string][]common.QueueMessage)
+	outgoingRoutes := make(map[string][]int) //Indice in routed di ogni messaggio di outgoing
+	forwarded := 0
+	batchIDs := make(map[string]bool)
+
+	for i := range routed {
+		route := &routed[i]
+		if route.err != nil {
+			continue
+		}
+
+		//Messaggi già inoltrati o ricevuti più volte nello stesso gruppo
+		if route.duplicate || batchIDs[route.message.MessageID] {
+			route.duplicate = true
+			common.Info("[BROKER] Messaggio " + route.message.MessageID + " già inoltrato, non viene inoltrato di nuovo")
+			continue
+		}
+		batchIDs[route.message.MessageID] = true
+
+		forwarded++
+		for _, url := range route.queueUrl {
+			if _, ok := outgoing[url]; !ok {
+				queues = append(queues, url)
+			}
+			outgoing[url] = append(outgoing[url], queueMessageFor(route.message, url))
+			outgoingRoutes[url] = append(outgoingRoutes[url], i)
+		}
+	}
+
+	//Invio dei messaggi, a gruppi di batchSize
+	var sendMutex sync.Mutex
+	failedQueues := make(map[string]bool)
+
+	runWorkers(workers, len(queues), func(q int) {
+
+		url := queues[q]
+		messages := outgoing[url]
+
+		for start := 0; start < len(messages); start += batchSize {
+			end := start + batchSize
+			if end > len(messages) {
+				end = len(messages)
+			}
+
+			failed, err := sendQueueMessages(url, messages[start:end])
+			if err != nil {
+				common.Fatal("[BROKER] Errore nell'invio del messaggio. " + err.Error())
+
+				//L'errore viene registrato sui messaggi non inviati di questo gruppo (tutti, se la richiesta è fallita)
+				//e su tutti quelli dei gruppi successivi, che non vengono inviati
+				if len(failed) == 0 {
+					for f := range messages[start:end] {
+						failed = append(failed, f)
+					}
+				}
+				for i := end; i < len(messages); i++ {
+					failed = append(failed, i-start)
+				}
+
+				sendErr := errors.New("sending to queue " + url + " failed: " + err.Error())
+				sendMutex.Lock()
+				failedQueues[url] = true
+				for _, f := range failed {
+					if f >= 0 && start+f < len(messages) {
+						route := &routed[outgoingRoutes[url][start+f]]
+						route.sendErr = sendErr
+						route.failed = append(route.failed, url)
+					}
+				}
+				sendMutex.Unlock()
+				return
+			}
+		}
+	})
+
+	//Le code dei subscriber rimossi nel frattempo non sono un invio fallito: i messaggi non hanno più destinatario
+	for url := range failedQueues {
+		if !subscriberRemoved(url) {
+			continue
+		}
+		common.Info("[BROKER] Il subscriber della coda " + url + " è stato rimosso, i messaggi non inviati vengono scartati")
+		for i := range routed {
+			routed[i].failed = removeQueue(routed[i].failed, url)
+			if len(routed[i].failed) == 0 {
+				routed[i].sendErr = nil
+			}
+		}
+	}
+
+	for i, route := range routed {
+		if route.err == nil && route.duplicate {
+			brokerStats.recordDuplicate()
+		} else if route.err == nil && route.sendErr == nil {
+			brokerStats.recordForwarded(received[i].SentTimestamp)
+		} else if route.err == nil {
+			forwarded--
+		}
+	}
+
+	//Memorizzazione dei messaggi inoltrati a tutte le code, prima della loro eliminazione. Quelli con un invio
+	//fallito vengono memorizzati solo dopo essere stati spostati nella coda dei messaggi non consegnati
+	runWorkers(workers, len(routed), func(i int) {
+		if routed[i].err == nil && routed[i].sendErr == nil && !routed[i].duplicate {
+			markForwarded(routed[i].message.MessageID)
+		}
+	})
+
+	common.Info("[BROKER] Inoltrati " + strconv.Itoa(forwarded) + " messaggi a " + strconv.Itoa(len(queues)) + " code")
+
+	//Conferma dei messaggi elaborati
+	var mutex sync.Mutex
+
+	runWorkers(workers, len(received), func(i int) {
+
+		mess := received[i]
+
+		reason := routed[i].err
+		if reason == nil {
+			reason = routed[i].sendErr
+		}
+
+		if reason != nil {
+			common.Warning("[BROKER] Errore nell'invio del messaggio dal broker. " + reason.Error())
+
+			//Il messaggio viene spostato nella coda dei messaggi non consegnati. Se non è possibile, non viene
+			//eliminato dalla coda e verrà ricevuto nuovamente
+			if moveToDeadLetter(mess, routed[i].message.MessageID, routed[i].failed, reason) != nil {
+				return
+			}
+			brokerStats.recordDeadLetter()
+
+			//Un messaggio instradato verrà reinviato solo alle code a cui l'invio è fallito: se venisse ricevuto di
+			//nuovo, non deve essere inoltrato alle altre
+			if routed[i].err == nil {
+				markForwarded(routed[i].message.MessageID)
+			}
+		}
+
+		//Messaggio eliminato solo dopoche viene mandato
+		err := common.MessageTransport.DeleteMessage(receiveQueue, mess.ReceiptHandle)
+		if err != nil {
+			common.Info("[BROKER] Errore nell'eliminazione del messaggio. " + err.Error())
+			return
+		}
+
+		mutex.Lock()
+		processed = append(processed, mess)
+		mutex.Unlock()
+
+		common.Info("[BROKER] Messaggio eliminato con successo")
+	})
+
+	return processed
+}
+
+//Verifica sullo storage se il subscriber a cui appartiene una coda è stato rimosso (aggiornando l'indice spaziale)
+func subscriberRemoved(queueUrl string) bool {
+
+	//Le code create prima dell'introduzione del prefisso hanno come nome il subscriber ID
+	subID := queueSubscriberID(queueUrl)
+	if subID == "" {
+		subID = queueName(queueUrl)
+	}
+
+	exists, err := refreshIndexedSubscriber(subID)
+	if err != nil {
+		common.Warning("[BROKER] Impossibile verificare il subscriber della coda " + queueUrl + ". " + err.Error())
+		return false
+	}
+
+	return !exists
+}
+
+//Rimuove una coda da una lista
+func removeQueue(queues []string, queueUrl string) (remaining []string) {
+
+	for _, url := range queues {
+		if url != queueUrl {
+			remaining = append(remaining, url)
+		}
+	}
+
+	return remaining
+}
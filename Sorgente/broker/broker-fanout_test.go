@@ -0,0 +1,291 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Ogni job viene eseguito una sola volta e da non più di workers goroutine contemporaneamente
+func TestRunWorkers(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		workers int
+		jobs    int
+		limit   int //Massimo numero di job eseguiti contemporaneamente
+	}{
+		{"no jobs", 4, 0, 0},
+		{"one worker", 1, 20, 1},
+		{"more jobs than workers", 3, 50, 3},
+		{"more workers than jobs", 16, 5, 5},
+		{"zero workers", 0, 10, 1},
+		{"negative workers", -2, 10, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var mutex sync.Mutex
+			executed := make([]int, test.jobs)
+			running, peak := 0, 0
+
+			runWorkers(test.workers, test.jobs, func(job int) {
+
+				mutex.Lock()
+				executed[job]++
+				running++
+				if running > peak {
+					peak = running
+				}
+				mutex.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+			})
+
+			for job, count := range executed {
+				if count != 1 {
+					t.Fatalf("job %d executed %d times", job, count)
+				}
+			}
+			if peak > test.limit {
+				t.Fatalf("%d jobs running at the same time, limit %d", peak, test.limit)
+			}
+		})
+	}
+}
+
+//Prepara broker, code e storage in memoria per i test dell'inoltro
+func setupFanout(t *testing.T, subscribers map[string]bool) (brokerQueue string, queues map[string]string) {
+
+	transport := common.NewMemoryTransport()
+	common.MessageTransport = transport
+	subscriberStore = newMemorySubscriberStore()
+	deadLetterStore = newMemoryDeadLetterStore()
+	dedupStore = newMemoryDedupStore()
+
+	brokerQueue, err := transport.CreateQueue("broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//I subscriber con valore false hanno una coda che non esiste (ancora), per cui l'invio fallisce
+	queues = make(map[string]string)
+	for subID, existing := range subscribers {
+		queueUrl := subID + ".fifo"
+		if existing {
+			queueUrl, err = transport.CreateQueue(subID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		queues[subID] = queueUrl
+
+		err, _ = subscriberStore.AddSubscriber(common.SubscriberEntry{SubID: subID, QueueURL: queueUrl, Topics: []string{"Uffici"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return brokerQueue, queues
+}
+
+//Un messaggio viene eliminato dalla coda del broker solo se inviato a tutte le code, altrimenti viene spostato
+//nella coda dei messaggi non consegnati
+func TestProcessMessagesSendFailure(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		subscribers map[string]bool
+		deadLetters int
+		failed      []string //Subscriber le cui code sono registrate nel messaggio non consegnato
+	}{
+		{"all queues available", map[string]bool{"a": true, "b": true}, 0, nil},
+		{"one queue missing", map[string]bool{"a": true, "b": false}, 1, []string{"b"}},
+		{"all queues missing", map[string]bool{"a": false, "b": false}, 1, []string{"a", "b"}},
+		{"no subscribers", map[string]bool{}, 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			brokerQueue, queues := setupFanout(t, test.subscribers)
+
+			message := common.Message{Version: common.MessageVersion, MessageID: "m1", Type: common.MessageEmergency, ID: "Ufficio", Topic: "Uffici", Text: "test"}
+			if err := common.MessageTransport.SendMessage(brokerQueue, message.Encode()); err != nil {
+				t.Fatal(err)
+			}
+			received, err := common.MessageTransport.ReceiveMessages(brokerQueue, 10, 0)
+			if err != nil || len(received) != 1 {
+				t.Fatalf("received %d messages: %v", len(received), err)
+			}
+
+			processed := processMessages(brokerQueue, received)
+
+			//Il messaggio viene sempre confermato: inoltrato oppure spostato nei messaggi non consegnati
+			if len(processed) != 1 {
+				t.Fatalf("%d messages processed, want 1", len(processed))
+			}
+			letters, _ := deadLetterStore.GetDeadLetters()
+			if len(letters) != test.deadLetters {
+				t.Fatalf("%d dead letters, want %d", len(letters), test.deadLetters)
+			}
+			if len(letters) == 1 {
+				if letters[0].MessageID != "m1" || len(letters[0].Queues) != len(test.failed) {
+					t.Fatalf("dead letter %s for queues %v, want m1 for %v", letters[0].MessageID, letters[0].Queues, test.failed)
+				}
+				for _, subID := range test.failed {
+					if !common.StringListContains(letters[0].Queues, queues[subID]) {
+						t.Fatalf("queue of %s not recorded in %v", subID, letters[0].Queues)
+					}
+				}
+			}
+
+			//Il messaggio, inoltrato o spostato nei messaggi non consegnati, non viene inoltrato di nuovo
+			if len(test.subscribers) > 0 && !alreadyForwarded("m1") {
+				t.Fatalf("message not marked as forwarded")
+			}
+
+			for subID, existing := range test.subscribers {
+				if !existing {
+					continue
+				}
+				delivered, _ := common.MessageTransport.ReceiveMessages(queues[subID], 10, 0)
+				if len(delivered) != 1 {
+					t.Fatalf("subscriber %s received %d messages, want 1", subID, len(delivered))
+				}
+			}
+		})
+	}
+}
+
+//Sistema di code in memoria in cui l'invio a gruppi fallisce per i messaggi con il testo indicato
+type partialTransport struct {
+	*common.MemoryTransport
+	failText string
+}
+
+func (transport partialTransport) SendMessageBatch(queueUrl string, messages []common.QueueMessage) (failed []int, retErr error) {
+
+	for i, message := range messages {
+		if message.Body == transport.failText {
+			failed = append(failed, i)
+			retErr = errors.New("entry rejected")
+			continue
+		}
+		if err := transport.SendMessage(queueUrl, message); err != nil {
+			return nil, err
+		}
+	}
+
+	return failed, retErr
+}
+
+//Dei messaggi di un gruppo vengono considerati non inviati solo quelli indicati dal sistema di code, oltre a quelli
+//dei gruppi successivi per la stessa coda
+func TestProcessMessagesPartialBatch(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		batchSize int
+		failText  string
+		delivered []string
+		dead      []string
+	}{
+		{"no failures", 10, "", []string{"m1", "m2", "m3"}, nil},
+		{"last entry fails", 10, "m3", []string{"m1", "m2"}, []string{"m3"}},
+		{"middle entry fails", 10, "m2", []string{"m1", "m3"}, []string{"m2"}},
+		{"later batches are not sent", 1, "m2", []string{"m1"}, []string{"m2", "m3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			brokerQueue, queues := setupFanout(t, map[string]bool{"a": true})
+			memory := common.MessageTransport.(*common.MemoryTransport)
+
+			conf := defaultConfig()
+			conf.FanoutBatchSize = test.batchSize
+			setConfig(conf)
+			defer setConfig(defaultConfig())
+
+			for _, id := range []string{"m1", "m2", "m3"} {
+				message := common.Message{Version: common.MessageVersion, MessageID: id, Type: common.MessageEmergency, ID: "Ufficio", Topic: "Uffici", Text: id}
+				if err := memory.SendMessage(brokerQueue, message.Encode()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			received, err := memory.ReceiveMessages(brokerQueue, 10, 0)
+			if err != nil || len(received) != 3 {
+				t.Fatalf("received %d messages: %v", len(received), err)
+			}
+
+			common.MessageTransport = partialTransport{MemoryTransport: memory, failText: test.failText}
+			processMessages(brokerQueue, received)
+
+			delivered, _ := memory.ReceiveMessages(queues["a"], 10, 0)
+			var deliveredIDs []string
+			for _, message := range delivered {
+				deliveredIDs = append(deliveredIDs, message.Body)
+			}
+			if common.ConcatenateArrayValues(deliveredIDs, ",") != common.ConcatenateArrayValues(test.delivered, ",") {
+				t.Fatalf("delivered %v, want %v", deliveredIDs, test.delivered)
+			}
+
+			letters, _ := deadLetterStore.GetDeadLetters()
+			var deadIDs []string
+			for _, letter := range letters {
+				deadIDs = append(deadIDs, letter.MessageID)
+			}
+			sort.Strings(deadIDs)
+			if common.ConcatenateArrayValues(deadIDs, ",") != common.ConcatenateArrayValues(test.dead, ",") {
+				t.Fatalf("dead letters %v, want %v", deadIDs, test.dead)
+			}
+		})
+	}
+}
+
+//Un subscriber rimosso attraverso un altro broker resta nell'indice fino alla sua ricostruzione: l'invio fallito
+//alla sua coda non sposta il messaggio nella coda dei messaggi non consegnati e lo rimuove dall'indice
+func TestProcessMessagesRemovedSubscriber(t *testing.T) {
+
+	brokerQueue, queues := setupFanout(t, map[string]bool{"a": true, "b": false})
+
+	backend := subscriberStore
+	indexed := newIndexedSubscriberStore(backend)
+	if err := indexed.refresh(defaultIndexCellSize); err != nil {
+		t.Fatal(err)
+	}
+	subscriberStore = indexed
+	defer func() { subscriberStore = backend }()
+
+	if err := backend.RemoveSubscriber("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	message := common.Message{Version: common.MessageVersion, MessageID: "m1", Type: common.MessageEmergency, ID: "Ufficio", Topic: "Uffici", Text: "test"}
+	if err := common.MessageTransport.SendMessage(brokerQueue, message.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	received, _ := common.MessageTransport.ReceiveMessages(brokerQueue, 10, 0)
+
+	if processed := processMessages(brokerQueue, received); len(processed) != 1 {
+		t.Fatalf("%d messages processed, want 1", len(processed))
+	}
+	if letters, _ := deadLetterStore.GetDeadLetters(); len(letters) != 0 {
+		t.Fatalf("%d dead letters, want 0", len(letters))
+	}
+	if _, indexedB := indexed.index.entries["b"]; indexedB {
+		t.Fatalf("removed subscriber still indexed")
+	}
+	if delivered, _ := common.MessageTransport.ReceiveMessages(queues["a"], 10, 0); len(delivered) != 1 {
+		t.Fatalf("subscriber a received %d messages, want 1", len(delivered))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"common"
+	"math"
+)
+
+/*
+			broker-geo.go
+
+	Questo modulo gestisce le posizioni geografiche reali (latitudine e longitudine WGS84) di publisher e subscriber.
+	Le coordinate a blocchi (PositionX, PositionY) continuano ad essere supportate: la griglia viene ancorata ad
+		un'origine geografica (grid_origin_lat, grid_origin_lon) e ogni blocco è un quadrato di lato grid_block_size
+		metri, con l'asse X verso est e l'asse Y verso nord. In questo modo ogni posizione può essere convertita
+		nell'altro sistema di coordinate.
+	I messaggi con posizione geografica vengono prima filtrati sul quadrato di blocchi che contiene l'area (così da
+		poter usare l'indice spaziale e la FilterExpression di DynamoDB), e poi controllati in maniera esatta
+		con la distanza in metri (formula dell'emisenoverso per la metrica euclidea).
+
+*/
+
+const earthRadius = 6371008.8          //Raggio medio terrestre (in metri)
+const geoDistanceEpsilon = 1e-6        //Tolleranza (in metri) nel confronto tra distanza e raggio
+const defaultGridBlockSize = 100.0     //Lato di default di un blocco della griglia (in metri)
+const maxGridLatitude = 89.0           //Oltre questa latitudine la proiezione sulla griglia non è utilizzabile
+
+//Converte gradi in radianti
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+//Converte radianti in gradi
+func toDegrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+//Griglia dei blocchi (parametri di configurazione grid_origin_lat, grid_origin_lon e grid_block_size)
+type gridConfig struct {
+	OriginLat float64 //Latitudine dell'origine (blocco 0, 0)
+	OriginLon float64 //Longitudine dell'origine (blocco 0, 0)
+	BlockSize float64 //Lato (in metri) di un blocco
+}
+
+//Posizione geografica del centro di un blocco della griglia
+func (grid gridConfig) blockToGeo(positionX int, positionY int) (latitude float64, longitude float64) {
+
+	latitude = grid.OriginLat + toDegrees(float64(positionY)*grid.BlockSize/earthRadius)
+	longitude = grid.OriginLon + toDegrees(float64(positionX)*grid.BlockSize/(earthRadius*math.Cos(toRadians(grid.OriginLat))))
+
+	return latitude, longitude
+}
+
+//Blocco della griglia che contiene la posizione geografica data
+func (grid gridConfig) geoToBlock(latitude float64, longitude float64) (positionX int, positionY int) {
+
+	north := toRadians(latitude-grid.OriginLat) * earthRadius
+	east := toRadians(longitude-grid.OriginLon) * earthRadius * math.Cos(toRadians(grid.OriginLat))
+
+	return int(math.Round(east / grid.BlockSize)), int(math.Round(north / grid.BlockSize))
+}
+
+//Posizione geografica di un subscriber (derivata dal blocco se il subscriber non ha comunicato latitudine e longitudine)
+func (grid gridConfig) subscriberCoordinates(entry common.SubscriberEntry) (latitude float64, longitude float64) {
+
+	if entry.Latitude == 0 && entry.Longitude == 0 {
+		return grid.blockToGeo(entry.PositionX, entry.PositionY)
+	}
+
+	return entry.Latitude, entry.Longitude
+}
+
+//Distanza (in metri) tra due posizioni geografiche secondo la metrica indicata
+func geoDistance(mode string, lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+
+	deltaLat := toRadians(lat2 - lat1)
+	deltaLon := toRadians(lon2 - lon1)
+
+	//Differenza di longitudine nell'intervallo [-pi, pi] (posizioni a cavallo dell'antimeridiano)
+	if deltaLon > math.Pi {
+		deltaLon -= 2 * math.Pi
+	} else if deltaLon < -math.Pi {
+		deltaLon += 2 * math.Pi
+	}
+
+	switch mode {
+	case distanceSquare, distanceManhattan:
+
+		//Componenti nord ed est della distanza, calcolate alla latitudine media
+		north := math.Abs(deltaLat) * earthRadius
+		east := math.Abs(deltaLon) * earthRadius * math.Cos(toRadians((lat1+lat2)/2))
+
+		if mode == distanceSquare {
+			return math.Max(north, east)
+		}
+		return north + east
+
+	default:
+
+		//Formula dell'emisenoverso
+		a := math.Sin(deltaLat/2)*math.Sin(deltaLat/2) +
+			math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(deltaLon/2)*math.Sin(deltaLon/2)
+
+		return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+	}
+}
+
+//Crea un filtro per una posizione geografica con raggio in metri, secondo la griglia e la metrica della configurazione
+func newGeoFilter(conf *BrokerConfig, topic string, latitude float64, longitude float64, radiusMeters float64) SubscriberFilter {
+
+	grid := conf.Grid
+	positionX, positionY := grid.geoToBlock(latitude, longitude)
+
+	//Il raggio convertito dai blocchi può superare quello accettato nei messaggi (vedere Message.Validate): oltre
+	//common.MaxRadiusMeters l'area contiene già tutta la Terra
+	radiusMeters = math.Min(radiusMeters, common.MaxRadiusMeters)
+
+	//Raggio in blocchi del quadrato usato come prefiltro. Sulla griglia le distanze verso est sono scalate di
+	//cos(grid_origin_lat)/cos(latitudine), che viene valutato alla latitudine dell'area più lontana dall'equatore
+	farthestLatitude := math.Min(maxGridLatitude, math.Abs(latitude)+toDegrees(radiusMeters/earthRadius))
+	stretch := math.Max(1, math.Cos(toRadians(grid.OriginLat))/math.Cos(toRadians(farthestLatitude)))
+
+	//Un blocco in più per via dell'arrotondamento della posizione dei subscriber al blocco più vicino
+	//Il raggio viene limitato prima della conversione ad int, che altrimenti potrebbe andare in overflow
+	radius := int(math.Min(math.Ceil(radiusMeters*stretch/grid.BlockSize), maxFilterRadius)) + 1
+
+	return SubscriberFilter{
+		Topic:        topic,
+		Spatial:      true,
+		PositionX:    positionX,
+		PositionY:    positionY,
+		Radius:       radius,
+		Distance:     conf.DistanceMode,
+		Geo:          true,
+		Grid:         grid,
+		Latitude:     latitude,
+		Longitude:    longitude,
+		RadiusMeters: radiusMeters,
+	}
+}
+
+//Verifica se un subscriber si trova entro il raggio in metri del filtro
+func (filter SubscriberFilter) matchesGeo(entry common.SubscriberEntry) bool {
+
+	latitude, longitude := filter.Grid.subscriberCoordinates(entry)
+
+	return geoDistance(filter.Distance, filter.Latitude, filter.Longitude, latitude, longitude) <= filter.RadiusMeters+geoDistanceEpsilon
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"common"
+	"math"
+	"testing"
+)
+
+//Griglia usata dai test, ancorata a Roma con blocchi di 100 metri
+var testGrid = gridConfig{OriginLat: 41.9, OriginLon: 12.5, BlockSize: 100}
+
+//La conversione di un blocco in posizione geografica e viceversa riporta allo stesso blocco
+func TestGridRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name string
+		grid gridConfig
+		x, y int
+	}{
+		{"origin", testGrid, 0, 0},
+		{"north east", testGrid, 25, 40},
+		{"south west", testGrid, -1000, -731},
+		{"equator", gridConfig{BlockSize: 100}, 12345, -6789},
+		{"small blocks", gridConfig{OriginLat: 60, OriginLon: -20, BlockSize: 0.5}, -3, 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			latitude, longitude := test.grid.blockToGeo(test.x, test.y)
+			x, y := test.grid.geoToBlock(latitude, longitude)
+
+			if x != test.x || y != test.y {
+				t.Fatalf("block (%d, %d) converted back to (%d, %d)", test.x, test.y, x, y)
+			}
+		})
+	}
+}
+
+//Blocco che contiene una posizione geografica
+func TestGeoToBlock(t *testing.T) {
+
+	tests := []struct {
+		name                string
+		latitude, longitude float64
+		x, y                int
+	}{
+		{"origin", 41.9, 12.5, 0, 0},
+		{"one kilometer north", 41.9 + toDegrees(1000/earthRadius), 12.5, 0, 10},
+		{"rounded to the nearest block", 41.9 - toDegrees(149/earthRadius), 12.5, 0, -1},
+		{"one kilometer east", 41.9, 12.5 + toDegrees(1000/(earthRadius*math.Cos(toRadians(41.9)))), 10, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			x, y := testGrid.geoToBlock(test.latitude, test.longitude)
+			if x != test.x || y != test.y {
+				t.Fatalf("got (%d, %d), want (%d, %d)", x, y, test.x, test.y)
+			}
+		})
+	}
+}
+
+//I subscriber senza latitudine e longitudine vengono posizionati al centro del proprio blocco
+func TestSubscriberCoordinates(t *testing.T) {
+
+	blockLat, blockLon := testGrid.blockToGeo(3, -2)
+
+	tests := []struct {
+		name                string
+		entry               common.SubscriberEntry
+		latitude, longitude float64
+	}{
+		{"block only", common.SubscriberEntry{PositionX: 3, PositionY: -2}, blockLat, blockLon},
+		{"geographic position", common.SubscriberEntry{PositionX: 3, PositionY: -2, Latitude: 45.1, Longitude: 7.6}, 45.1, 7.6},
+		{"zero latitude only", common.SubscriberEntry{Latitude: 0, Longitude: 7.6}, 0, 7.6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			latitude, longitude := testGrid.subscriberCoordinates(test.entry)
+			if latitude != test.latitude || longitude != test.longitude {
+				t.Fatalf("got (%f, %f), want (%f, %f)", latitude, longitude, test.latitude, test.longitude)
+			}
+		})
+	}
+}
+
+//Distanza in metri nelle diverse metriche
+func TestGeoDistance(t *testing.T) {
+
+	degree := toRadians(1) * earthRadius //Lunghezza di un grado di meridiano
+
+	tests := []struct {
+		name                   string
+		mode                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", distanceEuclidean, 41.9, 12.5, 41.9, 12.5, 0},
+		{"one degree of latitude", distanceEuclidean, 10, 20, 11, 20, degree},
+		{"one degree of longitude at the equator", distanceSquare, 0, 20, 0, 21, degree},
+		{"across the antimeridian", distanceEuclidean, 0, 179.5, 0, -179.5, degree},
+		{"manhattan sums the components", distanceManhattan, 0, 0, 1, 1, degree + degree*math.Cos(toRadians(0.5))},
+		{"square takes the largest component", distanceSquare, 0, 0, 2, 1, 2 * degree},
+		{"antipodes", distanceEuclidean, 0, 0, 0, 180, math.Pi * earthRadius},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got := geoDistance(test.mode, test.lat1, test.lon1, test.lat2, test.lon2)
+			if math.Abs(got-test.want) > 1e-3 {
+				t.Fatalf("got %f, want %f", got, test.want)
+			}
+		})
+	}
+}
+
+//Il filtro geografico seleziona i subscriber entro il raggio in metri, anche se sul bordo di un blocco
+func TestGeoFilter(t *testing.T) {
+
+	conf := &BrokerConfig{Grid: testGrid, DistanceMode: distanceEuclidean}
+
+	tests := []struct {
+		name         string
+		north, east  float64 //Posizione del subscriber rispetto al centro del filtro (in metri)
+		radiusMeters float64
+		want         bool
+	}{
+		{"center", 0, 0, 500, true},
+		{"inside", 300, -300, 500, true},
+		{"on the border", 0, 500, 500, true},
+		{"just outside", 0, 501, 500, false},
+		{"outside the square", 0, 2000, 500, false},
+		{"radius zero", 0, 0, 0, true},
+		{"radius smaller than a block", 40, 0, 30, false},
+		{"radius larger than the Earth", 0, 1e6, 1e12, true},
+	}
+
+	latitude, longitude := 41.95, 12.45
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			filter := newGeoFilter(conf, "", latitude, longitude, test.radiusMeters)
+
+			entry := common.SubscriberEntry{
+				SubID:     "a",
+				Latitude:  latitude + toDegrees(test.north/earthRadius),
+				Longitude: longitude + toDegrees(test.east/(earthRadius*math.Cos(toRadians(latitude)))),
+			}
+			entry.PositionX, entry.PositionY = testGrid.geoToBlock(entry.Latitude, entry.Longitude)
+
+			if got := filter.matches(entry); got != test.want {
+				t.Fatalf("matches = %v, want %v (filter radius %d blocks)", got, test.want, filter.Radius)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"common"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+			broker-reconcile.go
+
+	Questo modulo confronta le code dei subscriber (quelle il cui nome inizia con queuePrefix) con lo storage dei
+		subscriber, segnalando:
+	 - le code orfane, cioè senza un subscriber registrato (ad esempio se la registrazione è fallita dopo la
+	   creazione della coda, o la rimozione del subscriber non ha trovato la coda)
+	 - i subscriber senza coda (ad esempio se la coda è stata eliminata)
+	 - i subscriber con una coda creata prima dell'introduzione del prefisso, il cui nome è il solo subscriber ID
+	Se richiesto, le incongruenze vengono corrette eliminando le code orfane, ricreando le code mancanti e migrando
+		le code senza prefisso: i messaggi vengono spostati nella nuova coda con il prefisso e la vecchia coda viene
+		eliminata. La migrazione avviene anche alla ripresa del subscriber, che riceve l'URL della nuova coda.
+	Le code orfane create da meno di un intervallo di riconciliazione non vengono eliminate, perché potrebbero
+		appartenere ad una registrazione in corso (la coda viene creata prima di aggiungere il subscriber).
+	La riconciliazione viene eseguita ogni reconcile_delay secondi (solo segnalazione, o anche correzione se
+		reconcile_mode è "repair") e su richiesta con POST /admin/reconcile?dryRun=false.
+
+*/
+
+const defaultQueuePrefix = "dgds-sub-" //Prefisso di default del nome delle code dei subscriber
+const defaultReconcileDelay = 3600     //Intervallo di default tra due riconciliazioni (in secondi)
+
+//Modalità della riconciliazione periodica (parametro di configurazione reconcile_mode)
+const (
+	reconcileReport = "report" //Le incongruenze vengono solo segnalate
+	reconcileRepair = "repair" //Le incongruenze vengono corrette
+)
+
+//Esito di una riconciliazione
+type ReconcileReport struct {
+	Timestamp     string   //Istante della riconciliazione
+	DryRun        bool     //Se true le incongruenze sono state solo segnalate
+	Queues        int      //Numero di code dei subscriber trovate
+	Subscribers   int      //Numero di subscriber registrati
+	OrphanQueues  []string //Code senza un subscriber registrato
+	MissingQueues []string //Subscriber (ID) la cui coda non esiste
+	LegacyQueues  []string //Subscriber (ID) la cui coda non ha il prefisso
+	Repaired      []string `json:",omitempty"` //Code eliminate o ricreate
+	Skipped       []string `json:",omitempty"` //Code orfane non eliminate perché create di recente
+	Failed        []string `json:",omitempty"` //Correzioni non riuscite, con il motivo
+}
+
+//Età minima di una coda orfana per essere eliminata: un intervallo di riconciliazione (quello di default se la
+//riconciliazione periodica è disabilitata)
+func orphanGracePeriod() time.Duration {
+
+	delay := currentConfig().ReconcileDelay
+	if delay <= 0 {
+		delay = defaultReconcileDelay
+	}
+
+	return time.Second * time.Duration(delay)
+}
+
+//Nome della coda di un subscriber
+func subscriberQueueName(subID string) string {
+	return currentConfig().QueuePrefix + subID
+}
+
+//Nome di una coda, ricavato dall'URL
+func queueName(queueUrl string) string {
+
+	name := queueUrl[strings.LastIndex(queueUrl, "/")+1:]
+
+	return strings.TrimSuffix(name, ".fifo")
+}
+
+//ID del subscriber a cui appartiene una coda, ricavato dal nome ("" se la coda non è di un subscriber)
+func queueSubscriberID(queueUrl string) string {
+
+	name := queueName(queueUrl)
+
+	prefix := currentConfig().QueuePrefix
+	if !strings.HasPrefix(name, prefix) {
+		return ""
+	}
+
+	return strings.TrimPrefix(name, prefix)
+}
+
+//Indica se la coda di un subscriber è stata creata prima dell'introduzione del prefisso (il nome è il subscriber ID)
+func isLegacyQueue(sub common.SubscriberEntry) bool {
+	return sub.QueueURL != "" && currentConfig().QueuePrefix != "" && queueName(sub.QueueURL) == sub.SubID
+}
+
+//Verifica se una coda esiste
+func queueExists(queueUrl string) (exists bool, retErr error) {
+
+	queues, err := common.MessageTransport.ListQueues(queueName(queueUrl))
+	if err != nil {
+		return false, err
+	}
+
+	return common.StringListContains(queues, queueUrl), nil
+}
+
+//Sposta tutti i messaggi di una coda in un'altra, ritornando il numero di messaggi spostati
+func moveQueueMessages(fromUrl string, toUrl string) (moved int, retErr error) {
+
+	for {
+		messages, err := common.MessageTransport.ReceiveMessages(fromUrl, common.MaxBatchSize, 1)
+		if err != nil {
+			return moved, err
+		}
+		if len(messages) == 0 {
+			return moved, nil
+		}
+
+		for _, message := range messages {
+
+			//L'identificativo del messaggio resta lo stesso, per cui un messaggio già spostato non viene duplicato
+			outgoing := common.QueueMessage{
+				Body:            message.Body,
+				Attributes:      message.Attributes,
+				GroupID:         queueGroupID(toUrl),
+				DeduplicationID: messageKey(common.Message{MessageID: message.Attributes["MessageID"]}, message),
+			}
+
+			err = common.MessageTransport.SendMessage(toUrl, outgoing)
+			if err != nil {
+				return moved, err
+			}
+			err = common.MessageTransport.DeleteMessage(fromUrl, message.ReceiptHandle)
+			if err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+}
+
+//Migra la coda senza prefisso di un subscriber nella coda queueUrl: i messaggi vengono spostati prima e dopo
+//l'aggiornamento dell'URL nello storage (per quelli inoltrati nel frattempo), poi la vecchia coda viene eliminata
+func migrateLegacyQueue(sub common.SubscriberEntry, queueUrl string) (retErr error) {
+
+	exists, err := queueExists(sub.QueueURL)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	if exists {
+		moved, err = moveQueueMessages(sub.QueueURL, queueUrl)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = subscriberStore.UpdateQueueURL(sub.SubID, queueUrl)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		residual, err := moveQueueMessages(sub.QueueURL, queueUrl)
+		if err != nil {
+			return err
+		}
+		err = deleteQueue(sub.QueueURL)
+		if err != nil {
+			return err
+		}
+		moved += residual
+	}
+
+	common.Warning("[BROKER] La coda senza prefisso del subscriber " + sub.SubID + " è stata migrata all'URL " + queueUrl +
+		" (" + strconv.Itoa(moved) + " messaggi spostati)")
+
+	return nil
+}
+
+//Crea (se non esiste) la coda di un subscriber e aggiorna il suo URL nello storage se è cambiato, migrando la
+//coda senza prefisso se presente
+func ensureSubscriberQueue(sub common.SubscriberEntry) (queueUrl string, retErr error) {
+
+	//La creazione della coda è idempotente: se la coda esiste già viene ritornato il suo URL
+	queueUrl, err := createQueue(subscriberQueueName(sub.SubID))
+	if err != nil {
+		return "", err
+	}
+
+	if queueUrl == sub.QueueURL {
+		return queueUrl, nil
+	}
+
+	if isLegacyQueue(sub) {
+		err = migrateLegacyQueue(sub, queueUrl)
+		if err != nil {
+			return "", err
+		}
+		return queueUrl, nil
+	}
+
+	common.Warning("[BROKER] La coda del subscriber " + sub.SubID + " è stata ricreata all'URL " + queueUrl)
+
+	err = subscriberStore.UpdateQueueURL(sub.SubID, queueUrl)
+	if err != nil {
+		return "", err
+	}
+
+	return queueUrl, nil
+}
+
+//Confronta le code dei subscriber con lo storage e, se dryRun è false, corregge le incongruenze
+func reconcile(dryRun bool) (report ReconcileReport, retErr error) {
+
+	report = ReconcileReport{
+		Timestamp:     time.Now().Format(time.RFC3339),
+		DryRun:        dryRun,
+		OrphanQueues:  []string{},
+		MissingQueues: []string{},
+		LegacyQueues:  []string{},
+	}
+
+	//Le code vengono elencate prima di leggere i subscriber: una registrazione in corso crea la coda prima di
+	//aggiungere il subscriber, per cui la sua coda o non viene elencata o ha già il subscriber registrato
+	queues, err := common.MessageTransport.ListQueues(currentConfig().QueuePrefix)
+	if err != nil {
+		return report, err
+	}
+
+	subs, err := subscriberStore.GetSubscribers()
+	if err != nil {
+		return report, err
+	}
+
+	report.Queues = len(queues)
+	report.Subscribers = len(subs)
+
+	existingQueues := make(map[string]bool)
+	for _, queueUrl := range queues {
+		existingQueues[queueUrl] = true
+	}
+
+	registered := make(map[string]common.SubscriberEntry)
+	for _, sub := range subs {
+		registered[sub.SubID] = sub
+	}
+
+	//Subscriber senza coda o con la coda senza prefisso (che non viene elencata con le code dei subscriber)
+	var repair []common.SubscriberEntry
+	for _, sub := range subs {
+		if existingQueues[sub.QueueURL] {
+			continue
+		}
+
+		legacy := false
+		if isLegacyQueue(sub) {
+			legacy, err = queueExists(sub.QueueURL)
+			if err != nil {
+				return report, err
+			}
+		}
+
+		if legacy {
+			report.LegacyQueues = append(report.LegacyQueues, sub.SubID)
+		} else {
+			report.MissingQueues = append(report.MissingQueues, sub.SubID)
+		}
+		repair = append(repair, sub)
+	}
+
+	//Code orfane (la coda di un subscriber registrato con un URL diverso è già tra i subscriber senza coda)
+	for _, queueUrl := range queues {
+		if _, ok := registered[queueSubscriberID(queueUrl)]; !ok {
+			report.OrphanQueues = append(report.OrphanQueues, queueUrl)
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, queueUrl := range report.OrphanQueues {
+
+		//Il subscriber potrebbe essersi registrato dopo la lettura dello storage
+		_, err := subscriberStore.GetSubscriber(queueSubscriberID(queueUrl))
+		if err != errSubscriberNotFound {
+			continue
+		}
+
+		//Una coda recente potrebbe essere di una registrazione non ancora completata
+		createdAt, err := common.MessageTransport.QueueCreatedAt(queueUrl)
+		if err != nil {
+			report.Failed = append(report.Failed, queueUrl+": "+err.Error())
+			continue
+		}
+		if time.Since(createdAt) < orphanGracePeriod() {
+			report.Skipped = append(report.Skipped, queueUrl)
+			continue
+		}
+
+		err = deleteQueue(queueUrl)
+		if err != nil {
+			report.Failed = append(report.Failed, queueUrl+": "+err.Error())
+			continue
+		}
+		report.Repaired = append(report.Repaired, queueUrl)
+	}
+
+	for _, sub := range repair {
+
+		queueUrl, err := ensureSubscriberQueue(sub)
+		if err != nil {
+			report.Failed = append(report.Failed, sub.SubID+": "+err.Error())
+			continue
+		}
+		report.Repaired = append(report.Repaired, queueUrl)
+	}
+
+	return report, nil
+}
+
+//Esegue una riconciliazione registrandone l'esito nel log
+func runReconciliation(dryRun bool) (report ReconcileReport, retErr error) {
+
+	report, err := reconcile(dryRun)
+	if err != nil {
+		common.Warning("[BROKER] Errore nella riconciliazione tra subscriber e code. " + err.Error())
+		return report, err
+	}
+
+	for _, queueUrl := range report.OrphanQueues {
+		common.Warning("[BROKER] Coda senza subscriber: " + queueUrl)
+	}
+	for _, subID := range report.MissingQueues {
+		common.Warning("[BROKER] Subscriber senza coda: " + subID)
+	}
+	for _, subID := range report.LegacyQueues {
+		common.Warning("[BROKER] Subscriber con la coda senza prefisso: " + subID)
+	}
+	for _, queueUrl := range report.Skipped {
+		common.Info("[BROKER] Coda senza subscriber creata di recente, non eliminata: " + queueUrl)
+	}
+	for _, failure := range report.Failed {
+		common.Warning("[BROKER] Correzione non riuscita: " + failure)
+	}
+
+	common.Info("[BROKER] Riconciliazione completata: " + strconv.Itoa(report.Queues) + " code, " + strconv.Itoa(report.Subscribers) +
+		" subscriber, " + strconv.Itoa(len(report.OrphanQueues)) + " code orfane, " + strconv.Itoa(len(report.MissingQueues)) +
+		" code mancanti, " + strconv.Itoa(len(report.LegacyQueues)) + " code senza prefisso, " + strconv.Itoa(len(report.Repaired)) + " correzioni")
+
+	return report, nil
+}
+
+//Avvia la goroutine che esegue periodicamente la riconciliazione (fino all'annullamento del contesto)
+func startReconciliation(ctx context.Context) {
+
+	//Alla modifica dell'intervallo la riconciliazione viene ripianificata
+	wakeup := configWakeup(func(old *BrokerConfig, updated *BrokerConfig) bool {
+		return old.ReconcileDelay != updated.ReconcileDelay
+	})
+
+	go func() {
+		for {
+
+			//Con la riconciliazione periodica disabilitata si attende solo una modifica della configurazione
+			wait := time.Hour
+			if delay := currentConfig().ReconcileDelay; delay > 0 {
+				wait = time.Second * time.Duration(delay)
+			}
+
+			if !sleepUntilWakeup(ctx, wakeup, wait) {
+				return
+			}
+
+			conf := currentConfig()
+			if conf.ReconcileDelay > 0 {
+				_, _ = runReconciliation(conf.ReconcileMode != reconcileRepair)
+			}
+		}
+	}()
+}
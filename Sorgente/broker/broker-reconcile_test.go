@@ -0,0 +1,161 @@
+package main
+
+import (
+	"common"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Prepara code e subscriber in memoria per i test della riconciliazione. Le code di legacy hanno il nome senza
+//prefisso e contengono un messaggio
+func setupReconcile(t *testing.T, prefixed []string, legacy []string, orphans []string) (transport *common.MemoryTransport) {
+
+	transport = common.NewMemoryTransport()
+	common.MessageTransport = transport
+	subscriberStore = newMemorySubscriberStore()
+
+	add := func(subID string, queueUrl string) {
+		if err, _ := subscriberStore.AddSubscriber(common.SubscriberEntry{SubID: subID, QueueURL: queueUrl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, subID := range prefixed {
+		queueUrl, _ := transport.CreateQueue(subscriberQueueName(subID))
+		add(subID, queueUrl)
+	}
+	for _, subID := range legacy {
+		queueUrl, _ := transport.CreateQueue(subID)
+		message := common.QueueMessage{Body: "pending " + subID, Attributes: map[string]string{"MessageID": "m-" + subID}, GroupID: "g"}
+		if err := transport.SendMessage(queueUrl, message); err != nil {
+			t.Fatal(err)
+		}
+		add(subID, queueUrl)
+	}
+	for _, subID := range orphans {
+		_, _ = transport.CreateQueue(subscriberQueueName(subID))
+	}
+
+	return transport
+}
+
+//Le code senza prefisso vengono segnalate a parte e migrate, senza lasciare code orfane
+func TestReconcileLegacyQueues(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		prefixed    []string
+		legacy      []string
+		orphans     []string
+		wantLegacy  []string
+		wantOrphans []string
+	}{
+		{"consistent", []string{"a", "b"}, nil, nil, []string{}, []string{}},
+		{"legacy queue", []string{"a"}, []string{"old"}, nil, []string{"old"}, []string{}},
+		{"legacy and orphan", nil, []string{"old1", "old2"}, []string{"gone"}, []string{"old1", "old2"}, []string{"dgds-sub-gone.fifo"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			transport := setupReconcile(t, test.prefixed, test.legacy, test.orphans)
+
+			report, err := reconcile(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report.LegacyQueues, test.wantLegacy) || !reflect.DeepEqual(report.OrphanQueues, test.wantOrphans) ||
+				len(report.MissingQueues) != 0 {
+				t.Fatalf("unexpected report %+v", report)
+			}
+
+			report, err = reconcile(false)
+			if err != nil || len(report.Failed) != 0 {
+				t.Fatalf("repair failed: %v %v", err, report.Failed)
+			}
+
+			//Ogni subscriber senza prefisso ha la nuova coda, con il messaggio che era in attesa
+			for _, subID := range test.legacy {
+				sub, _ := subscriberStore.GetSubscriber(subID)
+				if sub.QueueURL != subscriberQueueName(subID)+".fifo" {
+					t.Fatalf("subscriber %s still uses queue %s", subID, sub.QueueURL)
+				}
+				messages, _ := transport.ReceiveMessages(sub.QueueURL, 10, 0)
+				if len(messages) != 1 || messages[0].Body != "pending "+subID {
+					t.Fatalf("subscriber %s: pending messages not migrated: %v", subID, messages)
+				}
+			}
+
+			//Dopo la correzione restano le code con il prefisso dei subscriber registrati e le code orfane appena
+			//create, che non vengono eliminate
+			queues, _ := transport.ListQueues("")
+			if len(queues) != len(test.prefixed)+len(test.legacy)+len(test.orphans) || len(report.Skipped) != len(test.orphans) {
+				t.Fatalf("queues after repair: %v (skipped %v)", queues, report.Skipped)
+			}
+
+			report, _ = reconcile(true)
+			if len(report.LegacyQueues)+len(report.MissingQueues) != 0 || !reflect.DeepEqual(report.OrphanQueues, test.wantOrphans) {
+				t.Fatalf("inconsistencies after repair: %+v", report)
+			}
+		})
+	}
+}
+
+//La ripresa di un subscriber con la coda senza prefisso la migra
+func TestEnsureSubscriberQueueMigratesLegacy(t *testing.T) {
+
+	transport := setupReconcile(t, nil, []string{"old"}, nil)
+	sub, _ := subscriberStore.GetSubscriber("old")
+
+	queueUrl, err := ensureSubscriberQueue(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := queueExists(sub.QueueURL); exists {
+		t.Fatal("legacy queue not deleted")
+	}
+	if messages, _ := transport.ReceiveMessages(queueUrl, 10, 0); len(messages) != 1 {
+		t.Fatalf("%d messages in the new queue, want 1", len(messages))
+	}
+}
+
+//Le code orfane vengono eliminate solo dopo un intervallo di riconciliazione dalla loro creazione
+func TestReconcileSkipsRecentQueues(t *testing.T) {
+
+	conf := defaultConfig()
+	conf.ReconcileDelay = 1
+	setConfig(conf)
+	defer setConfig(defaultConfig())
+
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		deleted bool
+	}{
+		{"just created", 0, false},
+		{"older than the interval", 1100 * time.Millisecond, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			transport := setupReconcile(t, []string{"a"}, nil, []string{"registering"})
+			time.Sleep(test.wait)
+
+			report, err := reconcile(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exists, _ := queueExists("dgds-sub-registering.fifo")
+			if exists == test.deleted || (len(report.Skipped) == 0) != test.deleted {
+				t.Fatalf("orphan queue deleted = %v, want %v (report %+v)", !exists, test.deleted, report)
+			}
+			if _, err := transport.QueueCreatedAt("dgds-sub-a.fifo"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"common"
+)
+
+/*
+			broker-routing.go
+
+	Questo modulo contiene le regole di inoltro dei messaggi: per ogni tipo di messaggio (vedere common.Message)
+		viene indicato a quali subscriber deve essere inoltrato e quali controlli deve effettuare il broker.
+	 - occupancy: subscriber del topic entro il raggio del messaggio (tutti i subscriber del topic se il raggio è 0)
+	 - positive:  tutti i subscriber entro positive_radius, a prescindere dal topic
+	 - emergency: subscriber del topic entro il raggio del messaggio (tutti i subscriber del topic se il raggio è 0)
+	 - service:   tutti i subscriber del topic, a prescindere dalla posizione
+
+*/
+
+//Regola di inoltro di un tipo di messaggio
+type routingRule struct {
+	AnyTopic       bool //Il messaggio viene inoltrato a prescindere dal topic dei subscriber
+	Spatial        bool //Il messaggio viene inoltrato solo ai subscriber entro il raggio (se il raggio è diverso da 0)
+	PositiveRadius bool //Viene utilizzato il raggio positive_radius al posto di quello del messaggio
+	CheckDensity   bool //Viene controllata la concentrazione di persone al metro quadro della struttura
+}
+
+//Regole di inoltro per ogni tipo di messaggio
+var routingRules = map[string]routingRule{
+	common.MessageOccupancy: {Spatial: true, CheckDensity: true},
+	common.MessagePositive:  {AnyTopic: true, Spatial: true, PositiveRadius: true, CheckDensity: true},
+	common.MessageEmergency: {Spatial: true, CheckDensity: true},
+	common.MessageService:   {},
+}
+
+//Costruisce il filtro dei subscriber a cui inoltrare un messaggio (già validato) secondo la regola del suo tipo
+func routingFilter(conf *BrokerConfig, message common.Message) (filter SubscriberFilter, rule routingRule) {
+
+	rule = routingRules[message.Type]
+
+	topic := message.Topic
+	if rule.AnyTopic {
+		topic = ""
+	}
+
+	if !rule.Spatial {
+		return SubscriberFilter{Topic: topic}, rule
+	}
+
+	//Raggio in blocchi e, per i messaggi con posizione geografica, in metri
+	radius := message.Radius
+	radiusMeters := 0.0
+	if message.Geo != nil {
+		radiusMeters = message.Geo.RadiusMeters
+	}
+	if rule.PositiveRadius {
+		radius = conf.PositiveRadius
+		radiusMeters = float64(conf.PositiveRadius) * conf.Grid.BlockSize
+	} else if radius == 0 && radiusMeters == 0 {
+		return SubscriberFilter{Topic: topic}, rule
+	}
+
+	if message.Geo != nil {
+		//Il raggio in metri ha la precedenza su quello in blocchi
+		if radiusMeters == 0 {
+			radiusMeters = float64(radius) * conf.Grid.BlockSize
+		}
+		return newGeoFilter(conf, topic, message.Geo.Latitude, message.Geo.Longitude, radiusMeters), rule
+	}
+
+	return SubscriberFilter{Topic: topic, Spatial: true, PositionX: message.PositionX, PositionY: message.PositionY, Radius: radius, Distance: conf.DistanceMode}, rule
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"common"
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+			broker-spatial-index.go
+
+	Questo modulo mantiene in memoria un indice spaziale dei subscriber, in modo da non dover interrogare l'intero
+		storage per ogni messaggio da inoltrare. Il piano viene suddiviso in celle quadrate di lato index_cell_size
+		(in blocchi): ogni cella contiene gli ID dei subscriber che vi si trovano, mentre un secondo indice associa
+		ogni topic ai suoi subscriber. Una ricerca con raggio visita solo le celle che intersecano l'area interessata.
+	L'indice è realizzato come un decoratore di SubscriberStore: le scritture vengono inoltrate allo storage e poi
+		applicate all'indice, mentre le ricerche filtrate vengono risolte dall'indice. Poiché più broker possono
+		condividere lo stesso storage, l'indice viene ricostruito periodicamente (index_refresh_delay).
+	Le scritture effettuate attraverso un altro broker (registrazioni, spostamenti, sottoscrizioni e rimozioni)
+		diventano quindi visibili al più dopo index_refresh_delay secondi: fino ad allora i messaggi non vengono
+		inoltrati ai nuovi subscriber e alle nuove posizioni. Se l'invio alla coda di un subscriber fallisce, il
+		subscriber viene riletto dallo storage (refreshIndexedSubscriber): se nel frattempo è stato rimosso, esce
+		subito dall'indice e la sua coda non viene considerata un invio fallito (vedere broker-fanout.go).
+
+*/
+
+const defaultIndexCellSize = 5       //Lato di default di una cella (in blocchi)
+const defaultIndexRefreshDelay = 60  //Intervallo di default tra due ricostruzioni dell'indice (in secondi)
+
+//Coordinate di una cella della griglia
+type gridCell struct {
+	X int
+	Y int
+}
+
+//Indice spaziale dei subscriber
+type spatialIndex struct {
+	cellSize int
+	entries  map[string]common.SubscriberEntry  //Subscriber indicizzati per ID
+	cells    map[gridCell]map[string]struct{}   //Subscriber presenti in ogni cella
+	topics   map[string]map[string]struct{}     //Subscriber iscritti ad ogni topic
+}
+
+//Crea un indice vuoto
+func newSpatialIndex(cellSize int) *spatialIndex {
+
+	if cellSize <= 0 {
+		cellSize = defaultIndexCellSize
+	}
+
+	return &spatialIndex{
+		cellSize: cellSize,
+		entries:  make(map[string]common.SubscriberEntry),
+		cells:    make(map[gridCell]map[string]struct{}),
+		topics:   make(map[string]map[string]struct{}),
+	}
+}
+
+//Cella che contiene la coordinata data (divisione arrotondata per difetto, valida anche per coordinate negative)
+func (index *spatialIndex) cellCoordinate(value int) int {
+
+	if value < 0 {
+		return -((-value - 1) / index.cellSize) - 1
+	}
+
+	return value / index.cellSize
+}
+
+//Cella che contiene la posizione data
+func (index *spatialIndex) cellOf(positionX int, positionY int) gridCell {
+	return gridCell{X: index.cellCoordinate(positionX), Y: index.cellCoordinate(positionY)}
+}
+
+//Inserisce o aggiorna un subscriber nell'indice
+func (index *spatialIndex) put(entry common.SubscriberEntry) {
+
+	index.remove(entry.SubID)
+
+	entry = copySubscriber(entry)
+	index.entries[entry.SubID] = entry
+
+	cell := index.cellOf(entry.PositionX, entry.PositionY)
+	if index.cells[cell] == nil {
+		index.cells[cell] = make(map[string]struct{})
+	}
+	index.cells[cell][entry.SubID] = struct{}{}
+
+	for _, topic := range entry.Topics {
+		if index.topics[topic] == nil {
+			index.topics[topic] = make(map[string]struct{})
+		}
+		index.topics[topic][entry.SubID] = struct{}{}
+	}
+}
+
+//Rimuove un subscriber dall'indice
+func (index *spatialIndex) remove(subID string) {
+
+	entry, ok := index.entries[subID]
+	if !ok {
+		return
+	}
+
+	cell := index.cellOf(entry.PositionX, entry.PositionY)
+	delete(index.cells[cell], subID)
+	if len(index.cells[cell]) == 0 {
+		delete(index.cells, cell)
+	}
+
+	for _, topic := range entry.Topics {
+		delete(index.topics[topic], subID)
+		if len(index.topics[topic]) == 0 {
+			delete(index.topics, topic)
+		}
+	}
+
+	delete(index.entries, subID)
+}
+
+//Ritorna i subscriber che rispettano il filtro, ordinati per ID
+func (index *spatialIndex) query(filter SubscriberFilter) (subs []common.SubscriberEntry) {
+
+	var candidates []string
+
+	if filter.Spatial {
+
+		minX, maxX, minY, maxY := filter.bounds()
+		minCell := index.cellOf(minX, minY)
+		maxCell := index.cellOf(maxX, maxY)
+
+		//Numero di celle per lato (al massimo 2*maxFilterRadius+2, non va in overflow con int64)
+		width := int64(maxCell.X) - int64(minCell.X) + 1
+		height := int64(maxCell.Y) - int64(minCell.Y) + 1
+
+		//Se l'area contiene più celle di quelle occupate, conviene scorrere solo le celle occupate. Il prodotto
+		//viene calcolato solo se entrambi i lati sono minori del numero di celle occupate, per non andare in overflow
+		occupied := int64(len(index.cells))
+		if width > occupied || height > occupied || width*height > occupied {
+			for cell, ids := range index.cells {
+				if cell.X >= minCell.X && cell.X <= maxCell.X && cell.Y >= minCell.Y && cell.Y <= maxCell.Y {
+					candidates = appendIDs(candidates, ids)
+				}
+			}
+		} else {
+			for i := int64(0); i < width; i++ {
+				for j := int64(0); j < height; j++ {
+					candidates = appendIDs(candidates, index.cells[gridCell{X: minCell.X + int(i), Y: minCell.Y + int(j)}])
+				}
+			}
+		}
+
+	} else if filter.Topic != "" {
+		candidates = appendIDs(candidates, index.topics[filter.Topic])
+
+	} else {
+		for id := range index.entries {
+			candidates = append(candidates, id)
+		}
+	}
+
+	//Controllo esatto su ogni candidato (topic e distanza)
+	for _, id := range candidates {
+		entry := index.entries[id]
+		if filter.matches(entry) {
+			subs = append(subs, copySubscriber(entry))
+		}
+	}
+
+	sort.Slice(subs, func(i, j int) bool { return subs[i].SubID < subs[j].SubID })
+
+	return subs
+}
+
+//Aggiunge gli ID di un insieme ad una lista
+func appendIDs(list []string, ids map[string]struct{}) []string {
+	for id := range ids {
+		list = append(list, id)
+	}
+	return list
+}
+
+
+//Decoratore di SubscriberStore che mantiene aggiornato l'indice spaziale
+type indexedSubscriberStore struct {
+	SubscriberStore                                  //Storage sottostante
+
+	mutex      sync.RWMutex
+	index      *spatialIndex
+	loaded     bool                                  //false finché l'indice non è stato caricato dallo storage
+	refreshing bool                                  //true durante una ricostruzione dell'indice
+	pending    map[string]*common.SubscriberEntry    //Scritture avvenute durante la ricostruzione (nil = subscriber rimosso)
+}
+
+//Crea il decoratore per lo storage dato
+func newIndexedSubscriberStore(backend SubscriberStore) *indexedSubscriberStore {
+	return &indexedSubscriberStore{SubscriberStore: backend, index: newSpatialIndex(defaultIndexCellSize)}
+}
+
+//Ricostruisce l'indice a partire dal contenuto dello storage
+func (store *indexedSubscriberStore) refresh(cellSize int) (retErr error) {
+
+	store.mutex.Lock()
+	store.refreshing = true
+	store.pending = make(map[string]*common.SubscriberEntry)
+	store.mutex.Unlock()
+
+	subs, err := store.SubscriberStore.GetSubscribers()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.refreshing = false
+	pending := store.pending
+	store.pending = nil
+
+	if err != nil {
+		return err
+	}
+
+	index := newSpatialIndex(cellSize)
+	for _, sub := range subs {
+		index.put(sub)
+	}
+
+	//Le scritture avvenute durante la lettura dello storage sono più recenti di quanto letto
+	for id, entry := range pending {
+		if entry == nil {
+			index.remove(id)
+		} else {
+			index.put(*entry)
+		}
+	}
+
+	store.index = index
+	store.loaded = true
+
+	return nil
+}
+
+//Applica all'indice lo stato attuale di un subscriber (da chiamare dopo una scrittura sullo storage), ritornando se
+//il subscriber esiste ancora
+func (store *indexedSubscriberStore) sync(subID string) (exists bool, retErr error) {
+
+	entry, err := store.SubscriberStore.GetSubscriber(subID)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if err == errSubscriberNotFound {
+		store.index.remove(subID)
+		if store.refreshing {
+			store.pending[subID] = nil
+		}
+		return false, nil
+	}
+
+	//In caso di errore di lettura la voce dell'indice resta invariata fino alla prossima ricostruzione
+	if err != nil {
+		common.Warning("[BROKER] Impossibile aggiornare l'indice spaziale per il subscriber " + subID + ": " + err.Error())
+		return false, err
+	}
+
+	store.index.put(entry)
+	if store.refreshing {
+		store.pending[subID] = &entry
+	}
+
+	return true, nil
+}
+
+//Aggiorna l'indice con lo stato di un subscriber letto dallo storage, ritornando se il subscriber esiste ancora.
+//Senza l'indice spaziale viene solo letto lo storage
+func refreshIndexedSubscriber(subID string) (exists bool, retErr error) {
+
+	if store, ok := subscriberStore.(*indexedSubscriberStore); ok {
+		return store.sync(subID)
+	}
+
+	_, err := subscriberStore.GetSubscriber(subID)
+	if err == errSubscriberNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (store *indexedSubscriberStore) AddSubscriber(entry common.SubscriberEntry) (retErr error, alreadyExisting bool) {
+
+	err, alreadyExisting := store.SubscriberStore.AddSubscriber(entry)
+	if err == nil {
+		store.sync(entry.SubID)
+	}
+
+	return err, alreadyExisting
+}
+
+func (store *indexedSubscriberStore) UpdatePosition(subID string, positionX int, positionY int, latitude float64, longitude float64) (retErr error) {
+
+	err := store.SubscriberStore.UpdatePosition(subID, positionX, positionY, latitude, longitude)
+	if err == nil {
+		store.sync(subID)
+	}
+
+	return err
+}
+
+func (store *indexedSubscriberStore) SetTopics(subID string, topics []string) (retErr error) {
+
+	err := store.SubscriberStore.SetTopics(subID, topics)
+	if err == nil {
+		store.sync(subID)
+	}
+
+	return err
+}
+
+func (store *indexedSubscriberStore) UpdateQueueURL(subID string, queueURL string) (retErr error) {
+
+	err := store.SubscriberStore.UpdateQueueURL(subID, queueURL)
+	if err == nil {
+		store.sync(subID)
+	}
+
+	return err
+}
+
+//L'ultima attività non è usata dalle ricerche: l'indice non viene aggiornato
+func (store *indexedSubscriberStore) Touch(subID string, lastSeen int64) (retErr error) {
+	return store.SubscriberStore.Touch(subID, lastSeen)
+}
+
+func (store *indexedSubscriberStore) RemoveExpiredSubscriber(subID string, cutoff int64) (removed bool, retErr error) {
+
+	removed, err := store.SubscriberStore.RemoveExpiredSubscriber(subID, cutoff)
+	if removed {
+		store.sync(subID)
+	}
+
+	return removed, err
+}
+
+func (store *indexedSubscriberStore) RemoveSubscriber(subID string) (retErr error) {
+
+	err := store.SubscriberStore.RemoveSubscriber(subID)
+	if err == nil {
+		store.sync(subID)
+	}
+
+	return err
+}
+
+//Ricerca dei subscriber tramite l'indice (o tramite lo storage se l'indice non è ancora stato caricato)
+func (store *indexedSubscriberStore) GetFilteredSubscribers(filter SubscriberFilter) (subs []common.SubscriberEntry, retErr error) {
+
+	store.mutex.RLock()
+	if store.loaded {
+		defer store.mutex.RUnlock()
+		return store.index.query(filter), nil
+	}
+	store.mutex.RUnlock()
+
+	return store.SubscriberStore.GetFilteredSubscribers(filter)
+}
+
+
+//Carica l'indice spaziale e avvia la goroutine che lo ricostruisce periodicamente (fino all'annullamento del contesto)
+func startSubscriberIndex(ctx context.Context) {
+
+	store, ok := subscriberStore.(*indexedSubscriberStore)
+	if !ok {
+		return
+	}
+
+	err := store.refresh(currentConfig().IndexCellSize)
+	if err != nil {
+		common.Warning("[BROKER] Errore nel caricamento dell'indice spaziale, le ricerche verranno effettuate sullo storage. " + err.Error())
+	} else {
+		common.Info("[BROKER] Indice spaziale caricato")
+	}
+
+	//L'indice viene ricostruito subito se cambia il lato delle celle
+	wakeup := configWakeup(func(old *BrokerConfig, updated *BrokerConfig) bool {
+		return old.IndexCellSize != updated.IndexCellSize
+	})
+
+	go func() {
+		for sleepUntilWakeup(ctx, wakeup, time.Second*time.Duration(currentConfig().IndexRefreshDelay)) {
+
+			cellSize := currentConfig().IndexCellSize
+
+			err := store.refresh(cellSize)
+			if err != nil {
+				common.Warning("[BROKER] Errore nella ricostruzione dell'indice spaziale. " + err.Error())
+			} else {
+				common.Info("[BROKER] Indice spaziale ricostruito (lato cella: " + strconv.Itoa(cellSize) + ")")
+			}
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"strings"
+	"testing"
+)
+
+//Subscriber usati dai test dell'indice spaziale
+func testSubscribers() []common.SubscriberEntry {
+	return []common.SubscriberEntry{
+		{SubID: "origin", Topics: []string{"Farmacia"}, PositionX: 0, PositionY: 0},
+		{SubID: "near", Topics: []string{"Farmacia", "Uffici"}, PositionX: 3, PositionY: 4},
+		{SubID: "diagonal", Topics: []string{"Uffici"}, PositionX: 4, PositionY: 4},
+		{SubID: "negative", Topics: []string{"Farmacia"}, PositionX: -6, PositionY: -1},
+		{SubID: "far", Topics: []string{"Farmacia"}, PositionX: 1000, PositionY: -1000},
+		{SubID: "edge", Topics: []string{"Farmacia"}, PositionX: maxInt, PositionY: minInt},
+	}
+}
+
+//Le ricerche sull'indice devono dare lo stesso risultato del controllo esatto su tutti i subscriber
+func TestSpatialIndexQuery(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		filter SubscriberFilter
+		want   string //ID attesi, ordinati e separati da virgole
+	}{
+		{"topic only", SubscriberFilter{Topic: "Uffici"}, "diagonal,near"},
+		{"no filter", SubscriberFilter{}, "diagonal,edge,far,near,negative,origin"},
+		{"euclidean radius 5", SubscriberFilter{Spatial: true, Radius: 5, Distance: distanceEuclidean}, "near,origin"},
+		{"square radius 5", SubscriberFilter{Spatial: true, Radius: 5, Distance: distanceSquare}, "diagonal,near,origin"},
+		{"manhattan radius 7", SubscriberFilter{Spatial: true, Radius: 7, Distance: distanceManhattan}, "near,negative,origin"},
+		{"negative cells", SubscriberFilter{Spatial: true, PositionX: -5, PositionY: -2, Radius: 1, Distance: distanceSquare}, "negative"},
+		{"topic and radius", SubscriberFilter{Topic: "Farmacia", Spatial: true, Radius: 7, Distance: distanceEuclidean}, "near,negative,origin"},
+		{"radius zero", SubscriberFilter{Spatial: true, Radius: 0}, "origin"},
+		{"huge radius is clamped", SubscriberFilter{Spatial: true, Radius: maxInt, Distance: distanceSquare}, "diagonal,far,near,negative,origin"},
+		{"huge radius at the edge", SubscriberFilter{Spatial: true, PositionX: maxInt, PositionY: minInt, Radius: maxInt}, "edge"},
+		{"negative radius", SubscriberFilter{Spatial: true, Radius: -10}, "origin"},
+	}
+
+	for _, cellSize := range []int{1, 5, 1000} {
+
+		index := newSpatialIndex(cellSize)
+		for _, sub := range testSubscribers() {
+			index.put(sub)
+		}
+
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+
+				var got []string
+				for _, sub := range index.query(test.filter) {
+					got = append(got, sub.SubID)
+				}
+				if strings.Join(got, ",") != test.want {
+					t.Fatalf("cell size %d: got %v, want %s", cellSize, got, test.want)
+				}
+
+				//Stesso risultato del controllo esatto
+				var expected []string
+				for _, sub := range testSubscribers() {
+					if test.filter.matches(sub) {
+						expected = append(expected, sub.SubID)
+					}
+				}
+				if len(expected) != len(got) {
+					t.Fatalf("cell size %d: index returned %v, exact check %v", cellSize, got, expected)
+				}
+			})
+		}
+	}
+}
+
+//Rimozione e aggiornamento di un subscriber liberano la cella e il topic precedenti
+func TestSpatialIndexPutRemove(t *testing.T) {
+
+	index := newSpatialIndex(5)
+	index.put(common.SubscriberEntry{SubID: "a", Topics: []string{"Uffici"}, PositionX: 1, PositionY: 1})
+	index.put(common.SubscriberEntry{SubID: "a", Topics: []string{"Farmacia"}, PositionX: 100, PositionY: 100})
+
+	if len(index.cells) != 1 || len(index.topics) != 1 || index.topics["Uffici"] != nil {
+		t.Fatalf("stale cells or topics after update: %v %v", index.cells, index.topics)
+	}
+
+	index.remove("a")
+	index.remove("missing")
+
+	if len(index.entries) != 0 || len(index.cells) != 0 || len(index.topics) != 0 {
+		t.Fatalf("index not empty after removal: %v %v %v", index.entries, index.cells, index.topics)
+	}
+}
+
+//Storage che fallisce la lettura dei subscriber con un errore dato
+type failingSubscriberStore struct {
+	SubscriberStore
+	err error
+}
+
+func (store failingSubscriberStore) GetSubscriber(subID string) (entry common.SubscriberEntry, retErr error) {
+	return common.SubscriberEntry{}, store.err
+}
+
+//Un subscriber viene rimosso dall'indice solo se lo storage non lo trova più
+func TestIndexedStoreSyncErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		err     error
+		indexed bool
+	}{
+		{"not found", errSubscriberNotFound, false},
+		{"storage error", errors.New("throttled"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			store := newIndexedSubscriberStore(failingSubscriberStore{SubscriberStore: newMemorySubscriberStore(), err: test.err})
+			store.index.put(common.SubscriberEntry{SubID: "a", Topics: []string{"Uffici"}})
+
+			store.sync("a")
+
+			if _, indexed := store.index.entries["a"]; indexed != test.indexed {
+				t.Fatalf("indexed = %v, want %v", indexed, test.indexed)
+			}
+		})
+	}
+}
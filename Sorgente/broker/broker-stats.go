@@ -0,0 +1,170 @@
+package main
+
+import (
+	"common"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+			broker-stats.go
+
+	Questo modulo raccoglie le statistiche del ciclo di ricezione del broker, esposte con GET /stats:
+	 - numero di richieste di ricezione (poll), di quelle che non hanno ottenuto messaggi e attesa corrente
+	 - numero di messaggi ricevuti, inoltrati, già inoltrati (duplicati) e spostati nella coda dei messaggi non consegnati
+	 - latenza di inoltro, cioè il tempo tra l'invio del messaggio da parte del publisher (SentTimestamp) e
+	   l'inoltro alle code dei subscriber. Media e massimo sono calcolati dall'avvio del broker, i percentili
+	   sugli ultimi latencySamples messaggi inoltrati
+
+*/
+
+const latencySamples = 1000 //Numero di latenze utilizzate per il calcolo dei percentili
+
+//Statistiche del broker (latenze in millisecondi)
+type BrokerStats struct {
+	Since          string  //Istante di avvio della raccolta delle statistiche
+	Polls          int64   //Richieste di ricezione effettuate
+	EmptyPolls     int64   //Richieste di ricezione che non hanno ottenuto messaggi
+	CurrentBackoff int64   //Attesa corrente prima della prossima richiesta di ricezione
+	Received       int64   //Messaggi ricevuti
+	Forwarded      int64   //Messaggi inoltrati ai subscriber
+	Duplicates     int64   //Messaggi ricevuti di nuovo dopo essere già stati inoltrati
+	DeadLettered   int64   //Messaggi spostati nella coda dei messaggi non consegnati
+	LatencyLast    int64   //Latenza dell'ultimo messaggio inoltrato
+	LatencyAvg     float64 //Latenza media
+	LatencyMax     int64   //Latenza massima
+	LatencyP50     int64   //Percentili della latenza sugli ultimi messaggi inoltrati
+	LatencyP95     int64
+	LatencyP99     int64
+}
+
+//Raccolta delle statistiche, condivisa tra il ciclo di ricezione e l'API REST
+type statsCollector struct {
+	mutex        sync.Mutex
+	stats        BrokerStats
+	latencySum   int64
+	latencyCount int64
+	samples      []int64 //Buffer circolare delle ultime latenze
+	next         int     //Posizione del prossimo campione nel buffer
+}
+
+var brokerStats = &statsCollector{stats: BrokerStats{Since: time.Now().Format(time.RFC3339)}}
+
+//Registra l'esito di una richiesta di ricezione
+func (collector *statsCollector) recordPoll(received int) {
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.stats.Polls++
+	if received == 0 {
+		collector.stats.EmptyPolls++
+	}
+	collector.stats.Received += int64(received)
+}
+
+//Registra l'attesa corrente del ciclo di ricezione
+func (collector *statsCollector) recordBackoff(backoff time.Duration) {
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.stats.CurrentBackoff = int64(backoff / time.Millisecond)
+}
+
+//Registra l'inoltro di un messaggio inviato dal publisher all'istante sentTimestamp (in millisecondi)
+func (collector *statsCollector) recordForwarded(sentTimestamp int64) {
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.stats.Forwarded++
+
+	//Messaggi senza istante di invio (trasporti che non lo forniscono)
+	if sentTimestamp <= 0 {
+		return
+	}
+
+	latency := time.Now().UnixNano()/int64(time.Millisecond) - sentTimestamp
+	if latency < 0 {
+		latency = 0
+	}
+
+	collector.stats.LatencyLast = latency
+	if latency > collector.stats.LatencyMax {
+		collector.stats.LatencyMax = latency
+	}
+	collector.latencySum += latency
+	collector.latencyCount++
+
+	if len(collector.samples) < latencySamples {
+		collector.samples = append(collector.samples, latency)
+	} else {
+		collector.samples[collector.next] = latency
+	}
+	collector.next = (collector.next + 1) % latencySamples
+}
+
+//Registra un messaggio ricevuto di nuovo dopo essere già stato inoltrato
+func (collector *statsCollector) recordDuplicate() {
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.stats.Duplicates++
+}
+
+//Registra lo spostamento di un messaggio nella coda dei messaggi non consegnati
+func (collector *statsCollector) recordDeadLetter() {
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.stats.DeadLettered++
+}
+
+//Ritorna una copia delle statistiche correnti
+func (collector *statsCollector) snapshot() BrokerStats {
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	stats := collector.stats
+
+	if collector.latencyCount > 0 {
+		stats.LatencyAvg = float64(collector.latencySum) / float64(collector.latencyCount)
+	}
+
+	if len(collector.samples) > 0 {
+		sorted := make([]int64, len(collector.samples))
+		copy(sorted, collector.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		stats.LatencyP50 = percentile(sorted, 50)
+		stats.LatencyP95 = percentile(sorted, 95)
+		stats.LatencyP99 = percentile(sorted, 99)
+	}
+
+	return stats
+}
+
+//Percentile p di una lista ordinata (nearest rank)
+func percentile(sorted []int64, p int) int64 {
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+//Funzione per rispondere ad una richiesta GET delle statistiche del broker
+func getStats(w http.ResponseWriter, r *http.Request) {
+
+	common.Info("[BROKER] Comando fetch delle statistiche")
+
+	writeJSONResponse(w, brokerStats.snapshot())
+}
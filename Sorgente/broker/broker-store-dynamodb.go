@@ -0,0 +1,762 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"strconv"
+	"time"
+)
+
+/*
+			broker-store-dynamodb.go
+
+	Implementazioni di SubscriberStore, ConfigStore, DeadLetterStore e DedupStore che memorizzano i subscriber nella
+		tabella DynamoDB subTableName, i parametri di configurazione nella tabella configTable (e il loro storico
+		nella tabella configHistoryTable), i messaggi non consegnati nella tabella deadLetterTableName e i messaggi
+		già inoltrati nella tabella dedupTableName.
+
+*/
+
+type dynamoSubscriberStore struct{}
+
+//Aggiunge un subscriber alla tabella su DynamoDB
+func (store *dynamoSubscriberStore) AddSubscriber(entry common.SubscriberEntry) (retErr error, alreadyExisting bool) {
+
+	svc := dynamodb.New(common.Sess)
+
+	//Marshalling
+	av, err := dynamodbattribute.MarshalMap(entry)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel marshalling della struttura dati")
+		return err, false
+	}
+
+	//Creazione della query
+	cond := "attribute_not_exists(SubID)" //Questa condizione è necessaria poiche una ADD su DynamoDB, se trova un elementro con la stessa chiave, esegue un UPDATE invece di annullare la transazione
+	input := &dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(currentConfig().SubTableName),
+		ConditionExpression: &cond,
+	}
+
+	//Esecuzione della query
+	_, err = svc.PutItem(input)
+	if err != nil {
+		switch err.(type) {
+		default:
+			return err, false
+		//L'errore presentato in questa riga viene gestito diversamente, infatti con ogni probabilità indica la registrazione contmeporanea di due subscriber. Questo viene gestito rieffettuando una nuova registrazione
+		case *dynamodb.ConditionalCheckFailedException:
+			return err, true
+		}
+	}
+
+	return nil, false
+}
+
+//Ottiene un subscriber dalla tabella su DynamoDB
+func (store *dynamoSubscriberStore) GetSubscriber(subID string) (entry common.SubscriberEntry, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      aws.String(currentConfig().SubTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+	})
+	if err != nil {
+		return common.SubscriberEntry{}, err
+	}
+
+	item := common.SubscriberEntry{}
+
+	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'unmarshaling del risultato")
+		return common.SubscriberEntry{}, err
+	}
+	if item.SubID == "" {
+		common.Warning("[BROKER] Nessun subscriber trovato con id " + subID)
+		return common.SubscriberEntry{}, errSubscriberNotFound
+	}
+
+	return item, nil
+}
+
+//Ottiene tutti i subscriber della tabella su DynamoDB
+func (store *dynamoSubscriberStore) GetSubscribers() (subs []common.SubscriberEntry, retErr error) {
+
+	return scanSubscribers(&dynamodb.ScanInput{
+		TableName: aws.String(currentConfig().SubTableName),
+	})
+}
+
+//Ottiene una pagina di subscriber, a partire dal cursore dato
+func (store *dynamoSubscriberStore) ListSubscribers(limit int64, nextToken string) (subs []common.SubscriberEntry, newNextToken string, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(currentConfig().SubTableName),
+		Limit:     aws.Int64(limit),
+	}
+
+	//Il cursore contiene la chiave (SubID) dell'ultimo subscriber della pagina precedente
+	if nextToken != "" {
+		lastID, err := decodePageToken(nextToken)
+		if err != nil {
+			return nil, "", err
+		}
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(lastID),
+			},
+		}
+	}
+
+	result, err := svc.Scan(input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	subs, err = unmarshalSubscribers(result.Items)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if key, ok := result.LastEvaluatedKey["SubID"]; ok {
+		newNextToken = encodePageToken(aws.StringValue(key.S))
+	}
+
+	return subs, newNextToken, nil
+}
+
+//Ottiene i subscriber filtrati costruendo la relativa espressione per DynamoDB
+func (store *dynamoSubscriberStore) GetFilteredSubscribers(filter SubscriberFilter) (subs []common.SubscriberEntry, retErr error) {
+
+	expr, err := buildFilterExpression(filter)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nella costruzione della query. " + err.Error())
+		return nil, err
+	}
+
+	candidates, err := scanSubscribers(&dynamodb.ScanInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		TableName:                 aws.String(currentConfig().SubTableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//La FilterExpression seleziona il quadrato che contiene l'area, la distanza esatta viene controllata qui
+	for _, sub := range candidates {
+		if filter.matches(sub) {
+			subs = append(subs, sub)
+		}
+	}
+
+	return subs, nil
+}
+
+//Aggiornamento della posizione di un subscriber
+func (store *dynamoSubscriberStore) UpdatePosition(subID string, positionX int, positionY int, latitude float64, longitude float64) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	//L'UPDATE in DynamoDB si comporta come un ADD nel momento in cui non trova la chiave. Con questa condizione si previene questo fenomeno
+	cond := "attribute_exists(SubID)"
+
+	values := map[string]*dynamodb.AttributeValue{
+		":x": {
+			N: aws.String(strconv.Itoa(positionX)),
+		},
+		":y": {
+			N: aws.String(strconv.Itoa(positionY)),
+		},
+	}
+
+	//Se il subscriber usa le coordinate a blocchi, un'eventuale posizione geografica precedente viene rimossa
+	update := "set PositionX = :x, PositionY = :y remove Latitude, Longitude"
+	if latitude != 0 || longitude != 0 {
+		values[":lat"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(latitude, 'f', -1, 64))}
+		values[":lon"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(longitude, 'f', -1, 64))}
+		update = "set PositionX = :x, PositionY = :y, Latitude = :lat, Longitude = :lon"
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: values,
+		TableName: aws.String(currentConfig().SubTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+		ConditionExpression: &cond,
+		ReturnValues:        aws.String("UPDATED_NEW"),
+		UpdateExpression:    aws.String(update),
+	}
+
+	_, err := svc.UpdateItem(input)
+	return err
+}
+
+//Sostituisce la lista dei topic di un subscriber
+func (store *dynamoSubscriberStore) SetTopics(subID string, topics []string) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {
+				SS: aws.StringSlice(topics),
+			},
+		},
+		TableName: aws.String(currentConfig().SubTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+		ReturnValues:     aws.String("UPDATED_NEW"),
+		UpdateExpression: aws.String("set Topics = :t"),
+	}
+
+	_, err := svc.UpdateItem(input)
+	return err
+}
+
+//Aggiorna la coda di ricezione di un subscriber esistente sulla tabella su DynamoDB
+func (store *dynamoSubscriberStore) UpdateQueueURL(subID string, queueURL string) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":q": {
+				S: aws.String(queueURL),
+			},
+		},
+		TableName: aws.String(currentConfig().SubTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(SubID)"),
+		UpdateExpression:    aws.String("set QueueURL = :q"),
+	}
+
+	_, err := svc.UpdateItem(input)
+	if _, notFound := err.(*dynamodb.ConditionalCheckFailedException); notFound {
+		return errSubscriberNotFound
+	}
+
+	return err
+}
+
+//Aggiorna l'ultima attività di un subscriber esistente sulla tabella su DynamoDB
+func (store *dynamoSubscriberStore) Touch(subID string, lastSeen int64) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": {
+				N: aws.String(strconv.FormatInt(lastSeen, 10)),
+			},
+		},
+		TableName: aws.String(currentConfig().SubTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(SubID)"),
+		UpdateExpression:    aws.String("set LastSeen = :t"),
+	}
+
+	_, err := svc.UpdateItem(input)
+	if _, notFound := err.(*dynamodb.ConditionalCheckFailedException); notFound {
+		return errSubscriberNotFound
+	}
+
+	return err
+}
+
+//Rimuove un subscriber dalla tabella su DynamoDB solo se la sua ultima attività è precedente a cutoff. La condizione
+//evita di rimuovere un subscriber che ha inviato un heartbeat dopo la lettura della tabella (anche da parte di un
+//altro broker)
+func (store *dynamoSubscriberStore) RemoveExpiredSubscriber(subID string, cutoff int64) (removed bool, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	input := &dynamodb.DeleteItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":c": {
+				N: aws.String(strconv.FormatInt(cutoff, 10)),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+		TableName:           aws.String(currentConfig().SubTableName),
+		ConditionExpression: aws.String("LastSeen < :c"),
+	}
+
+	_, err := svc.DeleteItem(input)
+	if _, notExpired := err.(*dynamodb.ConditionalCheckFailedException); notExpired {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+//Rimuove un subscriber dalla tabella su DynamoDB
+func (store *dynamoSubscriberStore) RemoveSubscriber(subID string) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"SubID": {
+				S: aws.String(subID),
+			},
+		},
+		TableName: aws.String(currentConfig().SubTableName),
+	}
+
+	_, err := svc.DeleteItem(input)
+	return err
+}
+
+//Costruisce l'espressione DynamoDB corrispondente al filtro
+func buildFilterExpression(filter SubscriberFilter) (expr expression.Expression, retErr error) {
+
+	var conds []expression.ConditionBuilder
+
+	if filter.Topic != "" {
+		conds = append(conds, expression.Name("Topics").Contains(filter.Topic))
+	}
+
+	//DynamoDB non supporta espressioni aritmetiche: viene selezionato il quadrato di lato 2*Radius
+	if filter.Spatial {
+		minX, maxX, minY, maxY := filter.bounds()
+		conds = append(conds, expression.Name("PositionX").Between(expression.Value(minX), expression.Value(maxX)))
+		conds = append(conds, expression.Name("PositionY").Between(expression.Value(minY), expression.Value(maxY)))
+	}
+
+	projection := expression.NamesList(expression.Name("SubID"), expression.Name("Topics"), expression.Name("QueueURL"), expression.Name("PositionX"), expression.Name("PositionY"),
+		expression.Name("Latitude"), expression.Name("Longitude"))
+	builder := expression.NewBuilder().WithProjection(projection)
+
+	switch len(conds) {
+	case 0:
+	case 1:
+		builder = builder.WithFilter(conds[0])
+	default:
+		builder = builder.WithFilter(expression.And(conds[0], conds[1], conds[2:]...))
+	}
+
+	return builder.Build()
+}
+
+//Esegue una Scan sulla tabella dei subscriber leggendo tutte le pagine (ogni pagina è limitata ad 1 MB)
+func scanSubscribers(input *dynamodb.ScanInput) (subs []common.SubscriberEntry, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	var unmarshalErr error
+
+	err := svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+
+		pageSubs, err := unmarshalSubscribers(page.Items)
+		if err != nil {
+			unmarshalErr = err
+			return false
+		}
+
+		subs = append(subs, pageSubs...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	return subs, nil
+}
+
+//Unmarshaling di una lista di item DynamoDB in subscriber
+func unmarshalSubscribers(items []map[string]*dynamodb.AttributeValue) (subs []common.SubscriberEntry, retErr error) {
+
+	var subList []common.SubscriberEntry
+
+	for _, i := range items {
+
+		item := common.SubscriberEntry{}
+
+		err := dynamodbattribute.UnmarshalMap(i, &item)
+		if err != nil {
+			common.Fatal("[BROKER] Errore nell'unmarshalling della entry. " + err.Error())
+			return nil, err
+		}
+
+		subList = append(subList, item)
+	}
+
+	return subList, nil
+}
+
+type dynamoConfigStore struct{}
+
+const maxConfigChangeAttempts = 5 //Tentativi di registrazione di una modifica in caso di versioni concorrenti
+
+//Ottiene tutti i parametri dalla tabella di configurazione su DynamoDB
+func (store *dynamoConfigStore) GetParameters() (configs []ConfigEntry, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	var unmarshalErr error
+
+	//Lettura di tutte le pagine della tabella
+	err := svc.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(configTable),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+
+		for _, i := range page.Items {
+
+			config := ConfigEntry{}
+
+			// Unmarshaling del dato ottenuto
+			err := dynamodbattribute.UnmarshalMap(i, &config)
+			if err != nil {
+				common.Fatal("[BROKER] Errore nell'unmarshaling della entry\n" + err.Error())
+				unmarshalErr = err
+				return false
+			}
+
+			configs = append(configs, config)
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	return configs, nil
+}
+
+//Aggiorna un parametro della tabella di configurazione su DynamoDB
+func (store *dynamoConfigStore) UpdateParameter(fieldName string, fieldValue string) (oldValue string, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	//Espressione condizionale che impone l'esistenza del parametro (Senza questa condizione, DynamoDB può creare una entry se non trova la corrispettiva chiave nel database)
+	cond := "attribute_exists(FieldName)"
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {
+				S: aws.String(fieldValue),
+			},
+		},
+		TableName: aws.String(configTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"FieldName": {
+				S: aws.String(fieldName),
+			},
+		},
+		ConditionExpression: &cond,
+		ReturnValues:        aws.String("UPDATED_OLD"),
+		UpdateExpression:    aws.String("set FieldValue = :v"),
+	}
+
+	result, err := svc.UpdateItem(input)
+	if err != nil {
+		return "", err
+	}
+
+	//Valore precedente del parametro, per lo storico
+	if old, ok := result.Attributes["FieldValue"]; ok && old.S != nil {
+		oldValue = *old.S
+	}
+
+	return oldValue, nil
+}
+
+//Registra una modifica nella tabella dello storico, con la versione successiva all'ultima registrata
+func (store *dynamoConfigStore) AddChange(change ConfigChange) (stored ConfigChange, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	//Se un altro broker registra contemporaneamente la stessa versione, la scrittura viene ripetuta con la successiva
+	for attempt := 0; attempt < maxConfigChangeAttempts; attempt++ {
+
+		last, err := svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(configHistoryTable),
+			KeyConditionExpression: aws.String("FieldName = :n"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":n": {S: aws.String(change.FieldName)},
+			},
+			ConsistentRead:   aws.Bool(true),
+			ScanIndexForward: aws.Bool(false),
+			Limit:            aws.Int64(1),
+		})
+		if err != nil {
+			return ConfigChange{}, err
+		}
+
+		change.Version = 1
+		if len(last.Items) > 0 {
+			previous := ConfigChange{}
+			err = dynamodbattribute.UnmarshalMap(last.Items[0], &previous)
+			if err != nil {
+				return ConfigChange{}, err
+			}
+			change.Version = previous.Version + 1
+		}
+
+		av, err := dynamodbattribute.MarshalMap(change)
+		if err != nil {
+			return ConfigChange{}, err
+		}
+
+		_, err = svc.PutItem(&dynamodb.PutItemInput{
+			Item:                av,
+			TableName:           aws.String(configHistoryTable),
+			ConditionExpression: aws.String("attribute_not_exists(Version)"),
+		})
+		if _, conflict := err.(*dynamodb.ConditionalCheckFailedException); conflict {
+			continue
+		}
+		if err != nil {
+			return ConfigChange{}, err
+		}
+
+		return change, nil
+	}
+
+	return ConfigChange{}, errors.New("too many concurrent changes of " + change.FieldName)
+}
+
+//Ottiene lo storico di un parametro dalla tabella su DynamoDB
+func (store *dynamoConfigStore) GetChanges(fieldName string) (changes []ConfigChange, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	var unmarshalErr error
+
+	//Lettura di tutte le pagine, in ordine di versione
+	err := svc.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(configHistoryTable),
+		KeyConditionExpression: aws.String("FieldName = :n"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":n": {S: aws.String(fieldName)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+
+		for _, i := range page.Items {
+
+			change := ConfigChange{}
+			err := dynamodbattribute.UnmarshalMap(i, &change)
+			if err != nil {
+				unmarshalErr = err
+				return false
+			}
+
+			changes = append(changes, change)
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	return changes, nil
+}
+
+
+type dynamoDeadLetterStore struct{}
+
+//Aggiunge un messaggio non consegnato alla tabella su DynamoDB
+func (store *dynamoDeadLetterStore) AddDeadLetter(letter DeadLetter) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	av, err := dynamodbattribute.MarshalMap(letter)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(currentConfig().DeadLetterTableName),
+	})
+
+	return err
+}
+
+//Ottiene un messaggio non consegnato dalla tabella su DynamoDB
+func (store *dynamoDeadLetterStore) GetDeadLetter(letterID string) (letter DeadLetter, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(currentConfig().DeadLetterTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LetterID": {
+				S: aws.String(letterID),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	if result.Item == nil {
+		return DeadLetter{}, errDeadLetterNotFound
+	}
+
+	err = dynamodbattribute.UnmarshalMap(result.Item, &letter)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+
+	return letter, nil
+}
+
+//Ottiene tutti i messaggi non consegnati dalla tabella su DynamoDB, ordinati per istante del fallimento
+func (store *dynamoDeadLetterStore) GetDeadLetters() (letters []DeadLetter, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	var unmarshalErr error
+
+	err := svc.ScanPages(&dynamodb.ScanInput{
+		TableName: aws.String(currentConfig().DeadLetterTableName),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+
+		var pageLetters []DeadLetter
+		err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &pageLetters)
+		if err != nil {
+			unmarshalErr = err
+			return false
+		}
+
+		letters = append(letters, pageLetters...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+
+	sortDeadLetters(letters)
+
+	return letters, nil
+}
+
+//Rimuove un messaggio non consegnato dalla tabella su DynamoDB
+func (store *dynamoDeadLetterStore) RemoveDeadLetter(letterID string) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	cond := "attribute_exists(LetterID)"
+
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(currentConfig().DeadLetterTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LetterID": {
+				S: aws.String(letterID),
+			},
+		},
+		ConditionExpression: &cond,
+	})
+	if _, ok := err.(*dynamodb.ConditionalCheckFailedException); ok {
+		return errDeadLetterNotFound
+	}
+
+	return err
+}
+
+
+type dynamoDedupStore struct{}
+
+//Verifica se un messaggio è già stato inoltrato. La rimozione degli elementi scaduti da parte di DynamoDB
+//non è immediata, per cui viene controllato anche l'attributo ExpiresAt
+func (store *dynamoDedupStore) Seen(messageID string) (seen bool, retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(currentConfig().DedupTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"MessageID": {
+				S: aws.String(messageID),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	if result.Item == nil || result.Item["ExpiresAt"] == nil {
+		return false, nil
+	}
+
+	expiresAt, err := strconv.ParseInt(aws.StringValue(result.Item["ExpiresAt"].N), 10, 64)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Now().Unix() < expiresAt, nil
+}
+
+//Memorizza un messaggio inoltrato nella tabella su DynamoDB (ExpiresAt in secondi, come richiesto dal TTL di DynamoDB)
+func (store *dynamoDedupStore) MarkSeen(messageID string, expiresAt time.Time) (retErr error) {
+
+	svc := dynamodb.New(common.Sess)
+
+	_, err := svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(currentConfig().DedupTableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"MessageID": {
+				S: aws.String(messageID),
+			},
+			"ExpiresAt": {
+				N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+			},
+		},
+	})
+
+	return err
+}
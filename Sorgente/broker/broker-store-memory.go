@@ -0,0 +1,441 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+			broker-store-memory.go
+
+	Implementazioni di SubscriberStore, ConfigStore, DeadLetterStore e DedupStore che mantengono i dati in memoria. Permettono di eseguire il broker
+		senza un account AWS (ad esempio per sviluppo e test in locale). I dati vengono persi al riavvio:
+		la configurazione viene ricaricata ogni volta dal file conf_db.json.
+
+*/
+
+const memoryDedupPurgeDelay = time.Minute //Intervallo minimo tra due rimozioni dei messaggi inoltrati scaduti
+
+type memorySubscriberStore struct {
+	mutex       sync.RWMutex
+	subscribers map[string]common.SubscriberEntry
+}
+
+//Crea uno storage in memoria vuoto
+func newMemorySubscriberStore() *memorySubscriberStore {
+	return &memorySubscriberStore{subscribers: make(map[string]common.SubscriberEntry)}
+}
+
+//Aggiunge un subscriber (fallisce se l'ID è già presente, come la condizione attribute_not_exists su DynamoDB)
+func (store *memorySubscriberStore) AddSubscriber(entry common.SubscriberEntry) (retErr error, alreadyExisting bool) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.subscribers[entry.SubID]; ok {
+		return errors.New("subscriber " + entry.SubID + " already existing"), true
+	}
+
+	store.subscribers[entry.SubID] = copySubscriber(entry)
+
+	return nil, false
+}
+
+//Ottiene un subscriber dato il suo ID
+func (store *memorySubscriberStore) GetSubscriber(subID string) (entry common.SubscriberEntry, retErr error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	item, ok := store.subscribers[subID]
+	if !ok {
+		common.Warning("[BROKER] Nessun subscriber trovato con id " + subID)
+		return common.SubscriberEntry{}, errSubscriberNotFound
+	}
+
+	return copySubscriber(item), nil
+}
+
+//Ottiene tutti i subscriber, ordinati per ID
+func (store *memorySubscriberStore) GetSubscribers() (subs []common.SubscriberEntry, retErr error) {
+	return store.GetFilteredSubscribers(SubscriberFilter{})
+}
+
+//Ottiene una pagina di subscriber, ordinati per ID, a partire dal cursore dato
+func (store *memorySubscriberStore) ListSubscribers(limit int64, nextToken string) (subs []common.SubscriberEntry, newNextToken string, retErr error) {
+
+	lastID := ""
+	if nextToken != "" {
+		var err error
+		lastID, err = decodePageToken(nextToken)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	all, _ := store.GetSubscribers()
+
+	for _, sub := range all {
+		if sub.SubID <= lastID {
+			continue
+		}
+		if int64(len(subs)) == limit {
+			newNextToken = encodePageToken(subs[len(subs)-1].SubID)
+			break
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, newNextToken, nil
+}
+
+//Ottiene i subscriber che rispettano il filtro, ordinati per ID
+func (store *memorySubscriberStore) GetFilteredSubscribers(filter SubscriberFilter) (subs []common.SubscriberEntry, retErr error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var subList []common.SubscriberEntry
+
+	for _, item := range store.subscribers {
+		if filter.matches(item) {
+			subList = append(subList, copySubscriber(item))
+		}
+	}
+
+	sort.Slice(subList, func(i, j int) bool { return subList[i].SubID < subList[j].SubID })
+
+	return subList, nil
+}
+
+//Aggiorna la posizione di un subscriber esistente
+func (store *memorySubscriberStore) UpdatePosition(subID string, positionX int, positionY int, latitude float64, longitude float64) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	item, ok := store.subscribers[subID]
+	if !ok {
+		return errSubscriberNotFound
+	}
+
+	item.PositionX = positionX
+	item.PositionY = positionY
+	item.Latitude = latitude
+	item.Longitude = longitude
+	store.subscribers[subID] = item
+
+	return nil
+}
+
+//Sostituisce la lista dei topic di un subscriber esistente
+func (store *memorySubscriberStore) SetTopics(subID string, topics []string) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	item, ok := store.subscribers[subID]
+	if !ok {
+		return errSubscriberNotFound
+	}
+
+	item.Topics = append([]string(nil), topics...)
+	store.subscribers[subID] = item
+
+	return nil
+}
+
+//Aggiorna la coda di ricezione di un subscriber esistente
+func (store *memorySubscriberStore) UpdateQueueURL(subID string, queueURL string) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	item, ok := store.subscribers[subID]
+	if !ok {
+		return errSubscriberNotFound
+	}
+
+	item.QueueURL = queueURL
+	store.subscribers[subID] = item
+
+	return nil
+}
+
+//Aggiorna l'ultima attività di un subscriber esistente
+func (store *memorySubscriberStore) Touch(subID string, lastSeen int64) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	item, ok := store.subscribers[subID]
+	if !ok {
+		return errSubscriberNotFound
+	}
+
+	item.LastSeen = lastSeen
+	store.subscribers[subID] = item
+
+	return nil
+}
+
+//Rimuove un subscriber la cui ultima attività è precedente a cutoff
+func (store *memorySubscriberStore) RemoveExpiredSubscriber(subID string, cutoff int64) (removed bool, retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	item, ok := store.subscribers[subID]
+	if !ok || item.LastSeen >= cutoff {
+		return false, nil
+	}
+
+	delete(store.subscribers, subID)
+
+	return true, nil
+}
+
+//Rimuove un subscriber (come su DynamoDB, rimuovere un subscriber inesistente non è un errore)
+func (store *memorySubscriberStore) RemoveSubscriber(subID string) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.subscribers, subID)
+
+	return nil
+}
+
+//Copia di una entry, in modo che chi la riceve non condivida la lista dei topic con lo storage
+func copySubscriber(entry common.SubscriberEntry) common.SubscriberEntry {
+	entry.Topics = append([]string(nil), entry.Topics...)
+	return entry
+}
+
+
+type memoryConfigStore struct {
+	mutex   sync.RWMutex
+	configs []ConfigEntry
+	history map[string][]ConfigChange //Storico delle modifiche per parametro
+}
+
+//Formato del file conf_db.json (lo stesso usato da "aws dynamodb batch-write-item" in start.sh)
+type configTableFile map[string][]struct {
+	PutRequest struct {
+		Item struct {
+			FieldName  struct{ S string }
+			FieldValue struct{ S string }
+		}
+	}
+}
+
+//Crea una tabella di configurazione in memoria a partire dal file dato
+func newMemoryConfigStore(fileName string) (store *memoryConfigStore, retErr error) {
+
+	byteValue, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var table configTableFile
+	err = json.Unmarshal(byteValue, &table)
+	if err != nil {
+		return nil, err
+	}
+
+	store = &memoryConfigStore{history: make(map[string][]ConfigChange)}
+	for _, request := range table[configTable] {
+		store.configs = append(store.configs, ConfigEntry{FieldName: request.PutRequest.Item.FieldName.S, FieldValue: request.PutRequest.Item.FieldValue.S})
+	}
+
+	if len(store.configs) == 0 {
+		return nil, errors.New("no " + configTable + " entries found in " + fileName)
+	}
+
+	return store, nil
+}
+
+//Ottiene tutti i parametri di configurazione
+func (store *memoryConfigStore) GetParameters() (configs []ConfigEntry, retErr error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return append([]ConfigEntry(nil), store.configs...), nil
+}
+
+//Aggiorna un parametro esistente (come la condizione attribute_exists su DynamoDB)
+func (store *memoryConfigStore) UpdateParameter(fieldName string, fieldValue string) (oldValue string, retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for i := range store.configs {
+		if store.configs[i].FieldName == fieldName {
+			oldValue = store.configs[i].FieldValue
+			store.configs[i].FieldValue = fieldValue
+			return oldValue, nil
+		}
+	}
+
+	return "", errors.New("configuration parameter " + fieldName + " does not exist")
+}
+
+//Registra una modifica nello storico del parametro
+func (store *memoryConfigStore) AddChange(change ConfigChange) (stored ConfigChange, retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	change.Version = len(store.history[change.FieldName]) + 1
+	store.history[change.FieldName] = append(store.history[change.FieldName], change)
+
+	return change, nil
+}
+
+//Ottiene lo storico di un parametro
+func (store *memoryConfigStore) GetChanges(fieldName string) (changes []ConfigChange, retErr error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return append([]ConfigChange(nil), store.history[fieldName]...), nil
+}
+
+
+type memoryDeadLetterStore struct {
+	mutex   sync.RWMutex
+	letters map[string]DeadLetter
+}
+
+//Crea uno storage vuoto per i messaggi non consegnati
+func newMemoryDeadLetterStore() *memoryDeadLetterStore {
+	return &memoryDeadLetterStore{letters: make(map[string]DeadLetter)}
+}
+
+//Aggiunge un messaggio non consegnato
+func (store *memoryDeadLetterStore) AddDeadLetter(letter DeadLetter) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.letters[letter.LetterID] = copyDeadLetter(letter)
+
+	return nil
+}
+
+//Ottiene un messaggio non consegnato dato il suo identificativo
+func (store *memoryDeadLetterStore) GetDeadLetter(letterID string) (letter DeadLetter, retErr error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	letter, ok := store.letters[letterID]
+	if !ok {
+		return DeadLetter{}, errDeadLetterNotFound
+	}
+
+	return copyDeadLetter(letter), nil
+}
+
+//Ottiene tutti i messaggi non consegnati, ordinati per istante del fallimento
+func (store *memoryDeadLetterStore) GetDeadLetters() (letters []DeadLetter, retErr error) {
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, letter := range store.letters {
+		letters = append(letters, copyDeadLetter(letter))
+	}
+
+	sortDeadLetters(letters)
+
+	return letters, nil
+}
+
+//Rimuove un messaggio non consegnato
+func (store *memoryDeadLetterStore) RemoveDeadLetter(letterID string) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.letters[letterID]; !ok {
+		return errDeadLetterNotFound
+	}
+	delete(store.letters, letterID)
+
+	return nil
+}
+
+//Copia di un messaggio non consegnato (la mappa degli attributi non viene condivisa con il chiamante)
+func copyDeadLetter(letter DeadLetter) DeadLetter {
+
+	attributes := make(map[string]string, len(letter.Attributes))
+	for key, value := range letter.Attributes {
+		attributes[key] = value
+	}
+	letter.Attributes = attributes
+	letter.Queues = append([]string(nil), letter.Queues...)
+
+	return letter
+}
+
+//Ordina i messaggi non consegnati per istante del fallimento
+func sortDeadLetters(letters []DeadLetter) {
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].FailedAt != letters[j].FailedAt {
+			return letters[i].FailedAt < letters[j].FailedAt
+		}
+		return letters[i].LetterID < letters[j].LetterID
+	})
+}
+
+
+type memoryDedupStore struct {
+	mutex     sync.Mutex
+	messages  map[string]time.Time //Messaggi inoltrati e relativo istante di scadenza
+	lastPurge time.Time            //Istante dell'ultima rimozione dei messaggi scaduti
+}
+
+//Crea uno storage vuoto per i messaggi già inoltrati
+func newMemoryDedupStore() *memoryDedupStore {
+	return &memoryDedupStore{messages: make(map[string]time.Time), lastPurge: time.Now()}
+}
+
+//Verifica se un messaggio è già stato inoltrato e non è scaduto
+func (store *memoryDedupStore) Seen(messageID string) (seen bool, retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	expiresAt, ok := store.messages[messageID]
+
+	return ok && time.Now().Before(expiresAt), nil
+}
+
+//Memorizza un messaggio inoltrato, rimuovendo periodicamente quelli scaduti
+func (store *memoryDedupStore) MarkSeen(messageID string, expiresAt time.Time) (retErr error) {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(store.lastPurge) > memoryDedupPurgeDelay {
+		for id, expiration := range store.messages {
+			if now.After(expiration) {
+				delete(store.messages, id)
+			}
+		}
+		store.lastPurge = now
+	}
+
+	store.messages[messageID] = expiresAt
+
+	return nil
+}
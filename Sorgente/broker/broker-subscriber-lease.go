@@ -0,0 +1,99 @@
+package main
+
+import (
+	"common"
+	"context"
+	"strconv"
+	"time"
+)
+
+/*
+			broker-subscriber-lease.go
+
+	Questo modulo rimuove i subscriber inattivi, ad esempio terminati senza deregistrarsi. Ogni subscriber ha un lease
+		(LastSeen) rinnovato dalla registrazione, dagli aggiornamenti della posizione, dalla ripresa e dagli heartbeat
+		(POST /subscriber/{id}/heartbeat).
+	Ogni reaper_delay secondi il broker cerca i subscriber il cui lease è scaduto da più di subscriber_ttl secondi e
+		li rimuove insieme alla loro coda. La rimozione è condizionata alla scadenza del lease, per cui più broker
+		possono cercare i subscriber inattivi contemporaneamente.
+
+*/
+
+const defaultSubscriberTTL = 600 //Tempo di default (in secondi) di inattività dopo cui un subscriber viene rimosso
+const defaultReaperDelay = 60    //Intervallo di default tra due ricerche dei subscriber inattivi (in secondi)
+
+//Rinnova il lease di un subscriber
+func touchSubscriber(subID string) (retErr error) {
+
+	err := subscriberStore.Touch(subID, time.Now().Unix())
+	if err != nil && err != errSubscriberNotFound {
+		common.Warning("[BROKER] Errore nel rinnovo del lease del subscriber " + subID + ". " + err.Error())
+	}
+
+	return err
+}
+
+//Avvia la goroutine che rimuove periodicamente i subscriber inattivi (fino all'annullamento del contesto)
+func startSubscriberReaper(ctx context.Context) {
+
+	//Alla modifica dell'intervallo la ricerca viene ripianificata
+	wakeup := configWakeup(func(old *BrokerConfig, updated *BrokerConfig) bool {
+		return old.ReaperDelay != updated.ReaperDelay
+	})
+
+	go func() {
+		for sleepUntilWakeup(ctx, wakeup, time.Second*time.Duration(currentConfig().ReaperDelay)) {
+
+			ttl := currentConfig().SubscriberTTL
+			if ttl > 0 {
+				reapSubscribers(ttl)
+			}
+		}
+	}()
+}
+
+//Rimuove i subscriber il cui lease è scaduto da più di ttl secondi, insieme alla loro coda
+func reapSubscribers(ttl int) {
+
+	now := time.Now().Unix()
+	cutoff := now - int64(ttl)
+
+	subs, err := subscriberStore.GetSubscribers()
+	if err != nil {
+		common.Warning("[BROKER] Errore nella ricerca dei subscriber inattivi. " + err.Error())
+		return
+	}
+
+	expired := 0
+	for _, sub := range subs {
+
+		//I subscriber registrati prima dell'introduzione dei lease non hanno LastSeen: il loro lease parte da ora
+		if sub.LastSeen == 0 {
+			_ = touchSubscriber(sub.SubID)
+			continue
+		}
+		if sub.LastSeen >= cutoff {
+			continue
+		}
+
+		removed, err := subscriberStore.RemoveExpiredSubscriber(sub.SubID, cutoff)
+		if err != nil {
+			common.Warning("[BROKER] Errore nella rimozione del subscriber inattivo " + sub.SubID + ". " + err.Error())
+			continue
+		}
+
+		//Il lease è stato rinnovato dopo la lettura, oppure il subscriber è già stato rimosso
+		if !removed {
+			continue
+		}
+
+		common.Info("[BROKER] Subscriber " + sub.SubID + " rimosso per inattività (ultima attività " + time.Unix(sub.LastSeen, 0).Format(time.RFC3339) + ")")
+
+		_ = deleteQueue(sub.QueueURL)
+		expired++
+	}
+
+	if expired > 0 {
+		sendLogMessage("Subscriber rimossi per inattività: " + strconv.Itoa(expired))
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"common"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+/*
+			broker-subscriber-store.go
+
+	Questo modulo definisce l'interfaccia SubscriberStore, cioè lo storage dove vengono memorizzati i subscribers.
+	Le funzioni di utility usate dal resto del broker (addEntryDB, updatePosition, addTopic, ...) si appoggiano
+		all'implementazione selezionata nella configurazione locale, in modo da poter cambiare storage
+		(DynamoDB, in memoria) senza modificare la gestione delle richieste REST.
+
+*/
+
+//Interfaccia per lo storage dei subscriber
+type SubscriberStore interface {
+	AddSubscriber(entry common.SubscriberEntry) (retErr error, alreadyExisting bool)      //Aggiunge un subscriber (fallisce se l'ID è già presente)
+	GetSubscriber(subID string) (entry common.SubscriberEntry, retErr error)              //Ottiene un subscriber dato il suo ID
+	GetSubscribers() (subs []common.SubscriberEntry, retErr error)                        //Ottiene tutti i subscriber registrati
+	ListSubscribers(limit int64, nextToken string) (subs []common.SubscriberEntry, newNextToken string, retErr error) //Ottiene al massimo limit subscriber a partire dal cursore (nextToken vuoto = prima pagina)
+	GetFilteredSubscribers(filter SubscriberFilter) (subs []common.SubscriberEntry, retErr error) //Ottiene i subscriber che rispettano il filtro
+	UpdatePosition(subID string, positionX int, positionY int, latitude float64, longitude float64) (retErr error) //Aggiorna la posizione di un subscriber esistente (latitudine e longitudine 0 se non disponibili)
+	SetTopics(subID string, topics []string) (retErr error)                               //Sostituisce la lista dei topic di un subscriber
+	UpdateQueueURL(subID string, queueURL string) (retErr error)                          //Aggiorna la coda di ricezione di un subscriber esistente
+	Touch(subID string, lastSeen int64) (retErr error)                                    //Aggiorna l'ultima attività di un subscriber esistente
+	RemoveExpiredSubscriber(subID string, cutoff int64) (removed bool, retErr error)      //Rimuove un subscriber solo se la sua ultima attività è precedente a cutoff
+	RemoveSubscriber(subID string) (retErr error)                                         //Rimuove un subscriber
+}
+
+//Filtro utilizzato per selezionare i subscriber a cui inoltrare un messaggio
+type SubscriberFilter struct {
+	Topic     string //Topic a cui deve essere iscritto il subscriber ("" se il topic non è rilevante)
+	Spatial   bool   //Se true, il subscriber deve trovarsi entro Radius da (PositionX, PositionY)
+	PositionX int
+	PositionY int
+	Radius    int
+	Distance  string //Metrica usata per il raggio (distanceEuclidean, distanceManhattan o distanceSquare)
+
+	//Posizione geografica (vedere newGeoFilter): se Geo è true, Radius è il raggio in blocchi del quadrato che
+	//contiene l'area e la distanza esatta viene calcolata in metri rispetto a (Latitude, Longitude)
+	Geo          bool
+	Latitude     float64
+	Longitude    float64
+	RadiusMeters float64
+	Grid         gridConfig //Griglia usata per la posizione geografica dei subscriber che hanno comunicato solo il blocco
+}
+
+//Metriche supportate per il confronto con il raggio (parametro di configurazione distance_mode)
+const (
+	distanceEuclidean = "euclidean" //Cerchio di raggio Radius (default)
+	distanceManhattan = "manhattan" //Rombo: |dx| + |dy| <= Radius
+	distanceSquare    = "square"    //Quadrato di lato 2*Radius (comportamento originale)
+)
+
+const maxInt = int(^uint(0) >> 1) //Valore massimo di un int
+const minInt = -maxInt - 1         //Valore minimo di un int
+
+//Raggio massimo (in blocchi) considerato dalle ricerche: un raggio maggiore viene ridotto a questo valore, in modo
+//che gli estremi dell'area, le distanze e il numero di celle visitate dall'indice non vadano in overflow
+const maxFilterRadius = 1 << 30
+
+//Verifica se la metrica indicata è supportata
+func validDistanceMode(mode string) bool {
+	return mode == distanceEuclidean || mode == distanceManhattan || mode == distanceSquare
+}
+
+var subscriberStore SubscriberStore //Storage dei subscriber utilizzato dal broker
+
+//Errore ritornato quando il subscriber cercato non esiste
+var errSubscriberNotFound = errors.New("no item found")
+
+//Inizializza lo storage dei subscriber secondo la configurazione locale
+func initSubscriberStore() (retErr error) {
+
+	storeType := common.Config.SubscriberStore
+	if storeType == "" && common.Config.Mode == "local" {
+		storeType = "memory"
+	}
+
+	switch storeType {
+	case "", "dynamodb":
+		subscriberStore = &dynamoSubscriberStore{}
+	case "memory":
+		subscriberStore = newMemorySubscriberStore()
+	default:
+		common.Fatal("[BROKER] Storage dei subscriber \"" + common.Config.SubscriberStore + "\" non supportato")
+		return errors.New("unknown subscriber store " + common.Config.SubscriberStore)
+	}
+
+	//Le ricerche filtrate vengono risolte dall'indice spaziale in memoria
+	subscriberStore = newIndexedSubscriberStore(subscriberStore)
+
+	common.Info("[BROKER] Storage dei subscriber inizializzato: " + storeType)
+
+	return nil
+}
+
+//Raggio del filtro limitato a [0, maxFilterRadius]
+func (filter SubscriberFilter) clampedRadius() int {
+
+	if filter.Radius < 0 {
+		return 0
+	}
+	if filter.Radius > maxFilterRadius {
+		return maxFilterRadius
+	}
+
+	return filter.Radius
+}
+
+//Estremi (inclusi) del quadrato di lato 2*Radius centrato nella posizione del filtro, limitati ai valori di un int
+func (filter SubscriberFilter) bounds() (minX int, maxX int, minY int, maxY int) {
+
+	radius := filter.clampedRadius()
+
+	interval := func(center int) (low int, high int) {
+		low, high = minInt, maxInt
+		if center >= minInt+radius {
+			low = center - radius
+		}
+		if center <= maxInt-radius {
+			high = center + radius
+		}
+		return low, high
+	}
+
+	minX, maxX = interval(filter.PositionX)
+	minY, maxY = interval(filter.PositionY)
+
+	return minX, maxX, minY, maxY
+}
+
+//Verifica se un subscriber rispetta il filtro dato
+func (filter SubscriberFilter) matches(entry common.SubscriberEntry) bool {
+
+	if filter.Topic != "" && common.StringListContains(entry.Topics, filter.Topic) == false {
+		return false
+	}
+
+	if filter.Spatial {
+		minX, maxX, minY, maxY := filter.bounds()
+		if entry.PositionX < minX || entry.PositionX > maxX || entry.PositionY < minY || entry.PositionY > maxY {
+			return false
+		}
+
+		if filter.Geo {
+			return filter.matchesGeo(entry)
+		}
+
+		//Il quadrato contiene sia il cerchio che il rombo, quindi il controllo precedente è valido per tutte le metriche.
+		//All'interno del quadrato le differenze non superano maxFilterRadius e i calcoli non vanno in overflow
+		dx := int64(entry.PositionX) - int64(filter.PositionX)
+		dy := int64(entry.PositionY) - int64(filter.PositionY)
+		radius := int64(filter.clampedRadius())
+
+		switch filter.Distance {
+		case distanceSquare:
+		case distanceManhattan:
+			if abs64(dx)+abs64(dy) > radius {
+				return false
+			}
+		default:
+			if dx*dx+dy*dy > radius*radius {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+//Valore assoluto di un int64
+func abs64(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+//Ottiene la lista di tutti i subscribers registrati nel sistema
+func getSubscribers() (subs []common.SubscriberEntry, retErr error) {
+
+	subList, err := subscriberStore.GetSubscribers()
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'esecuzione della Query\n" + err.Error())
+		return nil, err
+	}
+
+	return subList, nil
+}
+
+//Ottiene una pagina della lista dei subscribers registrati nel sistema
+func listSubscribers(limit int64, nextToken string) (subs []common.SubscriberEntry, newNextToken string, retErr error) {
+
+	subList, newNextToken, err := subscriberStore.ListSubscribers(limit, nextToken)
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'ottenimento della pagina di subscribers. " + err.Error())
+		return nil, "", err
+	}
+
+	return subList, newNextToken, nil
+}
+
+//Codifica il cursore di paginazione (opaco per il client) a partire dall'ultimo SubID della pagina
+func encodePageToken(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastID))
+}
+
+//Decodifica il cursore di paginazione
+func decodePageToken(token string) (lastID string, retErr error) {
+
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errors.New("invalid page token")
+	}
+
+	return string(decoded), nil
+}
+
+//Genera un nuovo ID per un subscriber: 128 bit casuali in formato UUID (versione 4). L'ID non dipende dai subscriber
+//già registrati, per cui non è necessario leggere lo storage, e non è prevedibile a partire da quello di un altro
+//subscriber
+func newSubscriberID() (subID string, retErr error) {
+
+	var id [16]byte
+
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", err
+	}
+
+	id[6] = (id[6] & 0x0f) | 0x40 //Versione 4
+	id[8] = (id[8] & 0x3f) | 0x80 //Variante RFC 4122
+
+	encoded := hex.EncodeToString(id[:])
+
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:32], nil
+}
+
+//Metodo per aggiungere un subscriber allo storage
+func addEntryDB(subID string, queueUrl string) (retErr error, alreadyExisting bool) {
+
+	//Item da aggiungere
+	item := common.SubscriberEntry{
+		SubID:     subID,
+		QueueURL:  queueUrl,
+		Topics:    []string{"empty"},
+		PositionX: 0,
+		PositionY: 0,
+		LastSeen:  time.Now().Unix(),
+	}
+
+	err, alreadyExisting := subscriberStore.AddSubscriber(item)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'inserimento del subscriber\n" + err.Error())
+		return err, alreadyExisting
+	}
+
+	common.Info("[BROKER] Subscriber registrato al DB con successo. (" + item.SubID + ")")
+
+	return nil, false
+}
+
+//Aggiornamento della posizione di un subscriber (coordinate a blocchi oppure latitudine e longitudine)
+func updatePosition(subID string, request common.SubPositionUpdateRequest) (retErr error) {
+
+	var positionX, positionY int
+	var latitude, longitude float64
+	var err error
+
+	if request.Latitude != "" || request.Longitude != "" {
+
+		latitude, err = strconv.ParseFloat(request.Latitude, 64)
+		if err != nil {
+			common.Warning("[BROKER] Latitudine non valida: " + request.Latitude)
+			return errors.New("invalid position")
+		}
+		longitude, err = strconv.ParseFloat(request.Longitude, 64)
+		if err != nil {
+			common.Warning("[BROKER] Longitudine non valida: " + request.Longitude)
+			return errors.New("invalid position")
+		}
+		if !common.ValidCoordinates(latitude, longitude) {
+			common.Warning("[BROKER] Coordinate fuori dall'intervallo consentito: " + request.Latitude + ", " + request.Longitude)
+			return errors.New("invalid position")
+		}
+
+		//Il blocco corrispondente viene salvato per i messaggi che usano le coordinate a blocchi
+		positionX, positionY = currentConfig().Grid.geoToBlock(latitude, longitude)
+
+	} else {
+
+		positionX, err = strconv.Atoi(request.PositionX)
+		if err != nil {
+			common.Warning("[BROKER] Coordinata X non valida: " + request.PositionX)
+			return errors.New("invalid position")
+		}
+		positionY, err = strconv.Atoi(request.PositionY)
+		if err != nil {
+			common.Warning("[BROKER] Coordinata Y non valida: " + request.PositionY)
+			return errors.New("invalid position")
+		}
+	}
+
+	err = subscriberStore.UpdatePosition(subID, positionX, positionY, latitude, longitude)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'aggiornamento della posizione. " + err.Error())
+		return err
+	}
+
+	//Un aggiornamento della posizione vale anche come heartbeat
+	_ = touchSubscriber(subID)
+
+	common.Info("[BROKER] Posizione aggiornata con successo")
+
+	return nil
+}
+
+//Aggiunta di 1 o più topic ad un subscriber
+func addTopic(subID string, topics []string) (retErr error) {
+
+	//Creazione di un nuovo array da salvare
+	origTopics, err := getTopicList(subID)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'ottenere la topic list")
+		return err
+	}
+
+	for _, elem := range topics {
+		if common.StringListContains(origTopics, elem) == false {
+			origTopics = append(origTopics, elem)
+		}
+	}
+
+	err = subscriberStore.SetTopics(subID, origTopics)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'aggiunta di topic. " + err.Error())
+		return err
+	}
+
+	common.Info("[BROKER] Topic aggiunti con successo")
+
+	//Un lista vuota di topic è espressa dal singolo elementro "empty", che viene protnamente eliminato se si aggiungono topics
+	_ = removeTopic(subID, []string{"empty"})
+
+	return nil
+}
+
+//Rimozione di topic ad un subscriber
+func removeTopic(subID string, topics []string) (retErr error) {
+
+	//Creazione nuovo insieme di topic eliminando quelli da rimuovere
+	origTopics, err := getTopicList(subID)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'ottenere la topic list")
+		return err
+	}
+
+	var newTopics []string
+
+	for _, elem := range origTopics {
+		if common.StringListContains(topics, elem) == false {
+			newTopics = append(newTopics, elem)
+		}
+	}
+
+	//Se non rimane nessun topic, viene impostato il singolo topic empty
+	//Nota bene: questo è necessario farlo poichè dynamodb non supporta le liste vuote
+	if len(newTopics) == 0 {
+		newTopics = append(newTopics, "empty")
+	}
+
+	err = subscriberStore.SetTopics(subID, newTopics)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nella rimozione di topic. " + err.Error())
+		return err
+	}
+
+	common.Info("[BROKER] Topic rimosso con successo")
+
+	return nil
+}
+
+//Ottiene la lista dei topic di un subscriber
+func getTopicList(id string) (topics []string, retErr error) {
+
+	item, err := subscriberStore.GetSubscriber(id)
+	if err != nil {
+		common.Warning("[BROKER] Errore nel retreive dell'item con ID: " + id + ".\n" + err.Error())
+		return nil, err
+	}
+
+	return item.Topics, nil
+}
+
+//Ottiene la coda SQS di un subscriber
+func getQueueUrl(id string) (queueUrl string, retErr error) {
+
+	item, err := subscriberStore.GetSubscriber(id)
+	if err != nil {
+		common.Warning("[BROKER] Errore nel retreive del subscriber con ID: " + id + ".\n" + err.Error())
+		return "", err
+	}
+
+	common.Info("[BROKER] Subscriber trovato: " + item.SubID + "\n\t" + item.QueueURL)
+
+	return item.QueueURL, nil
+}
+
+//Ottieni i subscriber filtrati (Su base topic e context-aware)
+func getFilteredSubscribers(filter SubscriberFilter) (subsID []string, queueUrl []string, retErr error) {
+
+	var subs []string
+	var qUrl []string
+
+	result, err := subscriberStore.GetFilteredSubscribers(filter)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'esecuzione della query. " + err.Error())
+		return nil, nil, err
+	}
+
+	for _, item := range result {
+		subs = append(subs, item.SubID)
+		qUrl = append(qUrl, item.QueueURL)
+	}
+
+	return subs, qUrl, nil
+}
+
+//Funzione che rimuove un subscriber dallo storage
+func removeEntryDB(subID string) (retErr error) {
+
+	err := subscriberStore.RemoveSubscriber(subID)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'eliminazione dell'item\n" + err.Error())
+		return err
+	}
+
+	common.Info("[BROKER] Subscriber rimosso con successo. (" + subID + ")")
+
+	return nil
+}
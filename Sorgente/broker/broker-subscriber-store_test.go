@@ -0,0 +1,67 @@
+package main
+
+import (
+	"common"
+	"testing"
+)
+
+//Confronto della posizione dei subscriber con il raggio nelle diverse metriche
+func TestSubscriberFilterDistance(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		distance string
+		radius   int
+		x, y     int
+		want     bool
+	}{
+		{"euclidean inside", distanceEuclidean, 5, 3, 4, true},
+		{"euclidean outside", distanceEuclidean, 5, 4, 4, false},
+		{"euclidean on the axis", distanceEuclidean, 5, 0, -5, true},
+		{"default is euclidean", "", 5, 4, 4, false},
+		{"manhattan on the border", distanceManhattan, 7, 3, -4, true},
+		{"manhattan outside", distanceManhattan, 7, 4, 4, false},
+		{"square corner", distanceSquare, 5, -5, 5, true},
+		{"square outside", distanceSquare, 5, 6, 0, false},
+		{"radius zero same cell", distanceEuclidean, 0, 0, 0, true},
+		{"radius zero other cell", distanceManhattan, 0, 1, 0, false},
+		{"negative radius", distanceSquare, -1, 0, 0, true},
+		{"huge radius does not overflow", distanceEuclidean, maxInt, maxFilterRadius, 0, true},
+		{"beyond the clamped radius", distanceSquare, maxInt, maxInt, 0, false},
+		{"extreme position", distanceManhattan, maxInt, minInt, minInt, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			filter := SubscriberFilter{Spatial: true, Radius: test.radius, Distance: test.distance}
+			entry := common.SubscriberEntry{SubID: "a", PositionX: test.x, PositionY: test.y}
+
+			if got := filter.matches(entry); got != test.want {
+				t.Fatalf("matches(%d, %d) = %v, want %v", test.x, test.y, got, test.want)
+			}
+		})
+	}
+}
+
+//Metriche accettate dal parametro distance_mode
+func TestValidDistanceMode(t *testing.T) {
+
+	tests := []struct {
+		mode string
+		want bool
+	}{
+		{distanceEuclidean, true},
+		{distanceManhattan, true},
+		{distanceSquare, true},
+		{"", false},
+		{"Euclidean", false},
+		{"chebyshev", false},
+	}
+
+	for _, test := range tests {
+		if got := validDistanceMode(test.mode); got != test.want {
+			t.Errorf("validDistanceMode(%q) = %v, want %v", test.mode, got, test.want)
+		}
+	}
+}
@@ -1,14 +1,11 @@
 package main
 import (
 	"common"
-	"errors"
-	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
-	"github.com/aws/aws-sdk-go/service/sqs"
+	"context"
+	"sync"
 	"math/rand"
 	"strconv"
 	"time"
-	"net"
-	"fmt"
 )
 
 /*
@@ -37,59 +34,146 @@ func Init() {
 		return
 	}
 
-	//Recupero della configurazione dal dynamoDB
+	//In modalità locale il broker gestisce direttamente le code, in memoria
+	if common.Config.Mode == "local" {
+		common.MessageTransport = common.NewMemoryTransport()
+	}
+
+	//Inizializzazione dello storage della configurazione
+	err = initConfigStore()
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'inizializzazione dello storage della configurazione\n" + err.Error())
+		return
+	}
+
+	//Inizializzazione dello storage dei subscriber
+	err = initSubscriberStore()
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'inizializzazione dello storage dei subscriber\n" + err.Error())
+		return
+	}
+
+	//Inizializzazione dello storage dei messaggi non consegnati
+	initDeadLetterStore()
+
+	//Inizializzazione dello storage dei messaggi già inoltrati
+	err = initDedupStore()
+	if err != nil {
+		common.Fatal("[BROKER] Errore nell'inizializzazione dello storage dei messaggi inoltrati\n" + err.Error())
+		return
+	}
+
+	//Recupero della configurazione
 	err = retreiveConfig()
 	if err != nil {
 		common.Fatal("[BROKER] Errore nel retreive della configurazione\n" + err.Error())
 		return
 	}
+	//Contesto annullato alla ricezione di SIGINT o SIGTERM
+	ctx, cancel := common.ShutdownContext()
+	defer cancel()
+
+	//Caricamento dell'indice spaziale dei subscriber
+	startSubscriberIndex(ctx)
+
+	//Rimozione periodica dei subscriber inattivi
+	startSubscriberReaper(ctx)
+
+	//Riconciliazione periodica tra subscriber e code
+	startReconciliation(ctx)
+
 	//Invio messaggio al logger remoto
 	sendLogMessage("Configurazione completata")
 
 	//Inizializzo il thread che gestisce le richieste API REST
-	go handleRequests()
+	var server sync.WaitGroup
+	server.Add(1)
+	go func() {
+		defer server.Done()
+		handleRequests(ctx)
+	}()
 
 
-	broker()
+	broker(ctx)
 
+	//Attesa della chiusura dell'API REST
+	server.Wait()
+
+	sendLogMessage("Broker terminato")
+	common.Info("[BROKER] Broker terminato")
+	common.CloseLog()
 }
 
-// Il meotodo principale del broker che gestisce la logica
-func broker() {
+const minReceiveBackoff = time.Second //Attesa dopo la prima ricezione vuota
+
+
+// Il meotodo principale del broker che gestisce la logica. Termina all'annullamento del contesto, dopo aver
+//completato l'inoltro dei messaggi già ricevuti
+func broker(ctx context.Context) {
 
 	//Go routine per l'aggiornamento della configurazione
-	go loadUpdatedConfiguration()
+	go loadUpdatedConfiguration(ctx)
 
-	//Ciclo infinito
-	for {
-		_, err := receiveQueueMessage(globalSqsQueue)
+	//Attesa prima di interrogare nuovamente la coda: nulla finché arrivano messaggi, poi raddoppiata ad ogni
+	//ricezione vuota fino a delay_sqs_request
+	var backoff time.Duration
+
+	//Al cambio della coda o dell'attesa massima l'attesa in corso viene interrotta
+	wakeup := configWakeup(func(old *BrokerConfig, updated *BrokerConfig) bool {
+		return old.GlobalSqsQueue != updated.GlobalSqsQueue || old.DelaySqsRequest != updated.DelaySqsRequest
+	})
+
+	//Ciclo fino alla terminazione
+	for ctx.Err() == nil {
+		messages, err := receiveQueueMessage(currentConfig().GlobalSqsQueue)
 		if err != nil {
 			common.Fatal("[BROKER] Errore nell'ottenimento del messaggio in coda. " + err.Error())
 		}
 
+		if err == nil && len(messages) > 0 {
+			backoff = 0
+		} else {
+			backoff = nextReceiveBackoff(backoff)
+		}
+		brokerStats.recordBackoff(backoff)
+
 		//Attesa prima di interrogare coda SQS di nuovo
-		delay, err := strconv.Atoi(delay_sqs_request)
-		if err != nil {
-			common.Warning("[BROKER] Errore nella conversione del delay SQS. " + err.Error())
-			time.Sleep(time.Second * 10)
+		if !sleepUntilWakeup(ctx, wakeup, backoff) {
+			break
 		}
-		time.Sleep(time.Second * time.Duration(delay))
 	}
+
+	common.Info("[BROKER] Ricezione dei messaggi terminata")
+}
+
+//Calcola l'attesa dopo una ricezione vuota (o fallita) a partire da quella corrente
+func nextReceiveBackoff(backoff time.Duration) time.Duration {
+
+	maxDelay := time.Second * time.Duration(currentConfig().DelaySqsRequest)
+
+	if backoff < minReceiveBackoff {
+		backoff = minReceiveBackoff
+	} else {
+		backoff *= 2
+	}
+	if backoff > maxDelay {
+		backoff = maxDelay
+	}
+
+	return backoff
 }
 
 
 //Metodo per aggiornare automaticamente la configurazione dal DynamoDB relativo
-func loadUpdatedConfiguration(){
+func loadUpdatedConfiguration(ctx context.Context){
 
 	for {
 
 		//Tempo di attesa prima di aggiornare la propria configurazione
-		delay, err := strconv.Atoi(delay_load_config)
-		if err != nil {
-			common.Warning("[BROKER] Errore nella conversione del delay per il load della configurazione. " + err.Error())
-			time.Sleep(time.Second * 120)
+		delay := currentConfig().DelayLoadConfig
+		if !common.SleepContext(ctx, time.Second * time.Duration(delay)) {
+			return
 		}
-		time.Sleep(time.Second * time.Duration(delay))
 
 		_ = retreiveConfig()
 	}
@@ -97,94 +181,66 @@ func loadUpdatedConfiguration(){
 
 
 
-//Invio del messaggio alle rispettive code
-func sendMessage(message sqs.Message) (retErr error) {
+//Decodifica un messaggio ricevuto e seleziona le code dei subscriber a cui deve essere inoltrato (l'invio è effettuato
+//da processMessages, vedere broker-fanout.go)
+func routeMessage(conf *BrokerConfig, queueMessage common.QueueMessage) (message common.Message, queueUrl []string, retErr error) {
 
-	//Esportazione dei parametri del messaggio sqs.Message ottenuto
-	id 				:= *message.MessageAttributes["ID"].StringValue
-	topic 			:= *message.MessageAttributes["Topic"].StringValue
-	positive, err 	:= strconv.Atoi(*message.MessageAttributes["Positive"].StringValue)
-	if err != nil { return errors.New("error converting string to int") }
-	peopleNum, err 	:= strconv.Atoi(*message.MessageAttributes["PeopleNum"].StringValue)
-	if err != nil { return errors.New("error converting string to int") }
-	mq, err 		:= strconv.Atoi(*message.MessageAttributes["Mq"].StringValue)
-	if err != nil { return errors.New("error converting string to int") }
-	positionX, err 	:= strconv.Atoi(*message.MessageAttributes["PositionX"].StringValue)
-	if err != nil { return errors.New("error converting string to int") }
-	positionY, err 	:= strconv.Atoi(*message.MessageAttributes["PositionY"].StringValue)
-	if err != nil { return errors.New("error converting string to int") }
-	radius, err		:= strconv.Atoi(*message.MessageAttributes["Radius"].StringValue)
-	if err != nil { return errors.New("error converting string to int") }
+	//Decodifica e validazione del messaggio ottenuto
+	message, err := common.DecodeMessage(queueMessage)
+	if err != nil { return message, nil, err }
+	err = message.Validate()
+	if err != nil { return message, nil, err }
 
+	//Esportazione dei parametri del messaggio ottenuto
+	id 			:= message.ID
+	topic 		:= message.Topic
+	positive 	:= message.Positive
+	peopleNum 	:= message.PeopleNum
+	mq 			:= message.Mq
 
-	//Filtro per effettuare la query su DynamoDB
-	var filter expression.ConditionBuilder
-
-	//Se esiste almeno un caso positivo (messaggio di positività)
-	if positive > 0 {
-		//Inoltra a tutti a prescindere dai topic, utilizzo il raggio nel caso di positivo
-		cond2 := expression.Name("PositionX").Between(expression.Value(positionX - positive_radius), expression.Value(positionX + positive_radius))
-		cond3 := expression.Name("PositionY").Between(expression.Value(positionY - positive_radius), expression.Value(positionY + positive_radius))
-		filter = expression.And(cond2, cond3)
-
-		//Se il raggio è maggiore di zero (messaggio normale)
-	} else if radius > 0 {
-		cond1 := expression.Name("Topics").Contains(topic)
-		cond2 := expression.Name("PositionX").Between(expression.Value(positionX - radius), expression.Value(positionX + radius))
-		cond3 := expression.Name("PositionY").Between(expression.Value(positionY - radius), expression.Value(positionY + radius))
-		filter = expression.And(cond1, expression.And(cond2, cond3))
-
-		//Messaggio di emergenza se ha radius == 0 (radius < 0 non è contemplato)
-	} else {
-		filter = expression.Name("Topics").Contains(topic)
-	}
-
-	//Creazione dell'espressione da dare come input
-	projection := expression.NamesList(expression.Name("SubID"), expression.Name("Topics"), expression.Name("QueueURL"), expression.Name("PositionX"), expression.Name("PositionY"))
-	expr, err := expression.NewBuilder().WithFilter(filter).WithProjection(projection).Build()
-	if err != nil {
-		common.Fatal("[BROKER] Errore nella costruzione della query. " + err.Error())
-	}
+	//Filtro per selezionare i subscriber interessati, secondo il tipo del messaggio
+	filter, rule := routingFilter(conf, message)
 
 	//Esecuzione della query con il filtro
-	subsID, queueUrl, err := getFilteredSubscribers(expr)
+	subsID, queueUrl, err := getFilteredSubscribers(filter)
 	if err != nil {
-		common.Warning("[BROKER] Errore nell'esecuzione della query a DynamoDB. " + err.Error())
-		return err
+		common.Warning("[BROKER] Errore nell'esecuzione della query sui subscribers. " + err.Error())
+		return message, nil, err
 	}
 
-	//invio del messaggio a tutti i subscriber interessati
-	for _, url := range queueUrl {
-		err = sendQueueMessage(message, url)
-		if err != nil {
-			common.Fatal("[BROKER] Errore nell'invio del messaggio. " + err.Error())
-
-		}
+	positionDescription := "(" + strconv.Itoa(message.PositionX) + ", " + strconv.Itoa(message.PositionY) + ") : "
+	if filter.Geo {
+		positionDescription = "(lat " + strconv.FormatFloat(filter.Latitude, 'f', -1, 64) + ", lon " + strconv.FormatFloat(filter.Longitude, 'f', -1, 64) + ") : " +
+			strconv.FormatFloat(filter.RadiusMeters, 'f', -1, 64) + "m"
+	} else if filter.Spatial {
+		positionDescription += strconv.Itoa(filter.Radius)
+	} else {
+		positionDescription += "tutti"
 	}
 
 	common.Info("[BROKER] Messaggio Ricevuto:\n" +
-		"\t[Struttura: " + id + "; Metri quadri: " + strconv.Itoa(mq) + "]: \"" + *message.Body + "\"\n" +
+		"\t[Struttura: " + id + "; Metri quadri: " + strconv.Itoa(mq) + "]: \"" + message.Text + "\"\n" +
 		"\t | Numero persone: " + strconv.Itoa(peopleNum) + " (Positivi: " + strconv.Itoa(positive) + ") \n" +
-		"\t | Topic \"" + topic + "\"\n" +
-		"\t | Posizione : Raggio (" + strconv.Itoa(positionX) + ", " + strconv.Itoa(positionY) + ") : " + strconv.Itoa(radius) + "\n" +
+		"\t | Tipo " + message.Type + ", Topic \"" + topic + "\"\n" +
+		"\t | Posizione : Raggio " + positionDescription + "\n" +
 		"\t | Inoltrato ai subscriber:\n\t |\t | " + common.ConcatenateArrayValues(subsID,"\n\t |\t | ") + "\n" +
 		"\t +-----------------------------------------------------------------------------\n")
 
 	sendLogMessage("Messaggio Ricevuto:\n" +
-		"\t[Struttura: " + id + "; Metri quadri: " + strconv.Itoa(mq) + "]: \"" + *message.Body + "\"\n" +
+		"\t[Struttura: " + id + "; Metri quadri: " + strconv.Itoa(mq) + "]: \"" + message.Text + "\"\n" +
 		"\t | Numero persone: " + strconv.Itoa(peopleNum) + " (Positivi: " + strconv.Itoa(positive) + ") \n" +
-		"\t | Topic \"" + topic + "\"\n" +
-		"\t | Posizione : Raggio (" + strconv.Itoa(positionX) + ", " + strconv.Itoa(positionY) + ") : " + strconv.Itoa(radius) + "\n" +
+		"\t | Tipo " + message.Type + ", Topic \"" + topic + "\"\n" +
+		"\t | Posizione : Raggio " + positionDescription + "\n" +
 		"\t | Inoltrato ai subscriber:\n\t |\t | " + common.ConcatenateArrayValues(subsID,"\n\t |\t | ") + "\n" +
 		"\t +-----------------------------------------------------------------------------\n")
 
 	//Notifica di emergenza nel caso è presente una concetrazione di persone al metro quadro superiore al valore previsto
-	if (float64(peopleNum) / float64(mq)) >= mq_threshold {
+	if rule.CheckDensity && (float64(peopleNum) / float64(mq)) >= conf.MqThreshold {
 		sendLogMessage("[ALERT!] Nella struttura " + id + " è stato riscontrata una concentrazione di persone al metro quadro superiore al limite consentito" +
-			"\n\t | " + id + ": " + strconv.FormatFloat(float64(peopleNum) / float64(mq), 'f', -1, 64) + " persone/mq, Limite consentito: " + strconv.FormatFloat(mq_threshold, 'f', -1, 64) + " persone/mq\n" +
+			"\n\t | " + id + ": " + strconv.FormatFloat(float64(peopleNum) / float64(mq), 'f', -1, 64) + " persone/mq, Limite consentito: " + strconv.FormatFloat(conf.MqThreshold, 'f', -1, 64) + " persone/mq\n" +
 			"\t +-----------------------------------------------------------------------------\n")
 		common.Info("[BROKER] [ALERT!] Nella struttura " + id + " è stato riscontrata una concentrazione di persone al metro quadro superiore al limite consentito" +
-			"\n\t | " + id + ": " + strconv.FormatFloat(float64(peopleNum) / float64(mq), 'f', -1, 64) + " persone/mq, Limite consentito: " + strconv.FormatFloat(mq_threshold, 'f', -1, 64) + " persone/mq\n" +
+			"\n\t | " + id + ": " + strconv.FormatFloat(float64(peopleNum) / float64(mq), 'f', -1, 64) + " persone/mq, Limite consentito: " + strconv.FormatFloat(conf.MqThreshold, 'f', -1, 64) + " persone/mq\n" +
 			"\t +-----------------------------------------------------------------------------\n")
 
 	}
@@ -195,7 +251,7 @@ func sendMessage(message sqs.Message) (retErr error) {
 		common.Info("[BROKER] [ALERT!] Nella struttura " + id + " è stato riscontrato un numero di " + strconv.Itoa(positive) + " persone positive.\n")
 	}
 
-	return nil
+	return message, queueUrl, nil
 
 }
 
@@ -205,23 +261,5 @@ func sendLogMessage(message string) {
 
 	prefix := "[BROKER] "
 
-	err := common.SendMessage(common.RemoteLogConnection, prefix + message + "\n")
-	if err != nil {
-		common.Warning("Errore nel logging remoto")
-		
-		//Istanzio la connessione con il remote logger
-		common.RemoteLogConnection, err = net.Dial("tcp", common.Config.LoggerHost)
-		if err != nil {
-			fmt.Println("Errore in dial: " + err.Error())
-		}
-		err = common.SendMessage(common.RemoteLogConnection, "d\n")
-		if err != nil {
-			fmt.Println("Errore nell'inizializzazione della connessione: " + err.Error())
-		}
-
-
-	common.SendMessage(common.RemoteLogConnection, prefix + message + "\n")
-
-	}
-
+	common.SendRemoteLog(prefix + message + "\n")
 }
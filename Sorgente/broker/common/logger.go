@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,7 +20,9 @@ import (
 
 
 var initializedLog = false 			//Variabile per memorizzare se il log è gia stato inizializzato
-var RemoteLogConnection net.Conn	//Connessione con il logger remoto
+var RemoteLogConnection net.Conn	//Connessione con il logger remoto (protetta da remoteLogMutex)
+var remoteLogMutex sync.Mutex		//Serializza invii e riconnessioni al logger remoto tra le goroutine
+var logFile *os.File				//File di log
 
 // Inizializza il Log
 func initializeLog() (retErr error) {
@@ -32,7 +35,7 @@ func initializeLog() (retErr error) {
 	var err error
 
 	//Istanzio la connessione con il remote logger
-	RemoteLogConnection, err = net.Dial("tcp", Config.LoggerHost)
+	RemoteLogConnection, err = DialLogger()
 	if err != nil {
 		fmt.Println("Errore in dial: " + err.Error())
 	}
@@ -63,10 +66,58 @@ func initializeLog() (retErr error) {
 	}
 
 	log.SetOutput(file)
+	logFile = file
 
 	return nil
 }
 
+//Invia un messaggio al logger remoto, riaprendo la connessione se l'invio fallisce. Può essere chiamata
+//contemporaneamente da più goroutine
+func SendRemoteLog(message string) {
+
+	remoteLogMutex.Lock()
+	defer remoteLogMutex.Unlock()
+
+	err := SendMessage(RemoteLogConnection, message)
+	if err == nil {
+		return
+	}
+	Warning("Errore nel logging remoto")
+
+	//Istanzio di nuovo la connessione con il remote logger
+	if RemoteLogConnection != nil {
+		_ = RemoteLogConnection.Close()
+	}
+	RemoteLogConnection, err = DialLogger()
+	if err != nil {
+		fmt.Println("Errore in dial: " + err.Error())
+	}
+	err = SendMessage(RemoteLogConnection, "d\n")
+	if err != nil {
+		fmt.Println("Errore nell'inizializzazione della connessione: " + err.Error())
+	}
+
+	_ = SendMessage(RemoteLogConnection, message)
+}
+
+//Chiude la connessione con il logger remoto e il file di log (chiamata alla terminazione dell'applicativo)
+func CloseLog() {
+
+	remoteLogMutex.Lock()
+	defer remoteLogMutex.Unlock()
+
+	if RemoteLogConnection != nil {
+		_ = RemoteLogConnection.Close()
+		RemoteLogConnection = nil
+	}
+
+	if logFile != nil {
+		log.SetOutput(os.Stderr)
+		_ = logFile.Close()
+		logFile = nil
+	}
+}
+
 //Scrive sul log Info generali
 func Info(message string) {
 	log.Println("[INFO] " + message)
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+//I messaggi non eliminati entro il visibility timeout tornano visibili nella loro posizione originale
+func TestMemoryTransportRestoresExpiredInOrder(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		sent     []string
+		received int
+		deleted  []string //Messaggi eliminati dopo la ricezione (gli altri scadono)
+		want     []string
+	}{
+		{"all expired", []string{"a", "b", "c", "d", "e"}, 4, nil, []string{"a", "b", "c", "d", "e"}},
+		{"some deleted", []string{"a", "b", "c", "d", "e"}, 4, []string{"b"}, []string{"a", "c", "d", "e"}},
+		{"nothing left behind", []string{"a", "b", "c"}, 3, []string{"a", "c"}, []string{"b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			transport := NewMemoryTransport()
+			queueUrl, _ := transport.CreateQueue("test")
+
+			for _, body := range test.sent {
+				if err := transport.SendMessage(queueUrl, QueueMessage{Body: body}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			received, err := transport.ReceiveMessages(queueUrl, int64(test.received), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range received {
+				for _, deleted := range test.deleted {
+					if message.Body == deleted {
+						if err := transport.DeleteMessage(queueUrl, message.ReceiptHandle); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+
+			//Scadenza immediata del visibility timeout dei messaggi rimasti in volo
+			queue := transport.queues[queueUrl]
+			for handle, pending := range queue.inFlight {
+				pending.deadline = time.Now().Add(-time.Second)
+				queue.inFlight[handle] = pending
+			}
+
+			received, err = transport.ReceiveMessages(queueUrl, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, message := range received {
+				got = append(got, message.Body)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
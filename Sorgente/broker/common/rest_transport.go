@@ -0,0 +1,103 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+			rest_transport.go
+
+	Implementazione di Transport usata da publisher e subscriber in modalità locale: le code vengono gestite
+		dal broker (in memoria) e raggiunte attraverso la sua API REST:
+		 - POST   /queue/{queue}/message            invio di un messaggio
+		 - GET    /queue/{queue}/message?max=&wait= ricezione con long polling
+		 - DELETE /queue/{queue}/message/{receipt}  conferma (eliminazione) di un messaggio ricevuto
+	La creazione e l'eliminazione delle code sono compito esclusivo del broker.
+
+*/
+
+type RestTransport struct{}
+
+//Risorsa REST della coda sul broker
+func queueResource(queueUrl string) string {
+	return Config.AwsBroker + "/queue/" + url.PathEscape(queueUrl) + "/message"
+}
+
+//Le code vengono create solo dal broker
+func (transport *RestTransport) CreateQueue(name string) (queueUrl string, retErr error) {
+	return "", errors.New("queues can only be created by the broker")
+}
+
+//Le code vengono eliminate solo dal broker
+func (transport *RestTransport) DeleteQueue(queueUrl string) (retErr error) {
+	return errors.New("queues can only be deleted by the broker")
+}
+
+//Le code vengono elencate solo dal broker
+func (transport *RestTransport) ListQueues(prefix string) (queueUrls []string, retErr error) {
+	return nil, errors.New("queues can only be listed by the broker")
+}
+
+//Le code vengono ispezionate solo dal broker
+func (transport *RestTransport) QueueCreatedAt(queueUrl string) (createdAt time.Time, retErr error) {
+	return time.Time{}, errors.New("queues can only be inspected by the broker")
+}
+
+//Invia un messaggio alla coda del broker
+func (transport *RestTransport) SendMessage(queueUrl string, message QueueMessage) (retErr error) {
+
+	statusCode, _, err := PostRequest(queueResource(queueUrl), message, nil)
+	if err != nil {
+		return err
+	}
+
+	return checkStatusCode(statusCode)
+}
+
+//Invia un gruppo di messaggi alla coda del broker (un messaggio per richiesta)
+func (transport *RestTransport) SendMessageBatch(queueUrl string, messages []QueueMessage) (failed []int, retErr error) {
+	return sendMessagesOneByOne(transport, queueUrl, messages)
+}
+
+//Riceve i messaggi dalla coda del broker con long polling
+func (transport *RestTransport) ReceiveMessages(queueUrl string, maxMessages int64, waitSeconds int64) (messages []QueueMessage, retErr error) {
+
+	resource := queueResource(queueUrl) + "?max=" + strconv.FormatInt(maxMessages, 10) + "&wait=" + strconv.FormatInt(waitSeconds, 10)
+
+	statusCode, _, err := GetRequest(resource, &messages)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkStatusCode(statusCode)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+//Elimina un messaggio ricevuto dalla coda del broker
+func (transport *RestTransport) DeleteMessage(queueUrl string, receiptHandle string) (retErr error) {
+
+	statusCode, _, err := DeleteRequest(queueResource(queueUrl)+"/"+url.PathEscape(receiptHandle), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return checkStatusCode(statusCode)
+}
+
+//Ritorna un errore se la risposta del broker non è andata a buon fine
+func checkStatusCode(statusCode int) (retErr error) {
+
+	if statusCode < http.StatusOK || statusCode >= http.StatusMultipleChoices {
+		return errors.New("broker replied with status " + strconv.Itoa(statusCode))
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+			shutdown.go
+
+	Questo modulo gestisce la terminazione controllata dell'applicativo. Alla ricezione di SIGINT o SIGTERM viene
+		annullato il contesto restituito da ShutdownContext: le goroutine che lo ricevono smettono di accettare nuovo
+		lavoro, completano quello in corso (ad esempio i messaggi già ricevuti) e terminano. Un secondo segnale
+		termina immediatamente il processo.
+
+*/
+
+const ShutdownTimeout = 10 * time.Second //Tempo massimo di attesa per il completamento delle operazioni in corso
+
+//Ritorna un contesto annullato alla ricezione di SIGINT o SIGTERM (o chiamando cancel)
+func ShutdownContext() (ctx context.Context, cancel context.CancelFunc) {
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			Info("Ricevuto il segnale " + sig.String() + ", terminazione in corso")
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(signals)
+			return
+		}
+
+		//Al secondo segnale la terminazione è immediata
+		sig := <-signals
+		Warning("Ricevuto il segnale " + sig.String() + ", terminazione immediata")
+		os.Exit(1)
+	}()
+
+	return ctx, cancel
+}
+
+//Attende per la durata data, ritornando false se nel frattempo il contesto viene annullato
+func SleepContext(ctx context.Context, duration time.Duration) bool {
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//Attende il termine delle goroutine del gruppo per al massimo timeout, ritornando false se non sono terminate
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
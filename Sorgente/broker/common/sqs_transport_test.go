@@ -0,0 +1,63 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+//I messaggi senza posizione geografica restano entro il limite di attributi di SQS e non vengono impacchettati;
+//negli altri gli attributi della versione 0 restano comunque separati
+func TestSqsAttributesLayout(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(message *Message)
+		packed []string //Attributi attesi in PackedAttributes
+	}{
+		{"plain message", func(message *Message) {}, nil},
+		{"without message ID", func(message *Message) { message.MessageID = "" }, nil},
+		{"geo position", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5, RadiusMeters: 500} },
+			[]string{"Latitude", "Longitude", "MessageID", "RadiusMeters", "Version"}},
+		{"geo without radius", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5} },
+			[]string{"Latitude", "Longitude", "MessageID", "Version"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			message := testMessage()
+			test.modify(&message)
+			encoded := message.Encode()
+
+			attributes, err := sqsAttributes(encoded.Attributes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(attributes) > sqsMaxAttributes {
+				t.Fatalf("%d attributes, SQS accepts at most %d", len(attributes), sqsMaxAttributes)
+			}
+
+			//Gli attributi letti dai subscriber e dai broker precedenti devono essere sempre presenti
+			for _, name := range legacyAttributes {
+				if attributes[name] == nil || *attributes[name].StringValue != encoded.Attributes[name] {
+					t.Fatalf("legacy attribute %s missing or packed", name)
+				}
+			}
+
+			packed := attributes[packedAttributesName]
+			if (packed != nil) != (test.packed != nil) {
+				t.Fatalf("packed attributes present = %v, want %v", packed != nil, test.packed != nil)
+			}
+			for _, name := range test.packed {
+				if attributes[name] != nil {
+					t.Fatalf("attribute %s should be packed", name)
+				}
+			}
+
+			//In ricezione gli attributi vengono ricostruiti uguali a quelli inviati
+			if received := messageAttributes(attributes); !reflect.DeepEqual(received, encoded.Attributes) {
+				t.Fatalf("received attributes %v, want %v", received, encoded.Attributes)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+/*
+			handle_dead_letter_request.go
+
+	API REST di amministrazione della coda dei messaggi non consegnati (vedere broker-dead-letter.go):
+	 - GET    /admin/dead-letter               lista dei messaggi non consegnati
+	 - GET    /admin/dead-letter/{id}          dettaglio di un messaggio
+	 - POST   /admin/dead-letter/{id}/redrive  reinvio di un messaggio sulla coda del broker
+	 - POST   /admin/dead-letter/redrive       reinvio di tutti i messaggi
+	 - DELETE /admin/dead-letter/{id}          eliminazione di un messaggio
+	 - DELETE /admin/dead-letter               eliminazione di tutti i messaggi
+
+*/
+
+//Risposta alle operazioni su tutti i messaggi non consegnati
+type DeadLetterBulkResponse struct {
+	Processed []string //Messaggi su cui l'operazione è andata a buon fine
+	Failed    []string //Messaggi su cui l'operazione non è andata a buon fine
+}
+
+//Registra le risorse REST della coda dei messaggi non consegnati
+func handleDeadLetterRequests(router *mux.Router) {
+	router.HandleFunc("/admin/dead-letter", handleDeadLetterList).Methods("GET")
+	router.HandleFunc("/admin/dead-letter", handleDeadLetterPurge).Methods("DELETE")
+	router.HandleFunc("/admin/dead-letter/redrive", handleDeadLetterRedriveAll).Methods("POST")
+	router.HandleFunc("/admin/dead-letter/{id}", handleDeadLetterGet).Methods("GET")
+	router.HandleFunc("/admin/dead-letter/{id}", handleDeadLetterRemove).Methods("DELETE")
+	router.HandleFunc("/admin/dead-letter/{id}/redrive", handleDeadLetterRedrive).Methods("POST")
+}
+
+//Lista dei messaggi non consegnati
+func handleDeadLetterList(w http.ResponseWriter, r *http.Request) {
+
+	common.Info("[BROKER] Comando fetch dei messaggi non consegnati")
+
+	letters, err := deadLetterStore.GetDeadLetters()
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'ottenimento dei messaggi non consegnati. " + err.Error())
+		http.Error(w, "Error in fetching dead letters.\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+
+	writeJSONResponse(w, letters)
+}
+
+//Dettaglio di un messaggio non consegnato
+func handleDeadLetterGet(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+
+	letter, err := deadLetterStore.GetDeadLetter(id)
+	if err != nil {
+		writeDeadLetterError(w, id, err)
+		return
+	}
+
+	writeJSONResponse(w, letter)
+}
+
+//Reinvio di un messaggio non consegnato
+func handleDeadLetterRedrive(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+
+	common.Info("[BROKER] Comando di reinvio del messaggio non consegnato " + id)
+
+	err := redriveDeadLetter(id)
+	if err != nil {
+		writeDeadLetterError(w, id, err)
+		return
+	}
+}
+
+//Reinvio di tutti i messaggi non consegnati
+func handleDeadLetterRedriveAll(w http.ResponseWriter, r *http.Request) {
+
+	common.Info("[BROKER] Comando di reinvio di tutti i messaggi non consegnati")
+
+	applyToAllDeadLetters(w, redriveDeadLetter)
+}
+
+//Eliminazione di un messaggio non consegnato
+func handleDeadLetterRemove(w http.ResponseWriter, r *http.Request) {
+
+	id := mux.Vars(r)["id"]
+
+	common.Info("[BROKER] Comando di eliminazione del messaggio non consegnato " + id)
+
+	err := deadLetterStore.RemoveDeadLetter(id)
+	if err != nil {
+		writeDeadLetterError(w, id, err)
+		return
+	}
+}
+
+//Eliminazione di tutti i messaggi non consegnati
+func handleDeadLetterPurge(w http.ResponseWriter, r *http.Request) {
+
+	common.Info("[BROKER] Comando di eliminazione di tutti i messaggi non consegnati")
+
+	applyToAllDeadLetters(w, deadLetterStore.RemoveDeadLetter)
+}
+
+//Applica un'operazione a tutti i messaggi non consegnati, riportando l'esito per ogni messaggio
+func applyToAllDeadLetters(w http.ResponseWriter, operation func(letterID string) error) {
+
+	letters, err := deadLetterStore.GetDeadLetters()
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'ottenimento dei messaggi non consegnati. " + err.Error())
+		http.Error(w, "Error in fetching dead letters.\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := DeadLetterBulkResponse{Processed: []string{}, Failed: []string{}}
+
+	for _, letter := range letters {
+		if operation(letter.LetterID) != nil {
+			response.Failed = append(response.Failed, letter.LetterID)
+		} else {
+			response.Processed = append(response.Processed, letter.LetterID)
+		}
+	}
+
+	common.Info("[BROKER] Operazione completata su " + strconv.Itoa(len(response.Processed)) + " messaggi non consegnati (" + strconv.Itoa(len(response.Failed)) + " errori)")
+
+	writeJSONResponse(w, response)
+}
+
+//Risposta di errore per un'operazione su un messaggio non consegnato
+func writeDeadLetterError(w http.ResponseWriter, id string, err error) {
+
+	if err == errDeadLetterNotFound {
+		http.Error(w, "Dead letter "+id+" not found.", http.StatusNotFound)
+		return
+	}
+
+	common.Warning("[BROKER] Errore nell'operazione sul messaggio non consegnato " + id + ". " + err.Error())
+	http.Error(w, "Error in dead letter operation.\n"+err.Error(), http.StatusInternalServerError)
+}
+
+//Scrive una risposta in formato JSON
+func writeJSONResponse(w http.ResponseWriter, response interface{}) {
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel marshalling della risposta. " + err.Error())
+		http.Error(w, "Error in response marshalling.\n"+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+/*
+			handle_queue_request.go
+
+	In modalità locale il broker gestisce le code in memoria e le espone a publisher e subscriber attraverso
+		l'API REST (vedere common/rest_transport.go).
+
+*/
+
+const maxQueueWaitTime = 20 //Tempo massimo di long polling (lo stesso limite di SQS)
+
+//Registra le risorse REST delle code
+func handleQueueRequests(router *mux.Router) {
+	router.HandleFunc("/queue/{queue}/message", handleQueueSend).Methods("POST")
+	router.HandleFunc("/queue/{queue}/message", handleQueueReceive).Methods("GET")
+	router.HandleFunc("/queue/{queue}/message/{receipt}", handleQueueDelete).Methods("DELETE")
+}
+
+//Invio di un messaggio ad una coda
+func handleQueueSend(w http.ResponseWriter, r *http.Request) {
+
+	queue := mux.Vars(r)["queue"]
+
+	message := common.QueueMessage{}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	if err != nil {
+		common.Warning("[BROKER] Errore nel unmarshalling del messaggio. " + err.Error())
+		http.Error(w, "Error in request marshalling.\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = common.MessageTransport.SendMessage(queue, message)
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'invio del messaggio alla coda " + queue + ". " + err.Error())
+		http.Error(w, "Error sending message.\n"+err.Error(), http.StatusNotFound)
+		return
+	}
+}
+
+//Ricezione dei messaggi da una coda con long polling
+func handleQueueReceive(w http.ResponseWriter, r *http.Request) {
+
+	queue := mux.Vars(r)["queue"]
+
+	maxMessages, err := strconv.ParseInt(r.URL.Query().Get("max"), 10, 64)
+	if err != nil || maxMessages <= 0 {
+		maxMessages = 1
+	}
+	wait, err := strconv.ParseInt(r.URL.Query().Get("wait"), 10, 64)
+	if err != nil || wait < 0 {
+		wait = 0
+	}
+	if wait > maxQueueWaitTime {
+		wait = maxQueueWaitTime
+	}
+
+	messages, err := common.MessageTransport.ReceiveMessages(queue, maxMessages, wait)
+	if err != nil {
+		common.Warning("[BROKER] Errore nella ricezione dalla coda " + queue + ". " + err.Error())
+		http.Error(w, "Error receiving messages.\n"+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if messages == nil {
+		messages = []common.QueueMessage{}
+	}
+
+	err = json.NewEncoder(w).Encode(messages)
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel marshalling dei messaggi. " + err.Error())
+		http.Error(w, "Error in response marshalling.\n"+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//Eliminazione di un messaggio ricevuto
+func handleQueueDelete(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+
+	err := common.MessageTransport.DeleteMessage(vars["queue"], vars["receipt"])
+	if err != nil {
+		common.Warning("[BROKER] Errore nell'eliminazione del messaggio dalla coda " + vars["queue"] + ". " + err.Error())
+		http.Error(w, "Error deleting message.\n"+err.Error(), http.StatusNotFound)
+		return
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"common"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+/*
+			handle_reconcile_request.go
+
+	API REST di amministrazione della riconciliazione tra subscriber e code (vedere broker-reconcile.go):
+	 - POST /admin/reconcile               segnalazione delle incongruenze (dryRun=true, default)
+	 - POST /admin/reconcile?dryRun=false  segnalazione e correzione delle incongruenze
+
+*/
+
+//Registra le risorse REST della riconciliazione
+func handleReconcileRequests(router *mux.Router) {
+	router.HandleFunc("/admin/reconcile", handleReconcile).Methods("POST")
+}
+
+//Esegue una riconciliazione e ne ritorna l'esito
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+
+	dryRun := true
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid dryRun value.", http.StatusBadRequest)
+			return
+		}
+		dryRun = parsed
+	}
+
+	common.Info("[BROKER] Comando di riconciliazione tra subscriber e code (dryRun " + strconv.FormatBool(dryRun) + ")")
+
+	report, err := runReconciliation(dryRun)
+	if err != nil {
+		http.Error(w, "Error in reconciling subscribers and queues.\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, report)
+}
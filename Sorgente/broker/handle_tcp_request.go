@@ -2,12 +2,14 @@ package main
 
 import (
 	"common"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,39 +22,111 @@ import (
 
 */
 
+const defaultSubscriberPageSize = 100  //Dimensione di default di una pagina di subscribers
+const maxSubscriberPageSize = 1000    //Dimensione massima di una pagina di subscribers
 
 
-
-// Funzione che inizializza il server htttp e imposta il comportamendo da esegure per ogni tipo di richiesta da fare
-func handleRequests(){
+// Funzione che inizializza il server htttp e imposta il comportamendo da esegure per ogni tipo di richiesta da fare.
+//Il server viene chiuso all'annullamento del contesto
+func handleRequests(ctx context.Context){
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/", checkVital)
 	router.HandleFunc("/configuration", getConfiguration).Methods("GET")
 	router.HandleFunc("/configuration", updateConfiguration).Methods("POST")
 	router.HandleFunc("/configuration", modifyConfiguration).Methods("PUT")
+	router.HandleFunc("/configuration/schema", getConfigurationSchema).Methods("GET")
+	router.HandleFunc("/configuration/{name}/history", getConfigurationHistory).Methods("GET")
+	router.HandleFunc("/configuration/{name}/rollback", rollbackConfiguration).Methods("POST")
 	router.HandleFunc("/subscriber", getSubscriber).Methods("GET")
 	router.HandleFunc("/subscriber", handleSubscriberRegistration).Methods("PUT")
 	router.HandleFunc("/publisher", handlePublisher).Methods("GET")
+	router.HandleFunc("/stats", getStats).Methods("GET")
 	router.HandleFunc("/subscriber/{id}/position", handlePositionUpdate).Methods("POST")
 	router.HandleFunc("/subscriber/{id}/topic", handleTopicSubscribe).Methods("PUT")
 	router.HandleFunc("/subscriber/{id}/topic", handleTopicUnsubscribe).Methods("DELETE")
 	router.HandleFunc("/subscriber/{id}", handleSubscriberRemoval).Methods("DELETE")
+	router.HandleFunc("/subscriber/{id}/resume", handleSubscriberResume).Methods("POST")
+	router.HandleFunc("/subscriber/{id}/heartbeat", handleSubscriberHeartbeat).Methods("POST")
+
+	//Amministrazione dei messaggi non consegnati
+	handleDeadLetterRequests(router)
+
+	//Riconciliazione tra subscriber e code
+	handleReconcileRequests(router)
+
+	//In modalità locale il broker espone anche le proprie code
+	if common.Config.Mode == "local" {
+		handleQueueRequests(router)
+	}
 
-	//Abilita il Cross origin request
+	//Autenticazione e autorizzazione delle richieste (vedere broker-auth.go)
+	router.Use(authMiddleware)
+	if !authEnabled() {
+		common.Warning("[BROKER] AuthSecret non impostato: l'API REST non richiede autenticazione")
+	}
+
+	//Abilita il Cross origin request dalle origini configurate. Le credenziali viaggiano nell'header Authorization
+	//(e non in cookie), per cui le richieste cross-origin non hanno bisogno di AllowCredentials
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowCredentials: true,
+		AllowedOrigins: allowedOrigins(),
 		AllowedMethods: []string{"GET", "PUT", "POST", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", configActorHeader},
 	})
 
 	handler := c.Handler(router)
-	//Ascolto sulla porta 80
-	err := http.ListenAndServe(":80", handler)
+	server := &http.Server{Addr: common.Config.ListenAddress, Handler: handler}
+
+	//Con TLSCertFile l'API REST viene esposta su HTTPS (vedere common/tls.go)
+	tlsConfig, err := common.ServerTLSConfig()
 	if err != nil {
+		common.Fatal("[BROKER] Errore nella lettura dei certificati TLS dell'API REST. " + err.Error())
+		return
+	}
+	server.TLSConfig = tlsConfig
+
+	//Alla terminazione il server smette di accettare connessioni e completa le richieste in corso
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), common.ShutdownTimeout)
+		defer cancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			common.Warning("[BROKER] Errore nella chiusura dell'API REST. " + err.Error())
+		}
+	}()
+
+	//Ascolto sull'indirizzo configurato (di default la porta 80, o la 443 con TLS)
+	if tlsConfig != nil {
+		common.Info("[BROKER] API REST in ascolto su HTTPS (" + common.Config.ListenAddress + ")")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		common.Fatal("[BROKER] Errore nell'inizializzazione dell'API REST")
 	}
 
+	common.Info("[BROKER] API REST terminata")
+}
+
+//Origini ammesse per le richieste cross-origin (AllowedOrigins della configurazione locale, separate da virgole)
+func allowedOrigins() []string {
+
+	var origins []string
+	for _, origin := range strings.Split(common.Config.AllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	if len(origins) == 0 {
+		return []string{"*"}
+	}
+
+	return origins
 }
 
 //Funzione per rispondere ad una richiesta GET per il check alive
@@ -71,6 +145,13 @@ func getSubscriber(w http.ResponseWriter, r *http.Request){
 
 	common.Info("[BROKER] Comando fetch dei subscribers.")
 
+	//Se vengono specificati "limit" o "next" viene ritornata una singola pagina
+	query := r.URL.Query()
+	if query.Get("limit") != "" || query.Get("next") != "" {
+		getSubscriberPage(w, r)
+		return
+	}
+
 	subs, err := getSubscribers()
 	if err != nil {
 		common.Fatal("[BROKER] Errore nell'ottenimento dei subscribers' " + err.Error())
@@ -88,6 +169,40 @@ func getSubscriber(w http.ResponseWriter, r *http.Request){
 
 }
 
+//Ottieni una pagina della lista dei subscribers
+func getSubscriberPage(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+
+	limit := int64(defaultSubscriberPageSize)
+	if query.Get("limit") != "" {
+		parsedLimit, err := strconv.ParseInt(query.Get("limit"), 10, 64)
+		if err != nil || parsedLimit <= 0 || parsedLimit > maxSubscriberPageSize {
+			http.Error(w, "Invalid limit, must be between 1 and "+strconv.Itoa(maxSubscriberPageSize)+".", http.StatusBadRequest)
+			return
+		}
+		limit = parsedLimit
+	}
+
+	subs, nextToken, err := listSubscribers(limit, query.Get("next"))
+	if err != nil {
+		http.Error(w, "Error in fetching subscribers.\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//Lista vuota invece di null
+	if subs == nil {
+		subs = []common.SubscriberEntry{}
+	}
+
+	err = json.NewEncoder(w).Encode(common.SubscriberPage{Subscribers: subs, NextToken: nextToken})
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel marshalling dei subscribers. " + err.Error())
+		http.Error(w, "Error in response marshalling.\n"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 //Ottieni lista configurazione
 func getConfiguration(w http.ResponseWriter, r *http.Request){
 
@@ -111,6 +226,70 @@ func getConfiguration(w http.ResponseWriter, r *http.Request){
 }
 
 
+//Ottieni lo schema dei parametri di configurazione
+func getConfigurationSchema(w http.ResponseWriter, r *http.Request){
+
+	common.Info("[BROKER] Comando fetch dello schema della configurazione")
+
+	writeJSONResponse(w, configSchema)
+}
+
+
+//Ottieni lo storico delle modifiche di un parametro di configurazione
+func getConfigurationHistory(w http.ResponseWriter, r *http.Request){
+
+	name := mux.Vars(r)["name"]
+
+	common.Info("[BROKER] Comando fetch dello storico del parametro " + name)
+
+	changes, err := configurationHistory(name)
+	if err != nil {
+		http.Error(w, "Error in fetching configuration history.\n" + err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+
+	writeJSONResponse(w, changes)
+}
+
+
+//Ripristina un parametro di configurazione ad una versione precedente
+func rollbackConfiguration(w http.ResponseWriter, r *http.Request){
+
+	name := mux.Vars(r)["name"]
+
+	request := struct{ Version int }{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		common.Warning("[BROKER] Errore nel unmarshalling della richiesta. " + err.Error())
+		http.Error(w, "Error in request marshalling.\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	common.Info("[BROKER] Comando ripristino del parametro " + name + " alla versione " + strconv.Itoa(request.Version))
+
+	change, err := rollbackConfigurationParameter(name, request.Version, configActor(r))
+	if err == errConfigVersionNotFound {
+		http.Error(w, "Version " + strconv.Itoa(request.Version) + " of " + name + " not found.", http.StatusNotFound)
+		return
+	}
+	if _, invalid := err.(*configValidationError); invalid {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		common.Warning("[BROKER] Errore nel ripristino del parametro " + name + ". " + err.Error())
+		http.Error(w, "Error in configuration rollback.\n" + err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, change)
+}
+
+
 //Forza l'aggiornamento della configurazione del broker
 func updateConfiguration(w http.ResponseWriter, r *http.Request){
 
@@ -137,7 +316,15 @@ func modifyConfiguration(w http.ResponseWriter, r *http.Request){
 
 	common.Info("[BROKER] Comando modifica dei parametri di configurazione: " + configModify.FieldName + " = " + configModify.FieldValue)
 
-	err = updateConfigurationParameter(configModify.FieldName, configModify.FieldValue)
+	//Il valore viene verificato prima di essere scritto sulla tabella
+	err = validateConfigEntry(configModify)
+	if err != nil {
+		common.Warning("[BROKER] Parametro di configurazione non valido. " + err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = updateConfigurationParameter(configModify.FieldName, configModify.FieldValue, configActor(r))
 	if err != nil {
 		common.Fatal("[BROKER] Errore nell'aggiornamento del parametro di configurazione. " + err.Error())
 		http.Error(w, "Error in modifying a config value.\n"+err.Error(), http.StatusInternalServerError)
@@ -168,7 +355,7 @@ func handleSubscriberRegistration(w http.ResponseWriter, r *http.Request) {
 
 	common.Info("[BROKER] Registrazione del subscriber " + subID + " avvenuta con successo. Invio dei parametri.")
 
-	err = json.NewEncoder(w).Encode(common.SubRegistrationResponse{SubID: subID, QueueURL: queueUrl})
+	err = json.NewEncoder(w).Encode(common.SubRegistrationResponse{SubID: subID, QueueURL: queueUrl, Token: subscriberToken(subID)})
 	if err != nil {
 		common.Fatal("[BROKER] Errore nel marshalling della risposta al subscriber. ( " + subID + ", " + queueUrl + "). " + err.Error())
 		http.Error(w, "Error in response marshalling.\n" + err.Error(), http.StatusInternalServerError)
@@ -182,63 +369,126 @@ func registerSubscriber() (ID string, queueURL string, retErr error) {
 
 	//Registro il nuovo subscriber
 
-	var queueUrl = ""
-	var subID = "0"
-	id, _ := strconv.Atoi(subID)
-
-	subsID, err := getSubscribersID()
-	if err != nil {
-		common.Fatal("[BROKER] Errore nell'ottenimento della lista di subscribers")
-		return "", "", err
-	}
-
 	//Dopo 3 tentativi la richiesta di generare un subscriber fallisce
 	retry := 3
 	for {
 
-		subID, err = common.GenerateSubID(subsID, id)
+		//ID casuale: non è necessario conoscere quelli già assegnati
+		subID, err := newSubscriberID()
 		if err != nil {
-			common.Fatal("[BROKER] Impossibile trovare ID valido per subscriber")
+			common.Fatal("[BROKER] Impossibile generare un ID per il subscriber. " + err.Error())
 			return "", "", err
 		}
 
 		//Creazione di coda SQS
-
-		queueUrl, err = createQueue(subID)
+		queueUrl, err := createQueue(subscriberQueueName(subID))
 		if err != nil {
 			common.Fatal("[BROKER] Errore nella creazione della coda della entry al DB\n" + err.Error())
 
 			retry --
 			if retry < 0 { return "", "", err}
 
-			id, _ = strconv.Atoi(subID)
-			id++
-
 			time.Sleep(time.Second)
+			continue
+		}
+
+		//Aggiunge la entry al DB
+		err, alreadyExisting := addEntryDB(subID, queueUrl)
+		if err == nil {
+			return subID, queueUrl, nil
+		}
+
+		common.Fatal("[BROKER] Errore nell'aggiunta del subscriber al DB\n" + err.Error())
+
+		//Un ID già esistente (estremamente improbabile) viene sostituito con uno nuovo; la coda appartiene al
+		//subscriber esistente e non va eliminata
+		if alreadyExisting {
+			retry --
+			if retry < 0 { return "", "", err}
+			continue
+		}
 
-		} else { break }
+		//Se c'è stato un errore nell'aggiunta della entry al db, elimina anche la coda per evitare che rimanga una coda senza subscriber annesso
+		if deleteQueue(queueUrl) != nil {
+			common.Fatal("[BROKER] Errore nell'eliminazione della coda\n" + err.Error())
+		}
+
+		return "", "", err
 	}
+}
+
 
 
-	//Aggiunge la entry al DB
-	err, alreadyExisting := addEntryDB(subID, queueUrl)
+//Funzione che gestisce la ripresa di un subscriber già registrato (ad esempio dopo un suo riavvio)
+func handleSubscriberResume(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	common.Info("[BROKER] Comando ripresa subscriber " + id)
+
+	queueUrl, err := resumeSubscriber(id)
+	if err == errSubscriberNotFound {
+		common.Warning("[BROKER] Il subscriber " + id + " non è registrato")
+		http.Error(w, "Subscriber not found.", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		common.Fatal("[BROKER] Errore nell'aggiunta del subscriber al DB\n" + err.Error())
+		common.Fatal("[BROKER] Errore nella ripresa del subscriber " + id + ". " + err.Error())
+		http.Error(w, "Error in resuming subscriber.\n" + err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Rimuovo la entry dal DB
-		if alreadyExisting == false {
+	err = json.NewEncoder(w).Encode(common.SubRegistrationResponse{SubID: id, QueueURL: queueUrl, Token: subscriberToken(id)})
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel marshalling della risposta al subscriber. ( " + id + ", " + queueUrl + "). " + err.Error())
+		http.Error(w, "Error in response marshalling.\n" + err.Error(), http.StatusInternalServerError)
+	}
+}
 
-			//Se c'è stato un errore nell'aggiunta della entry al db, elimina anche la coda per evitare che rimanga una coda senza subscriber annesso
-			if deleteQueue(queueUrl) != nil {
-				common.Fatal("[BROKER] Errore nell'eliminazione della coda\n" + err.Error())
-			}
-		}
+//Rinnova il lease (vedere broker-subscriber-lease.go) e il token di un subscriber
+func handleSubscriberHeartbeat(w http.ResponseWriter, r *http.Request) {
 
+	vars := mux.Vars(r)
+	id := vars["id"]
 
-		return "", "", err
+	err := touchSubscriber(id)
+	if err == errSubscriberNotFound {
+		common.Warning("[BROKER] Heartbeat dal subscriber " + id + " non registrato")
+		http.Error(w, "Subscriber not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error in renewing subscriber lease.\n" + err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	return subID, queueUrl, nil
+	//Ad ogni heartbeat viene rinnovato anche il token del subscriber
+	err = json.NewEncoder(w).Encode(common.SubHeartbeatResponse{Token: subscriberToken(id)})
+	if err != nil {
+		common.Fatal("[BROKER] Errore nel marshalling della risposta all'heartbeat del subscriber " + id + ". " + err.Error())
+		http.Error(w, "Error in response marshalling.\n" + err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//Verifica che il subscriber sia ancora registrato e ricrea la sua coda nel caso sia stata persa
+func resumeSubscriber(subID string) (queueURL string, retErr error) {
+
+	sub, err := subscriberStore.GetSubscriber(subID)
+	if err != nil {
+		return "", err
+	}
+
+	queueUrl, err := ensureSubscriberQueue(sub)
+	if err != nil {
+		return "", err
+	}
+
+	_ = touchSubscriber(subID)
+
+	common.Info("[BROKER] Ripresa del subscriber " + subID + " avvenuta con successo")
+
+	return queueUrl, nil
 }
 
 
@@ -248,7 +498,7 @@ func handlePublisher(w http.ResponseWriter, r *http.Request) {
 
 	common.Info("[BROKER] Comando registrazione publisher")
 
-	err := json.NewEncoder(w).Encode(common.PubRegistrationResponse{QueueURL: globalSqsQueue})
+	err := json.NewEncoder(w).Encode(common.PubRegistrationResponse{QueueURL: currentConfig().GlobalSqsQueue})
 	if err != nil {
 		common.Fatal("[BROKER] Errore nel marshalling della risposta al publisher. " + err.Error())
 		http.Error(w, "Error in response marshalling.\n" + err.Error(), http.StatusInternalServerError)
@@ -273,9 +523,13 @@ func handlePositionUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 
-	common.Info("[BROKER] Comando di position update del subscriber: " + id + " [ " + positionUpdate.PositionX + ", " + positionUpdate.PositionY + "]")
+	if positionUpdate.Latitude != "" || positionUpdate.Longitude != "" {
+		common.Info("[BROKER] Comando di position update del subscriber: " + id + " [ lat " + positionUpdate.Latitude + ", lon " + positionUpdate.Longitude + "]")
+	} else {
+		common.Info("[BROKER] Comando di position update del subscriber: " + id + " [ " + positionUpdate.PositionX + ", " + positionUpdate.PositionY + "]")
+	}
 
-	err = updatePosition(id, positionUpdate.PositionX, positionUpdate.PositionY)
+	err = updatePosition(id, positionUpdate)
 	if err != nil {
 		common.Fatal("[BROKER] Errore nell'aggiornamento della posizione per: " + id + ". " + err.Error())
 		http.Error(w, "Error in updating subscriber position.\n" + err.Error(), http.StatusInternalServerError)
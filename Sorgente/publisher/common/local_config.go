@@ -0,0 +1,237 @@
+package common
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+			local_config.go
+
+	Questo modulo completa la lettura della configurazione locale:
+	 - ogni campo di config.json può essere sovrascritto da una variabile d'ambiente DGDS_ seguita dal nome del
+	   campo in maiuscolo con le parole separate da "_" (ad esempio DGDS_AWS_BROKER, DGDS_POLLING_TIME o
+	   DGDS_DYNAMO_DB_ENDPOINT). In questo modo config.json è opzionale, ad esempio in un container
+	 - la configurazione ottenuta viene validata, riportando in un solo errore tutti i valori mancanti o non validi
+	 - le chiavi di autenticazione non vengono scritte nel log
+	 - la sessione con AWS usa il profilo di credenziali indicato (Profile) e gli eventuali endpoint di DynamoDB e
+	   SQS (ad esempio di un emulatore locale)
+
+*/
+
+const envPrefix = "DGDS_" //Prefisso delle variabili d'ambiente che sovrascrivono config.json
+const minAuthKeyLength = 16 //Lunghezza minima delle chiavi di autenticazione del broker
+
+//Nome della variabile d'ambiente che sovrascrive un campo di LocalConfig (LoggerHost -> DGDS_LOGGER_HOST)
+func envName(field string) string {
+
+	runes := []rune(field)
+	name := envPrefix
+
+	for i, r := range runes {
+		//Nuova parola: maiuscola dopo una minuscola, oppure ultima maiuscola di una sigla seguita da una minuscola
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			name += "_"
+		}
+		name += string(unicode.ToUpper(r))
+	}
+
+	return name
+}
+
+//Sovrascrive i campi della configurazione con le variabili d'ambiente, ritornando i valori non validi
+func applyEnvironmentOverrides(config *LocalConfig) (problems []string) {
+
+	value := reflect.ValueOf(config).Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+
+		field := value.Type().Field(i)
+		name := envName(field.Name)
+
+		env, found := os.LookupEnv(name)
+		if !found {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.Field(i).SetString(env)
+		case reflect.Int, reflect.Int64:
+			number, err := strconv.ParseInt(strings.TrimSpace(env), 10, 64)
+			if err != nil {
+				problems = append(problems, name+": must be an integer")
+				continue
+			}
+			value.Field(i).SetInt(number)
+		}
+
+		Info("Campo " + field.Name + " impostato dalla variabile d'ambiente " + name)
+	}
+
+	return problems
+}
+
+//Valida la configurazione locale, ritornando tutti i valori mancanti o non validi
+func validateLocalConfig(config LocalConfig) (problems []string) {
+
+	oneOf := func(field string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problems = append(problems, field+": must be one of \""+strings.Join(allowed, "\", \"")+"\"")
+	}
+
+	oneOf("Mode", config.Mode, "aws", "local")
+	oneOf("Transport", config.Transport, "", "sqs", "memory", "rest")
+	oneOf("SubscriberStore", config.SubscriberStore, "", "dynamodb", "memory")
+	oneOf("DedupStore", config.DedupStore, "", "memory", "dynamodb")
+
+	if config.Mode == "aws" && config.Region == "" && config.Profile == "" {
+		problems = append(problems, "Region: missing (required in aws mode unless Profile provides it)")
+	}
+	if config.Mode == "local" {
+		if config.Transport == "sqs" {
+			problems = append(problems, "Transport: \"sqs\" is not available in local mode")
+		}
+		if config.SubscriberStore == "dynamodb" || config.DedupStore == "dynamodb" {
+			problems = append(problems, "SubscriberStore/DedupStore: \"dynamodb\" is not available in local mode")
+		}
+	}
+
+	//Indirizzi nella forma host:porta, preceduti dall'eventuale schema
+	for _, address := range []struct {
+		field   string
+		value   string
+		schemes []string
+	}{{"LoggerHost", config.LoggerHost, []string{"", "tcp", "tls"}}, {"AwsBroker", config.AwsBroker, []string{"", "http", "https"}},
+		{"ListenAddress", config.ListenAddress, []string{""}}} {
+		if address.value == "" {
+			continue
+		}
+		scheme, host := splitScheme(address.value)
+		if !StringListContains(address.schemes, scheme) {
+			problems = append(problems, address.field+": unsupported scheme \""+scheme+"\"")
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			problems = append(problems, address.field+": must be in the form host:port")
+		}
+	}
+
+	//Certificati TLS
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		problems = append(problems, "TLSCertFile/TLSKeyFile: must be specified together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		problems = append(problems, "TLSClientCAFile: requires TLSCertFile and TLSKeyFile")
+	}
+
+	//Endpoint dei servizi AWS
+	for _, endpoint := range []struct{ field, value string }{{"DynamoDBEndpoint", config.DynamoDBEndpoint}, {"SQSEndpoint", config.SQSEndpoint}} {
+		if endpoint.value == "" {
+			continue
+		}
+		parsed, err := url.Parse(endpoint.value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, endpoint.field+": must be an http or https URL")
+		}
+	}
+
+	//Intervalli di tempo
+	for _, delay := range []struct {
+		field string
+		value int
+	}{{"RetryDelay", config.RetryDelay}, {"PositDelay", config.PositDelay}, {"OpDelay", config.OpDelay},
+		{"SimulationTime", config.SimulationTime}, {"RcvMessDelay", config.RcvMessDelay}, {"HeartbeatDelay", config.HeartbeatDelay},
+		{"TokenTTL", config.TokenTTL}} {
+		if delay.value < 0 {
+			problems = append(problems, delay.field+": must not be negative")
+		}
+	}
+
+	//Con l'autenticazione abilitata servono le chiavi di tutti i ruoli, sufficientemente lunghe da non poter essere indovinate
+	if config.AuthSecret != "" {
+		for _, key := range []struct{ field, value string }{{"AuthSecret", config.AuthSecret}, {"AdminKey", config.AdminKey}, {"PublisherKey", config.PublisherKey}} {
+			if len(key.value) < minAuthKeyLength {
+				problems = append(problems, key.field+": must be at least "+strconv.Itoa(minAuthKeyLength)+" characters long when AuthSecret is set")
+			}
+		}
+	}
+
+	//Limiti di SQS per la ricezione
+	if config.MaxRcvMessage < 1 || config.MaxRcvMessage > 10 {
+		problems = append(problems, "MaxRcvMessage: must be between 1 and 10")
+	}
+	if config.PollingTime < 0 || config.PollingTime > 20 {
+		problems = append(problems, "PollingTime: must be between 0 and 20")
+	}
+
+	return problems
+}
+
+//Copia della configurazione con le chiavi nascoste, da scrivere nel log
+func maskedLocalConfig(config LocalConfig) LocalConfig {
+
+	for _, key := range []*string{&config.AuthSecret, &config.AdminKey, &config.PublisherKey, &config.ApiKey} {
+		if *key != "" {
+			*key = "****"
+		}
+	}
+
+	return config
+}
+
+//Unisce i problemi della configurazione in un solo errore
+func localConfigError(problems []string) error {
+	return errors.New("invalid local configuration:\n - " + strings.Join(problems, "\n - "))
+}
+
+//Crea la sessione con AWS usando il profilo e gli endpoint della configurazione locale
+func newAwsSession() (sess *session.Session, retErr error) {
+
+	awsConfig := aws.Config{
+		EndpointResolver: endpoints.ResolverFunc(resolveEndpoint),
+	}
+	if Config.Region != "" {
+		awsConfig.Region = aws.String(Config.Region)
+	}
+
+	options := session.Options{Config: awsConfig}
+
+	//Con un profilo le credenziali (e la regione, se non specificata) sono lette dai file condivisi di AWS
+	if Config.Profile != "" {
+		options.Profile = Config.Profile
+		options.SharedConfigState = session.SharedConfigEnable
+	}
+
+	return session.NewSessionWithOptions(options)
+}
+
+//Ritorna l'endpoint di un servizio AWS: quello della configurazione locale se presente, altrimenti quello di default
+func resolveEndpoint(service string, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+
+	custom := ""
+	switch service {
+	case endpoints.DynamodbServiceID:
+		custom = Config.DynamoDBEndpoint
+	case endpoints.SqsServiceID:
+		custom = Config.SQSEndpoint
+	}
+
+	if custom != "" {
+		return endpoints.ResolvedEndpoint{URL: custom, SigningRegion: region}, nil
+	}
+
+	return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+}
@@ -0,0 +1,284 @@
+package common
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+			memory_transport.go
+
+	Implementazione di Transport con code FIFO in memoria. Le code esistono solo all'interno del processo
+		che le crea: permette di eseguire publisher, broker e subscriber senza SQS quando condividono
+		lo stesso processo (ad esempio durante i test) o quando il broker espone le proprie code.
+	Come su SQS, un messaggio ricevuto e non eliminato torna visibile dopo memoryVisibilityTimeout e i messaggi
+		con lo stesso DeduplicationID inviati entro memoryDeduplicationWindow vengono scartati.
+
+*/
+
+const memoryVisibilityTimeout = 30 * time.Second    //Tempo dopo il quale un messaggio ricevuto e non eliminato torna visibile
+const memoryDeduplicationWindow = 5 * time.Minute   //Intervallo di deduplicazione (come per le code FIFO di SQS)
+
+var errQueueNotFound = errors.New("queue does not exist")
+
+type MemoryTransport struct {
+	mutex    sync.Mutex
+	queues   map[string]*memoryQueue
+	receipts uint64 //Contatore usato per generare i receipt handle
+}
+
+type memoryQueue struct {
+	messages []queuedMessage               //Messaggi visibili, in ordine di arrivo
+	sequence uint64                        //Numero di sequenza dell'ultimo messaggio accodato
+	inFlight map[string]inFlightMessage    //Messaggi ricevuti e non ancora eliminati, indicizzati per receipt handle
+	dedup    map[string]time.Time          //DeduplicationID inviati e relativo istante di invio
+	notify   chan struct{}                 //Canale chiuso all'arrivo di un nuovo messaggio (risveglia il long polling)
+	created  time.Time                     //Istante di creazione della coda
+}
+
+//Messaggio accodato, con il numero di sequenza che ne determina la posizione nella coda
+type queuedMessage struct {
+	message  QueueMessage
+	sequence uint64
+}
+
+type inFlightMessage struct {
+	queuedMessage
+	deadline time.Time
+}
+
+//Crea un sistema di code in memoria vuoto
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{queues: make(map[string]*memoryQueue)}
+}
+
+//Crea una coda (se esiste già viene ritornata quella esistente, come su SQS)
+func (transport *MemoryTransport) CreateQueue(name string) (queueUrl string, retErr error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	queueUrl = name + ".fifo"
+
+	if _, ok := transport.queues[queueUrl]; !ok {
+		transport.queues[queueUrl] = &memoryQueue{
+			inFlight: make(map[string]inFlightMessage),
+			dedup:    make(map[string]time.Time),
+			notify:   make(chan struct{}),
+			created:  time.Now(),
+		}
+	}
+
+	return queueUrl, nil
+}
+
+//Elimina una coda e tutti i suoi messaggi
+func (transport *MemoryTransport) DeleteQueue(queueUrl string) (retErr error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	queue, ok := transport.queues[queueUrl]
+	if !ok {
+		return errQueueNotFound
+	}
+
+	close(queue.notify)
+	delete(transport.queues, queueUrl)
+
+	return nil
+}
+
+//Elenca le code il cui nome inizia con prefix, in ordine alfabetico
+func (transport *MemoryTransport) ListQueues(prefix string) (queueUrls []string, retErr error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	for queueUrl := range transport.queues {
+		if strings.HasPrefix(queueUrl, prefix) {
+			queueUrls = append(queueUrls, queueUrl)
+		}
+	}
+	sort.Strings(queueUrls)
+
+	return queueUrls, nil
+}
+
+//Ritorna l'istante di creazione di una coda
+func (transport *MemoryTransport) QueueCreatedAt(queueUrl string) (createdAt time.Time, retErr error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	queue, ok := transport.queues[queueUrl]
+	if !ok {
+		return time.Time{}, errQueueNotFound
+	}
+
+	return queue.created, nil
+}
+
+//Accoda un messaggio
+func (transport *MemoryTransport) SendMessage(queueUrl string, message QueueMessage) (retErr error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	queue, ok := transport.queues[queueUrl]
+	if !ok {
+		return errQueueNotFound
+	}
+
+	now := time.Now()
+
+	if message.DeduplicationID != "" {
+		for id, sent := range queue.dedup {
+			if now.Sub(sent) > memoryDeduplicationWindow {
+				delete(queue.dedup, id)
+			}
+		}
+		if _, duplicated := queue.dedup[message.DeduplicationID]; duplicated {
+			return nil
+		}
+		queue.dedup[message.DeduplicationID] = now
+	}
+
+	message.Attributes = copyAttributes(message.Attributes)
+	message.ReceiptHandle = ""
+	message.SentTimestamp = now.UnixNano() / int64(time.Millisecond)
+	queue.sequence++
+	queue.messages = append(queue.messages, queuedMessage{message: message, sequence: queue.sequence})
+
+	//Risveglio di chi è in attesa sulla coda
+	close(queue.notify)
+	queue.notify = make(chan struct{})
+
+	return nil
+}
+
+//Accoda un gruppo di messaggi
+func (transport *MemoryTransport) SendMessageBatch(queueUrl string, messages []QueueMessage) (failed []int, retErr error) {
+	return sendMessagesOneByOne(transport, queueUrl, messages)
+}
+
+//Riceve fino a maxMessages messaggi, attendendo al massimo waitSeconds se la coda è vuota
+func (transport *MemoryTransport) ReceiveMessages(queueUrl string, maxMessages int64, waitSeconds int64) (messages []QueueMessage, retErr error) {
+
+	deadline := time.Now().Add(time.Second * time.Duration(waitSeconds))
+
+	for {
+		transport.mutex.Lock()
+
+		queue, ok := transport.queues[queueUrl]
+		if !ok {
+			transport.mutex.Unlock()
+			return nil, errQueueNotFound
+		}
+
+		transport.restoreExpired(queue)
+
+		if len(queue.messages) > 0 {
+			messages = transport.take(queue, maxMessages)
+			transport.mutex.Unlock()
+			return messages, nil
+		}
+
+		notify := queue.notify
+		transport.mutex.Unlock()
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, nil
+		}
+
+		//Attesa di un nuovo messaggio o della scadenza del long polling
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+//Elimina un messaggio ricevuto
+func (transport *MemoryTransport) DeleteMessage(queueUrl string, receiptHandle string) (retErr error) {
+
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	queue, ok := transport.queues[queueUrl]
+	if !ok {
+		return errQueueNotFound
+	}
+
+	if _, ok := queue.inFlight[receiptHandle]; !ok {
+		return errors.New("receipt handle " + receiptHandle + " is not valid")
+	}
+
+	delete(queue.inFlight, receiptHandle)
+
+	return nil
+}
+
+//Rimette in coda i messaggi ricevuti e non eliminati entro il visibility timeout (da chiamare con il mutex acquisito).
+//I messaggi tornano nella posizione originale, per cui l'ordine di arrivo viene mantenuto come sulle code FIFO di SQS
+func (transport *MemoryTransport) restoreExpired(queue *memoryQueue) {
+
+	now := time.Now()
+	restored := false
+
+	for handle, pending := range queue.inFlight {
+		if now.After(pending.deadline) {
+			pending.message.ReceiptHandle = ""
+			queue.messages = append(queue.messages, pending.queuedMessage)
+			delete(queue.inFlight, handle)
+			restored = true
+		}
+	}
+
+	if restored {
+		sort.Slice(queue.messages, func(i, j int) bool { return queue.messages[i].sequence < queue.messages[j].sequence })
+	}
+}
+
+//Preleva fino a maxMessages messaggi dalla testa della coda (da chiamare con il mutex acquisito)
+func (transport *MemoryTransport) take(queue *memoryQueue, maxMessages int64) (messages []QueueMessage) {
+
+	if maxMessages <= 0 {
+		maxMessages = 1
+	}
+
+	for len(queue.messages) > 0 && int64(len(messages)) < maxMessages {
+
+		queued := queue.messages[0]
+		queue.messages = queue.messages[1:]
+
+		transport.receipts++
+		message := queued.message
+		message.ReceiptHandle = strconv.FormatUint(transport.receipts, 10)
+		queued.message = message
+		queue.inFlight[message.ReceiptHandle] = inFlightMessage{queuedMessage: queued, deadline: time.Now().Add(memoryVisibilityTimeout)}
+
+		message.Attributes = copyAttributes(message.Attributes)
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+//Copia degli attributi di un messaggio
+func copyAttributes(attributes map[string]string) map[string]string {
+
+	copied := make(map[string]string, len(attributes))
+	for name, value := range attributes {
+		copied[name] = value
+	}
+
+	return copied
+}
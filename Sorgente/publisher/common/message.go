@@ -0,0 +1,298 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+			message.go
+
+	Questo modulo definisce il messaggio scambiato tra publisher, broker e subscriber. Il messaggio viene
+		trasportato come QueueMessage: i campi diventano attributi stringa (ID, Topic, Positive, PeopleNum, Mq,
+		PositionX, PositionY, Radius, eventualmente Latitude, Longitude e RadiusMeters) e il testo diventa il Body.
+	L'attributo Version indica la versione del formato: i messaggi senza Version (versione 0) sono quelli
+		inviati prima dell'introduzione di questo modulo e hanno la stessa disposizione degli attributi, per cui
+		vengono decodificati allo stesso modo. Gli attributi di posizione sono opzionali (il broker non li
+		inoltrava ai subscriber) e valgono 0 se assenti.
+	Dalla versione 2 il tipo del messaggio (aggiornamento delle presenze, segnalazione di positivi, emergenza,
+		comunicazione di servizio) è indicato esplicitamente, di seguito alla versione nell'attributo Version
+		(ad esempio "2:occupancy"), oppure nell'attributo Type. Per i messaggi delle versioni precedenti il tipo
+		viene dedotto come faceva il broker: Positive > 0 è una segnalazione di positivi, Radius == 0 un'emergenza
+		e tutti gli altri un aggiornamento delle presenze.
+	I messaggi senza posizione geografica hanno al massimo 10 attributi, il limite di SQS, e vengono quindi
+		trasportati senza impacchettare gli attributi (vedere sqs_transport.go).
+	L'attributo MessageID identifica il messaggio in modo stabile: viene assegnato dal publisher (NewMessageID) e
+		usato come DeduplicationID sia sulla coda del broker che sulle code dei subscriber, in modo che un messaggio
+		ricevuto più volte dal broker non venga notificato più volte. È opzionale per i publisher precedenti.
+
+*/
+
+const MessageVersion = 2 //Versione del formato dei messaggi prodotti da Encode
+
+const versionTypeSeparator = ":" //Separatore tra versione e tipo nell'attributo Version
+
+const maxMessageIDLength = 128 //Lunghezza massima del MessageID (la stessa del DeduplicationID di SQS)
+
+const MaxRadiusMeters = 20040000 //Raggio massimo (in metri) di un messaggio: circa metà della circonferenza terrestre
+
+//Tipi di messaggio
+const (
+	MessageOccupancy = "occupancy" //Aggiornamento del numero di persone presenti nella struttura
+	MessagePositive  = "positive"  //Segnalazione di nuovi casi positivi nella struttura
+	MessageEmergency = "emergency" //Segnalazione di emergenza
+	MessageService   = "service"   //Comunicazione di servizio
+)
+
+//Lista dei tipi di messaggio supportati
+var MessageTypes = []string{MessageOccupancy, MessagePositive, MessageEmergency, MessageService}
+
+//Attributi presenti anche nei messaggi della versione 0, gli unici letti dai subscriber e dai broker precedenti
+var legacyAttributes = []string{"ID", "Topic", "Positive", "PeopleNum", "Mq", "PositionX", "PositionY", "Radius"}
+
+//Posizione geografica di un messaggio
+type GeoPosition struct {
+	Latitude     float64 //Latitudine WGS84 in gradi decimali
+	Longitude    float64 //Longitudine WGS84 in gradi decimali
+	RadiusMeters float64 //Raggio di pubblicazione in metri (0 = viene convertito il raggio in blocchi)
+}
+
+//Messaggio inviato da un publisher (e inoltrato dal broker ai subscriber)
+type Message struct {
+	Version   int          //Versione del formato (0 per i messaggi senza attributo Version)
+	MessageID string       //Identificativo univoco assegnato dal publisher (vuoto per i publisher precedenti)
+	Type      string       //Tipo del messaggio (MessageOccupancy, MessagePositive, ...)
+	ID        string       //Identificativo (nome) della struttura
+	Topic     string       //Topic del messaggio
+	Positive  int          //Nuovi positivi trovati nella struttura
+	PeopleNum int          //Persone presenti nella struttura
+	Mq        int          //Metri quadri della struttura
+	PositionX int          //Posizione della struttura (in blocchi)
+	PositionY int
+	Radius    int          //Raggio di pubblicazione (in blocchi, 0 = tutti i subscriber del topic)
+	Geo       *GeoPosition //Posizione geografica (nil se il publisher usa solo le coordinate a blocchi)
+	Text      string       //Testo del messaggio
+}
+
+//Verifica che latitudine e longitudine siano valide
+func ValidCoordinates(latitude float64, longitude float64) bool {
+	return isFinite(latitude) && isFinite(longitude) &&
+		latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+//Verifica che un valore decimale non sia NaN o infinito
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+//Genera un identificativo casuale per un nuovo messaggio
+func NewMessageID() string {
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+//Verifica che i campi del messaggio siano validi
+func (message Message) Validate() (retErr error) {
+
+	if message.Version < 0 || message.Version > MessageVersion {
+		return errors.New("unsupported message version " + strconv.Itoa(message.Version))
+	}
+	if StringListContains(MessageTypes, message.Type) == false {
+		return errors.New("unknown message type " + message.Type)
+	}
+	if message.Type == MessagePositive && message.Positive <= 0 {
+		return errors.New("positive report without positives")
+	}
+	if len(message.MessageID) > maxMessageIDLength {
+		return errors.New("message ID too long")
+	}
+	if message.ID == "" {
+		return errors.New("missing structure ID")
+	}
+	if message.Topic == "" {
+		return errors.New("missing topic")
+	}
+	if message.Positive < 0 || message.PeopleNum < 0 || message.Mq < 0 {
+		return errors.New("positive, people number and square meters must not be negative")
+	}
+	if message.Radius < 0 {
+		return errors.New("radius must not be negative")
+	}
+	if message.Geo != nil {
+		if !ValidCoordinates(message.Geo.Latitude, message.Geo.Longitude) {
+			return errors.New("coordinates out of range")
+		}
+		if !isFinite(message.Geo.RadiusMeters) || message.Geo.RadiusMeters < 0 {
+			return errors.New("radius in meters must be a non-negative number")
+		}
+		if message.Geo.RadiusMeters > MaxRadiusMeters {
+			return errors.New("radius in meters must not exceed " + strconv.Itoa(MaxRadiusMeters))
+		}
+	}
+
+	return nil
+}
+
+//Converte il messaggio nel formato trasportato dalle code (GroupID e DeduplicationID sono a carico del chiamante)
+func (message Message) Encode() QueueMessage {
+
+	attributes := map[string]string{
+		"Version":   strconv.Itoa(MessageVersion) + versionTypeSeparator + message.Type,
+		"ID":        message.ID,
+		"Topic":     message.Topic,
+		"Positive":  strconv.Itoa(message.Positive),
+		"PeopleNum": strconv.Itoa(message.PeopleNum),
+		"Mq":        strconv.Itoa(message.Mq),
+		"PositionX": strconv.Itoa(message.PositionX),
+		"PositionY": strconv.Itoa(message.PositionY),
+		"Radius":    strconv.Itoa(message.Radius),
+	}
+
+	if message.MessageID != "" {
+		attributes["MessageID"] = message.MessageID
+	}
+
+	if message.Geo != nil {
+		attributes["Latitude"] = strconv.FormatFloat(message.Geo.Latitude, 'f', -1, 64)
+		attributes["Longitude"] = strconv.FormatFloat(message.Geo.Longitude, 'f', -1, 64)
+		if message.Geo.RadiusMeters > 0 {
+			attributes["RadiusMeters"] = strconv.FormatFloat(message.Geo.RadiusMeters, 'f', -1, 64)
+		}
+	}
+
+	return QueueMessage{Body: message.Text, Attributes: attributes}
+}
+
+//Ricostruisce un messaggio a partire dal formato trasportato dalle code (non effettua la validazione, vedere Validate)
+func DecodeMessage(queueMessage QueueMessage) (message Message, retErr error) {
+
+	attributes := queueMessage.Attributes
+	if attributes == nil {
+		return Message{}, errors.New("message has no attributes")
+	}
+
+	var err error
+
+	message.MessageID = attributes["MessageID"]
+	message.ID = attributes["ID"]
+	message.Topic = attributes["Topic"]
+	message.Text = queueMessage.Body
+
+	//Versione, eventualmente seguita dal tipo del messaggio
+	version, messageType := attributes["Version"], ""
+	if separator := strings.Index(version, versionTypeSeparator); separator >= 0 {
+		version, messageType = version[:separator], version[separator+len(versionTypeSeparator):]
+	}
+	if message.Version, err = intAttribute(map[string]string{"Version": version}, "Version", false); err != nil {
+		return Message{}, err
+	}
+	if message.Positive, err = intAttribute(attributes, "Positive", true); err != nil {
+		return Message{}, err
+	}
+	if message.PeopleNum, err = intAttribute(attributes, "PeopleNum", true); err != nil {
+		return Message{}, err
+	}
+	if message.Mq, err = intAttribute(attributes, "Mq", true); err != nil {
+		return Message{}, err
+	}
+	if message.PositionX, err = intAttribute(attributes, "PositionX", false); err != nil {
+		return Message{}, err
+	}
+	if message.PositionY, err = intAttribute(attributes, "PositionY", false); err != nil {
+		return Message{}, err
+	}
+	if message.Radius, err = intAttribute(attributes, "Radius", false); err != nil {
+		return Message{}, err
+	}
+
+	//Posizione geografica opzionale
+	if attributes["Latitude"] != "" || attributes["Longitude"] != "" {
+
+		geo := &GeoPosition{}
+
+		if geo.Latitude, err = floatAttribute(attributes, "Latitude", true); err != nil {
+			return Message{}, err
+		}
+		if geo.Longitude, err = floatAttribute(attributes, "Longitude", true); err != nil {
+			return Message{}, err
+		}
+		if geo.RadiusMeters, err = floatAttribute(attributes, "RadiusMeters", false); err != nil {
+			return Message{}, err
+		}
+
+		message.Geo = geo
+	}
+
+	//Tipo del messaggio (dedotto per i messaggi che non lo specificano)
+	message.Type = messageType
+	if message.Type == "" {
+		message.Type = attributes["Type"]
+	}
+	if message.Type == "" {
+		message.Type = message.InferType()
+	}
+
+	return message, nil
+}
+
+//Deduce il tipo di un messaggio che non lo specifica a partire dal numero di positivi e dal raggio
+func (message Message) InferType() string {
+
+	if message.Positive > 0 {
+		return MessagePositive
+	}
+	if message.Radius == 0 && (message.Geo == nil || message.Geo.RadiusMeters == 0) {
+		return MessageEmergency
+	}
+
+	return MessageOccupancy
+}
+
+//Legge un attributo intero (0 se l'attributo è opzionale ed assente)
+func intAttribute(attributes map[string]string, name string, required bool) (value int, retErr error) {
+
+	strValue, ok := attributes[name]
+	if !ok || strValue == "" {
+		if required {
+			return 0, errors.New("missing attribute " + name)
+		}
+		return 0, nil
+	}
+
+	value, err := strconv.Atoi(strValue)
+	if err != nil {
+		return 0, errors.New("invalid attribute " + name + ": " + strValue)
+	}
+
+	return value, nil
+}
+
+//Legge un attributo decimale (0 se l'attributo è opzionale ed assente)
+func floatAttribute(attributes map[string]string, name string, required bool) (value float64, retErr error) {
+
+	strValue, ok := attributes[name]
+	if !ok || strValue == "" {
+		if required {
+			return 0, errors.New("missing attribute " + name)
+		}
+		return 0, nil
+	}
+
+	value, err := strconv.ParseFloat(strValue, 64)
+	if err != nil {
+		return 0, errors.New("invalid attribute " + name + ": " + strValue)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+//Messaggio valido usato come base dai test
+func testMessage() Message {
+	return Message{
+		Version:   MessageVersion,
+		MessageID: "3f2a",
+		Type:      MessageOccupancy,
+		ID:        "Farmacia Centrale",
+		Topic:     "Farmacia",
+		PeopleNum: 12,
+		Mq:        80,
+		PositionX: -3,
+		PositionY: 7,
+		Radius:    4,
+		Text:      "Aggiornamento presenze",
+	}
+}
+
+//Validazione dei campi del messaggio
+func TestMessageValidate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(message *Message)
+		valid  bool
+	}{
+		{"valid", func(message *Message) {}, true},
+		{"legacy version", func(message *Message) { message.Version = 0 }, true},
+		{"future version", func(message *Message) { message.Version = MessageVersion + 1 }, false},
+		{"unknown type", func(message *Message) { message.Type = "alarm" }, false},
+		{"positive report without positives", func(message *Message) { message.Type = MessagePositive }, false},
+		{"missing topic", func(message *Message) { message.Topic = "" }, false},
+		{"negative people", func(message *Message) { message.PeopleNum = -1 }, false},
+		{"negative radius", func(message *Message) { message.Radius = -1 }, false},
+		{"geo position", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5, RadiusMeters: 500} }, true},
+		{"geo on the limits", func(message *Message) { message.Geo = &GeoPosition{Latitude: -90, Longitude: 180, RadiusMeters: MaxRadiusMeters} }, true},
+		{"latitude out of range", func(message *Message) { message.Geo = &GeoPosition{Latitude: 90.5, Longitude: 12.5} }, false},
+		{"latitude NaN", func(message *Message) { message.Geo = &GeoPosition{Latitude: math.NaN(), Longitude: 12.5} }, false},
+		{"longitude infinite", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: math.Inf(-1)} }, false},
+		{"radius NaN", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5, RadiusMeters: math.NaN()} }, false},
+		{"radius infinite", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5, RadiusMeters: math.Inf(1)} }, false},
+		{"radius too large", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5, RadiusMeters: MaxRadiusMeters + 1} }, false},
+		{"negative radius in meters", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.9, Longitude: 12.5, RadiusMeters: -1} }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			message := testMessage()
+			test.modify(&message)
+
+			err := message.Validate()
+			if (err == nil) != test.valid {
+				t.Fatalf("Validate() = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+//Un messaggio codificato e poi decodificato resta invariato
+func TestMessageEncodeDecode(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(message *Message)
+	}{
+		{"blocks only", func(message *Message) {}},
+		{"without message ID", func(message *Message) { message.MessageID = "" }},
+		{"geo position", func(message *Message) { message.Geo = &GeoPosition{Latitude: 41.902783, Longitude: -12.496366, RadiusMeters: 1500.5} }},
+		{"geo without radius", func(message *Message) { message.Geo = &GeoPosition{Latitude: -33.8688, Longitude: 151.2093} }},
+		{"emergency with empty text", func(message *Message) { message.Type = MessageEmergency; message.Radius = 0; message.Text = "" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			message := testMessage()
+			test.modify(&message)
+
+			decoded, err := DecodeMessage(message.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, message) {
+				t.Fatalf("decoded %+v, want %+v", decoded, message)
+			}
+		})
+	}
+}
+
+//Decodifica dei messaggi dei publisher precedenti e dei messaggi malformati
+func TestDecodeMessage(t *testing.T) {
+
+	legacy := map[string]string{"ID": "Ufficio", "Topic": "Uffici", "Positive": "0", "PeopleNum": "5", "Mq": "40", "Radius": "3"}
+
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		wantType   string
+		valid      bool
+	}{
+		{"legacy occupancy", legacy, MessageOccupancy, true},
+		{"legacy positive", withAttribute(legacy, "Positive", "2"), MessagePositive, true},
+		{"legacy emergency", withAttribute(legacy, "Radius", "0"), MessageEmergency, true},
+		{"type after the version", withAttribute(legacy, "Version", "0:service"), MessageService, true},
+		{"type attribute", withAttribute(legacy, "Type", MessageService), MessageService, true},
+		{"version without type", withAttribute(withAttribute(legacy, "Version", "0:"), "Positive", "1"), MessagePositive, true},
+		{"invalid version", withAttribute(legacy, "Version", "two:service"), "", false},
+		{"no attributes", nil, "", false},
+		{"missing required attribute", withAttribute(legacy, "Mq", ""), "", false},
+		{"invalid integer", withAttribute(legacy, "PeopleNum", "many"), "", false},
+		{"invalid latitude", withAttribute(withAttribute(legacy, "Latitude", "north"), "Longitude", "12.5"), "", false},
+		{"longitude without latitude", withAttribute(legacy, "Longitude", "12.5"), "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			message, err := DecodeMessage(QueueMessage{Body: "testo", Attributes: test.attributes})
+			if (err == nil) != test.valid {
+				t.Fatalf("DecodeMessage() = %v, want valid %v", err, test.valid)
+			}
+			if err == nil && (message.Type != test.wantType || message.Version != 0 || message.Text != "testo") {
+				t.Fatalf("decoded %+v, want type %s", message, test.wantType)
+			}
+		})
+	}
+}
+
+//Copia degli attributi con un attributo modificato
+func withAttribute(attributes map[string]string, name string, value string) map[string]string {
+
+	copied := make(map[string]string)
+	for key, current := range attributes {
+		copied[key] = current
+	}
+	copied[name] = value
+
+	return copied
+}
@@ -3,25 +3,25 @@ package main
 import (
 	"bufio"
 	"common"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"log"
 	"math/rand"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"net"
 )
 
 /*
 			publisher.go
 
 	Questo è il modulo "start" del publisher che orchestra il suo funzionamento. Può essere eseguito in modalità "interattiva" e non.
-	Come specificato nelle istruzioni, accetta parametri a riga di comando.
+	Come specificato nelle istruzioni, accetta parametri a riga di comando (vedere publisher_flags.go).
 
 */
 
@@ -29,52 +29,33 @@ import (
 //Variabile che contiene l'URL della coda SQS per i messaggi in uscita
 var sendQueue string
 
+//Posizione geografica opzionale della struttura (latitudine e longitudine WGS84, raggio in metri). Se specificata,
+//il broker la utilizza al posto delle coordinate a blocchi
+var latitude string
+var longitude string
+var radiusMeters string
+
 // Punto di ingresso
 func main() {
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	//Recupero gli argomenti in ingresso (scartando il primo che contiene il nome del programma)
-	args := os.Args[1:]
-
-	//Se non si specificano parametri di ingresso, il programma di default sarà interattivo
-	interactive := true
-
-	//Se specifica almeno il primo argomento, ed esso è uguale ad "i", allora il programma sarà interattivo
-	if len(args) >= 1 {
-		if args[0] == "i" { interactive = true
-		} else { interactive = false }
+	//Lettura dei parametri a riga di comando (vedere publisher_flags.go), scartando il primo che contiene il nome del programma
+	options, err := parseArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
 	}
 
-	//Se vengono specificati tutti i parametri si parte da una situazione di publisher predefinita
-	if len(args) >= 8 {
-
-		name := args[1]
-		topic := args[2]
-		peopleNum := args[3]
-		positionX := args[4]
-		positionY := args[5]
-		radius := args[6]
-		mq := args[7]
-
-		//Eseguo il publsiher
-		run(name, topic, peopleNum, positionX, positionY, radius, mq, interactive)
+	common.ConfigFile = options.configFile
 
-	} else {
-		//Se non sono stati specificati tutti i parametri, il publisher viene eseguito impostando valori randomici
-
-		name := "Struttura #" + strconv.Itoa(rand.Intn(100))				//Nome struttura
-		topic := common.Topics[rand.Intn(len(common.Topics))]				//Topic a cui manderà i messaggi
-		peopleNum := strconv.Itoa(rand.Intn(50) + 20)					//Numero di persone presenti nella struttura al momento dello startup
-		positionX := strconv.Itoa(rand.Intn(common.TestPositionSize))		//Posizione della struttura in coordinate X (Nota: Le cordinate X, Y si riferiscono al "blocco" posizionato in X,Y, non sono latitudine e longitudine)
-		positionY := strconv.Itoa(rand.Intn(common.TestPositionSize))		//Posizione della struttura in coordinate Y
-		radius := strconv.Itoa(rand.Intn(10) + 1)						//Raggio di interesse per il messaggio mandato dal publisher (Distanza per la quale i subscriber riceveranno il messaggio del publisher)
-		mq := strconv.Itoa(rand.Intn(100))								//Metri quadri della struttura
-
-		//Eseguo il publsiher
-		run(name, topic, peopleNum, positionX, positionY, radius, mq, interactive)
-	}
+	//Posizione geografica opzionale
+	latitude, longitude, radiusMeters = options.latitude, options.longitude, options.radiusMeters
 
+	//Eseguo il publsiher
+	run(options.name, options.topic, options.peopleNum, options.positionX, options.positionY, options.radius, options.mq, options.interactive)
 }
 
 
@@ -91,6 +72,11 @@ func run(name string, topic string, peopleNum string, positionX string, position
 	}
 
 
+	//Contesto annullato alla ricezione di SIGINT o SIGTERM
+	ctx, cancel := common.ShutdownContext()
+	defer cancel()
+	defer common.CloseLog()
+
 	time.Sleep(time.Second * 1)
 
 	//Comunicazione con il broker per ottenere la coda SQS su cui mandare il messaggio
@@ -98,7 +84,8 @@ func run(name string, topic string, peopleNum string, positionX string, position
 		err = getSendQueue()
 		if err != nil {
 			common.Fatal("[PUB] Errore nell'ottenimento della coda dal broker. Tentativo di riconnessione tra " + strconv.Itoa(common.Config.RetryDelay) + "s\n" + err.Error())
-			time.Sleep(time.Second * time.Duration(common.Config.RetryDelay))	//Se connessione con broker fallisce, si ritenta dopo "Config.RetryDelay" secondi.
+			//Se connessione con broker fallisce, si ritenta dopo "Config.RetryDelay" secondi.
+			if !common.SleepContext(ctx, time.Second * time.Duration(common.Config.RetryDelay)) { return }
 		} else { break }
 	}
 
@@ -106,14 +93,35 @@ func run(name string, topic string, peopleNum string, positionX string, position
 	sendLogMessage("Configurazione completata")
 
 	if interactive {
-		//Eseguo in maniera interattiva il publisher
-		interactivePublisher(name, topic, peopleNum, positionX, positionY, radius, mq)
+		//Eseguo in maniera interattiva il publisher, fino alla sua uscita o alla terminazione
+		done := make(chan struct{})
+		go func() {
+			interactivePublisher(name, topic, peopleNum, positionX, positionY, radius, mq)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
 
 	} else {
 		//Applicazione non interattiva
-		go publisher(name, topic, peopleNum, positionX, positionY, radius, mq)
-
-		time.Sleep(time.Second * time.Duration(common.Config.SimulationTime)) 	//La simulazione terminerà dopo Config.SimulationTime secondi.
+		simulationCtx, stop := context.WithTimeout(ctx, time.Second * time.Duration(common.Config.SimulationTime))	//La simulazione terminerà dopo Config.SimulationTime secondi.
+		defer stop()
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publisher(simulationCtx, name, topic, peopleNum, positionX, positionY, radius, mq)
+		}()
+
+		//Attesa del termine della simulazione e dell'invio in corso
+		<-simulationCtx.Done()
+		if !common.WaitTimeout(&wg, common.ShutdownTimeout) {
+			common.Warning("[PUB] Invio del messaggio in corso non completato")
+		}
 	}
 
 	//Invio del messaggio al log remoto
@@ -124,8 +132,8 @@ func run(name string, topic string, peopleNum string, positionX string, position
 
 
 
-// Logica del publisher (NON INTERATTIVO)
-func publisher(name string, topic string, peopleNum string, positionX string, positionY string, radius string, mq string) {
+// Logica del publisher (NON INTERATTIVO), fino all'annullamento del contesto
+func publisher(ctx context.Context, name string, topic string, peopleNum string, positionX string, positionY string, radius string, mq string) {
 
 	delay := time.Duration(common.Config.OpDelay)
 
@@ -142,7 +150,7 @@ func publisher(name string, topic string, peopleNum string, positionX string, po
 
 			positive := strconv.Itoa(rand.Intn(4) + 1)
 
-			err := sendQueueMessage("Numeno nuovi positivi dall'ultima segnalazione: " + positive, name, peopleNum, positive, mq, topic, positionX, positionY, radius)
+			err := sendQueueMessage(common.MessagePositive, "Numeno nuovi positivi dall'ultima segnalazione: " + positive, name, peopleNum, positive, mq, topic, positionX, positionY, radius)
 			if err != nil {
 				common.Warning(err.Error())
 			}
@@ -151,7 +159,7 @@ func publisher(name string, topic string, peopleNum string, positionX string, po
 		} else if choice < 0.3 {
 
 
-			err := sendQueueMessage("Segnalazione di emergenza (inoltrato a tutti i subscriber del topic \"" + topic + "\")", name, peopleNum, "0", mq, topic, positionX, positionY, "0")
+			err := sendQueueMessage(common.MessageEmergency, "Segnalazione di emergenza (inoltrato a tutti i subscriber del topic \"" + topic + "\")", name, peopleNum, "0", mq, topic, positionX, positionY, "0")
 			if err != nil {
 				common.Warning(err.Error())
 			}
@@ -167,7 +175,7 @@ func publisher(name string, topic string, peopleNum string, positionX string, po
 				peopleNum = strconv.Itoa(intPeopleNum  + ((rand.Intn(3) - 1) * rand.Intn(10))) // (rand.Intn(3) - 1) esprime un valore random tra -1, 0, 1; che moltiplicato per un numero tra 0 e 4 esprime la variazione di persone
 			}
 
-			err = sendQueueMessage("Numero di persone presenti attualmente nella struttura: " + peopleNum, name, peopleNum, "0", mq, topic, positionX, positionY, radius)
+			err = sendQueueMessage(common.MessageOccupancy, "Numero di persone presenti attualmente nella struttura: " + peopleNum, name, peopleNum, "0", mq, topic, positionX, positionY, radius)
 			if err != nil {
 				common.Warning(err.Error())
 			}
@@ -185,7 +193,7 @@ func publisher(name string, topic string, peopleNum string, positionX string, po
 				fakePeopleNum = strconv.Itoa(2 * intMq)
 			}
 
-			err = sendQueueMessage("Numero di persone presenti attualmente nella struttura: " + fakePeopleNum, name, fakePeopleNum, "0", mq, topic, positionX, positionY, radius)
+			err = sendQueueMessage(common.MessageOccupancy, "Numero di persone presenti attualmente nella struttura: " + fakePeopleNum, name, fakePeopleNum, "0", mq, topic, positionX, positionY, radius)
 			if err != nil {
 				common.Warning(err.Error())
 			}
@@ -193,7 +201,9 @@ func publisher(name string, topic string, peopleNum string, positionX string, po
 		}
 
 		//Ritardo tra un'operazione ed un'altra
-		time.Sleep(time.Second * delay)
+		if !common.SleepContext(ctx, time.Second * delay) {
+			return
+		}
 	}
 }
 
@@ -246,7 +256,7 @@ func interactivePublisher(name string, topic string, peopleNum string, positionX
 
 
 			//---------- Coordinata X e Y ----------
-			fmt.Print("[INPUT*] Specificare la coordinata X [numero intero positivo] del publisher (valore impostato = " + positionX + ")\n" +
+			fmt.Print("[INPUT*] Specificare la coordinata X [numero intero] del publisher (valore impostato = " + positionX + ")\n" +
 				"(E' consigliato utilizzare un valore al di sotto di " + strconv.Itoa(common.TestPositionSize) + " ai fini del test): ")
 
 			input, err = common.ReadInput(reader)
@@ -256,7 +266,7 @@ func interactivePublisher(name string, topic string, peopleNum string, positionX
 
 
 
-			fmt.Print("[INPUT*] Specificare la coordinata Y [numero intero positivo] del publisher (valore impostato = " + positionY + ")\n" +
+			fmt.Print("[INPUT*] Specificare la coordinata Y [numero intero] del publisher (valore impostato = " + positionY + ")\n" +
 				"(E' consigliato utilizzare un valore al di sotto di " + strconv.Itoa(common.TestPositionSize) + " ai fini del test): ")
 
 			input, err = common.ReadInput(reader)
@@ -279,6 +289,36 @@ func interactivePublisher(name string, topic string, peopleNum string, positionX
 
 
 
+			//---------- Posizione geografica ----------
+			fmt.Print("[INPUT*] Specificare la latitudine della struttura in gradi decimali (valore impostato = " + latitude + ")\n" +
+				"(Se specificata insieme alla longitudine sostituisce le coordinate X e Y, inserire \"-\" per non utilizzarla): ")
+
+			input, err = common.ReadInput(reader)
+			if err != nil { return }
+
+			if strings.Compare(input, "-") == 0 { latitude, longitude, radiusMeters = "", "", ""
+			} else if strings.Compare(input, "") != 0 { latitude = input }
+
+			if latitude != "" {
+
+				fmt.Print("[INPUT*] Specificare la longitudine della struttura in gradi decimali (valore impostato = " + longitude + "): ")
+
+				input, err = common.ReadInput(reader)
+				if err != nil { return }
+
+				if strings.Compare(input, "") != 0 { longitude = input }
+
+				fmt.Print("[INPUT*] Specificare il raggio della publicazione in metri (valore impostato = " + radiusMeters + ")\n" +
+					"(Se non specificato viene convertito il raggio in blocchi): ")
+
+				input, err = common.ReadInput(reader)
+				if err != nil { return }
+
+				if strings.Compare(input, "") != 0 { radiusMeters = input }
+			}
+
+
+
 			//---------- Metri quadri ----------
 			fmt.Print("[INPUT*] Specificare i metri quadri della struttura [numero intero positivo] del publisher (valore impostato = " + mq + "): ")
 
@@ -309,6 +349,24 @@ func interactivePublisher(name string, topic string, peopleNum string, positionX
 
 
 
+			//---------- Tipo del messaggio ----------
+			fmt.Print("Tipi di messaggio disponibili: \n\t - " + common.ConcatenateArrayValues(common.MessageTypes, "\n\t - ") + "\n")
+			messageType := ""
+			for {
+				fmt.Print("[INPUT*] Specificare il tipo del messaggio (valore impostato = dedotto dal numero di positivi e dal raggio): ")
+
+				input, err = common.ReadInput(reader)
+				if err != nil { return }
+
+				if input == "" || common.StringListContains(common.MessageTypes, input) {
+					messageType = input
+					break
+				}
+				fmt.Println("Tipo di messaggio non valido: " + input)
+			}
+
+
+
 			//---------- Testo del messaggio ----------
 			fmt.Print("[INPUT*] Inserire il testo del messaggio (valore impostato = Nessun messaggio): ")
 
@@ -319,7 +377,7 @@ func interactivePublisher(name string, topic string, peopleNum string, positionX
 
 
 			//Invio del messaggio
-			if sendQueueMessage(message, name, peopleNum, positive, mq, topic, positionX, positionY, radius) != nil {
+			if err = sendQueueMessage(messageType, message, name, peopleNum, positive, mq, topic, positionX, positionY, radius); err != nil {
 				common.Fatal("[PUB] Errore nell'invio del messaggio. " + err.Error())
 			}
 
@@ -333,8 +391,8 @@ func interactivePublisher(name string, topic string, peopleNum string, positionX
 
 
 
-//Funzione che invia il messaggio alla coda SQS verso il broker
-func sendQueueMessage(message string, id string, peopleNum string, positive string, mq string, topic string, positionX string, positionY string, radius string) (retErr error) {
+//Funzione che invia il messaggio alla coda verso il broker
+func sendQueueMessage(messageType string, message string, id string, peopleNum string, positive string, mq string, topic string, positionX string, positionY string, radius string) (retErr error) {
 
 	rad, _ := strconv.Atoi(radius)
 
@@ -344,56 +402,54 @@ func sendQueueMessage(message string, id string, peopleNum string, positive stri
 		return errors.New("radius must be a positive value")
 	}
 
-	//Connessione con AWS
-	svc := sqs.New(common.Sess)
-
 	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
 	if err != nil {
 		log.Fatal(err)
 	}
 	deduplication_ID := reg.ReplaceAllString(id, "")
 
-	//Creazione e invio del messaggio messaggio
-	_, err = svc.SendMessage(&sqs.SendMessageInput{
-		MessageAttributes: map[string]*sqs.MessageAttributeValue{
-			"ID": &sqs.MessageAttributeValue{
-				DataType:    aws.String("String"),
-				StringValue: aws.String(id),
-			},
-			"Positive": &sqs.MessageAttributeValue{
-				DataType:    aws.String("String"),
-				StringValue: aws.String(positive),
-			},
-			"PeopleNum": &sqs.MessageAttributeValue{
-				DataType:    aws.String("String"),
-				StringValue: aws.String(peopleNum),
-			},
-			"Mq": &sqs.MessageAttributeValue{
-				DataType:    aws.String("String"),
-				StringValue: aws.String(mq),
-			},
-			"Topic": &sqs.MessageAttributeValue{
-				DataType:    aws.String("String"),
-				StringValue: aws.String(topic),
-			},
-			"PositionX": &sqs.MessageAttributeValue{
-				DataType:    aws.String("Number"),
-				StringValue: aws.String(positionX),
-			},
-			"PositionY": &sqs.MessageAttributeValue{
-				DataType:    aws.String("Number"),
-				StringValue: aws.String(positionY),
-			},
-			"Radius": &sqs.MessageAttributeValue{
-				DataType:    aws.String("Number"),
-				StringValue: aws.String(radius),
-			},
-		},
-		MessageGroupId:         aws.String(deduplication_ID + "groupID"),
-		MessageDeduplicationId: aws.String(deduplication_ID + strconv.Itoa(time.Now().Nanosecond())),
-		MessageBody:            aws.String(message),
-		QueueUrl:               &sendQueue,
-	})
+	attributes := map[string]string{
+		"ID":        id,
+		"Positive":  positive,
+		"PeopleNum": peopleNum,
+		"Mq":        mq,
+		"Topic":     topic,
+		"PositionX": positionX,
+		"PositionY": positionY,
+		"Radius":    radius,
+	}
+
+	//Se il tipo non viene specificato viene dedotto dal broker a partire dal numero di positivi e dal raggio
+	if messageType != "" {
+		attributes["Type"] = messageType
+	}
+
+	//Posizione geografica (il raggio in metri non viene inviato per i messaggi a raggio 0, inoltrati a tutti i subscriber del topic)
+	if latitude != "" && longitude != "" {
+		attributes["Latitude"] = latitude
+		attributes["Longitude"] = longitude
+		if rad > 0 && radiusMeters != "" {
+			attributes["RadiusMeters"] = radiusMeters
+		}
+	}
+
+	//Conversione e validazione dei parametri (che sono espressi come stringhe da linea di comando)
+	pubMessage, err := common.DecodeMessage(common.QueueMessage{Attributes: attributes, Body: message})
+	if err == nil {
+		err = pubMessage.Validate()
+	}
+	if err != nil {
+		common.Warning("[PUB] Messaggio non valido. " + err.Error())
+		return err
+	}
+
+	//Creazione e invio del messaggio messaggio, con un identificativo univoco usato anche per la deduplicazione
+	pubMessage.MessageID = common.NewMessageID()
+	queueMessage := pubMessage.Encode()
+	queueMessage.GroupID = deduplication_ID + "groupID"
+	queueMessage.DeduplicationID = pubMessage.MessageID
+
+	err = common.MessageTransport.SendMessage(sendQueue, queueMessage)
 	if err != nil {
 		common.Warning("[PUB] Errore nell'invio del messaggio. " + err.Error())
 		return err
@@ -404,14 +460,14 @@ func sendQueueMessage(message string, id string, peopleNum string, positive stri
 	sendLogMessage("Messaggio inviato:\n" +
 		"\t[Struttura: " + id + "; Metri quadri: " + mq + "]: \"" + message + "\"\n" +
 		"\t | Numero persone: " + peopleNum + " (Positivi: " + positive + ") \n" +
-		"\t | Topic \"" + topic + "\"\n" +
+		"\t | Tipo " + pubMessage.Type + ", Topic \"" + topic + "\"\n" +
 		"\t | Posizione:Raggio (" + positionX + ", " + positionY + "):" + radius + "\n" +
 		"\t +-----------------------------------------------------------------------------\n")
 
 	common.Info("[PUB] Messaggio inviato:\n" +
 		"\t[Struttura: " + id + "; Metri quadri: " + mq + "]: \"" + message + "\"\n" +
 		"\t | Numero persone: " + peopleNum + " (Positivi: " + positive + ") \n" +
-		"\t | Topic \"" + topic + "\"\n" +
+		"\t | Tipo " + pubMessage.Type + ", Topic \"" + topic + "\"\n" +
 		"\t | Posizione : Raggio (" + positionX + ", " + positionY + ") : " + radius + "\n" +
 		"\t +-----------------------------------------------------------------------------\n")
 	return nil
@@ -446,24 +502,5 @@ func sendLogMessage(message string) {
 
 	prefix := "[PUB] "
 
-	err := common.SendMessage(common.RemoteLogConnection, prefix + message + "\n")
-	if err != nil {
-		common.Warning("Errore nel logging remoto")
-		
-		//Istanzio la connessione con il remote logger
-		common.RemoteLogConnection, err = net.Dial("tcp", common.Config.LoggerHost)
-		if err != nil {
-			fmt.Println("Errore in dial: " + err.Error())
-		}
-		err = common.SendMessage(common.RemoteLogConnection, "d\n")
-		if err != nil {
-			fmt.Println("Errore nell'inizializzazione della connessione: " + err.Error())
-		}
-
-
-	common.SendMessage(common.RemoteLogConnection, prefix + message + "\n")
-
-
-	}
-
+	common.SendRemoteLog(prefix + message + "\n")
 }
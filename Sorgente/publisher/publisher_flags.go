@@ -0,0 +1,202 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+			publisher_flags.go
+
+	Questo modulo legge i parametri a riga di comando del publisher (publisher -help per la lista delle opzioni).
+		I parametri non specificati vengono impostati con valori casuali.
+	È ancora accettata, ma deprecata, la forma posizionale originale:
+		publisher i|n nome topic persone x y raggio mq [latitudine longitudine [raggio_metri]]
+
+*/
+
+//Parametri di avvio del publisher
+type publisherOptions struct {
+	interactive  bool
+	name         string
+	topic        string
+	peopleNum    string
+	positionX    string
+	positionY    string
+	radius       string
+	mq           string
+	latitude     string
+	longitude    string
+	radiusMeters string
+	configFile   string
+}
+
+//Legge i parametri a riga di comando (nella forma con opzioni oppure in quella posizionale deprecata)
+func parseArgs(args []string) (options publisherOptions, retErr error) {
+
+	options = randomPublisherOptions()
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return parsePositionalArgs(args, options), nil
+	}
+
+	flags := flag.NewFlagSet("publisher", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Uso: publisher [opzioni]\nI parametri non specificati vengono impostati con valori casuali.\n\nOpzioni:")
+		flags.PrintDefaults()
+	}
+
+	flags.BoolVar(&options.interactive, "interactive", true, "esecuzione interattiva (--interactive=false per la simulazione)")
+	name := flags.String("name", "", "nome della struttura")
+	topic := flags.String("topic", "", "topic a cui inviare i messaggi ("+strings.Join(common.Topics, ", ")+")")
+	people := flags.Int("people", 0, "numero di persone presenti nella struttura")
+	x := flags.Int("x", 0, "coordinata X del blocco della struttura")
+	y := flags.Int("y", 0, "coordinata Y del blocco della struttura")
+	radius := flags.Int("radius", 0, "raggio di pubblicazione in blocchi (0 per tutti i subscriber del topic)")
+	mq := flags.Int("mq", 0, "metri quadri della struttura")
+	lat := flags.Float64("lat", 0, "latitudine WGS84 della struttura (opzionale, insieme a --lon sostituisce --x e --y)")
+	lon := flags.Float64("lon", 0, "longitudine WGS84 della struttura (opzionale)")
+	radiusMeters := flags.Int("radius-meters", 0, "raggio di pubblicazione in metri (opzionale, con --lat e --lon)")
+	flags.StringVar(&options.configFile, "config", options.configFile, "file di configurazione locale")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return options, err
+	}
+
+	//Validazione dei soli parametri specificati
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var problems []string
+	if flags.NArg() > 0 {
+		problems = append(problems, "unexpected arguments: "+strings.Join(flags.Args(), " "))
+	}
+	checkInt := func(flagName string, value int, min int, target *string) {
+		if !set[flagName] {
+			return
+		}
+		if value < min {
+			problems = append(problems, "--"+flagName+" must be at least "+strconv.Itoa(min))
+			return
+		}
+		*target = strconv.Itoa(value)
+	}
+
+	if set["name"] {
+		if strings.TrimSpace(*name) == "" {
+			problems = append(problems, "--name must not be empty")
+		}
+		options.name = *name
+	}
+	if set["topic"] {
+		if strings.TrimSpace(*topic) == "" {
+			problems = append(problems, "--topic must not be empty")
+		}
+		options.topic = *topic
+	}
+	checkInt("people", *people, 0, &options.peopleNum)
+	//Le coordinate dei blocchi possono essere negative (a sud e ad ovest dell'origine della griglia)
+	if set["x"] {
+		options.positionX = strconv.Itoa(*x)
+	}
+	if set["y"] {
+		options.positionY = strconv.Itoa(*y)
+	}
+	checkInt("radius", *radius, 0, &options.radius)
+	checkInt("mq", *mq, 1, &options.mq)
+
+	//Posizione geografica opzionale: latitudine e longitudine vanno specificate insieme
+	if set["lat"] != set["lon"] {
+		problems = append(problems, "--lat and --lon must be specified together")
+	} else if set["lat"] {
+		if *lat < -90 || *lat > 90 {
+			problems = append(problems, "--lat must be between -90 and 90")
+		}
+		if *lon < -180 || *lon > 180 {
+			problems = append(problems, "--lon must be between -180 and 180")
+		}
+		options.latitude = strconv.FormatFloat(*lat, 'f', -1, 64)
+		options.longitude = strconv.FormatFloat(*lon, 'f', -1, 64)
+	}
+	if set["radius-meters"] {
+		if !set["lat"] {
+			problems = append(problems, "--radius-meters requires --lat and --lon")
+		}
+		if *radiusMeters <= 0 {
+			problems = append(problems, "--radius-meters must be positive")
+		}
+		options.radiusMeters = strconv.Itoa(*radiusMeters)
+	}
+
+	if len(problems) > 0 {
+		return options, usageError(flags, strings.Join(problems, "; "))
+	}
+
+	return options, nil
+}
+
+//Parametri nella forma posizionale deprecata
+func parsePositionalArgs(args []string, options publisherOptions) publisherOptions {
+
+	fmt.Fprintln(os.Stderr, "Attenzione: i parametri posizionali sono deprecati, usare le opzioni (publisher -help)")
+
+	//Se specifica il primo argomento, ed esso è uguale ad "i", allora il programma sarà interattivo
+	options.interactive = args[0] == "i"
+
+	if len(args) < 8 {
+		if len(args) > 1 {
+			fmt.Fprintln(os.Stderr, "Attenzione: parametri posizionali incompleti (ne servono almeno 8), vengono usati valori casuali")
+		}
+		return options
+	}
+
+	options.name = args[1]
+	options.topic = args[2]
+	options.peopleNum = args[3]
+	options.positionX = args[4]
+	options.positionY = args[5]
+	options.radius = args[6]
+	options.mq = args[7]
+
+	//Posizione geografica opzionale
+	if len(args) >= 10 {
+		options.latitude = args[8]
+		options.longitude = args[9]
+	}
+	if len(args) >= 11 {
+		options.radiusMeters = args[10]
+	}
+
+	return options
+}
+
+//Parametri casuali, usati per quelli non specificati
+func randomPublisherOptions() publisherOptions {
+	return publisherOptions{
+		interactive: true,
+		name:        "Struttura #" + strconv.Itoa(rand.Intn(100)),         //Nome struttura
+		topic:       common.Topics[rand.Intn(len(common.Topics))],         //Topic a cui manderà i messaggi
+		peopleNum:   strconv.Itoa(rand.Intn(50) + 20),                     //Numero di persone presenti nella struttura al momento dello startup
+		positionX:   strconv.Itoa(rand.Intn(common.TestPositionSize)),     //Posizione della struttura in coordinate X (Nota: Le cordinate X, Y si riferiscono al "blocco" posizionato in X,Y, non sono latitudine e longitudine)
+		positionY:   strconv.Itoa(rand.Intn(common.TestPositionSize)),     //Posizione della struttura in coordinate Y
+		radius:      strconv.Itoa(rand.Intn(10) + 1),                      //Raggio di interesse per il messaggio mandato dal publisher (Distanza per la quale i subscriber riceveranno il messaggio del publisher)
+		mq:          strconv.Itoa(rand.Intn(100)),                         //Metri quadri della struttura
+		configFile:  common.ConfigFile,
+	}
+}
+
+//Errore di validazione dei parametri, preceduto dall'uso del programma
+func usageError(flags *flag.FlagSet, message string) error {
+
+	fmt.Fprintln(flags.Output(), "Parametri non validi: "+message)
+	flags.Usage()
+
+	return errors.New(message)
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"strconv"
 )
@@ -10,14 +15,23 @@ import (
 			remote-logger.go
 
 	Questo modulo si occupa del logging remoto del sistema
+	Con le opzioni -cert e -key il logger accetta solo connessioni TLS (i client usano LoggerHost "tls://host:porta");
+		con -client-ca i client devono presentare anche un certificato firmato da una delle CA indicate (mutual TLS)
 
 */
 
 var initialized = false
 var clientConnections []net.Conn
 
+var certFile = flag.String("cert", "", "certificato TLS (PEM) del logger, insieme a -key abilita TLS")
+var keyFile = flag.String("key", "", "chiave privata (PEM) del certificato -cert")
+var clientCAFile = flag.String("client-ca", "", "certificati (PEM) delle CA dei client, che devono presentare un certificato valido (mutual TLS)")
+
 //Inizializza il log
-func main(){ Main() }
+func main(){
+	flag.Parse()
+	Main()
+}
 
 
 func Main() {
@@ -36,10 +50,10 @@ func Main() {
 
 func handleClientConnections() {
 
-	//Aspetta connessione TCP sulla porta tcp_port
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(60001))
+	//Aspetta connessione TCP (o TLS) sulla porta tcp_port
+	listener, err := listen(":"+strconv.Itoa(60001))
 	if err != nil {
-		fmt.Println("Errore nell'apertura della connessione TCP")
+		fmt.Println("Errore nell'apertura della connessione TCP. " + err.Error())
 		return
 	}
 	fmt.Println("Server per invio del log in ascolto")
@@ -56,6 +70,40 @@ func handleClientConnections() {
 	}
 }
 
+//Apre il listener, con TLS se sono stati specificati certificato e chiave
+func listen(address string) (listener net.Listener, retErr error) {
+
+	if *certFile == "" && *keyFile == "" {
+		if *clientCAFile != "" {
+			return nil, errors.New("-client-ca requires -cert and -key")
+		}
+		return net.Listen("tcp", address)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{certificate}}
+
+	if *clientCAFile != "" {
+		content, err := ioutil.ReadFile(*clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, errors.New("no PEM certificate found in " + *clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	fmt.Println("Connessioni TLS abilitate")
+
+	return tls.Listen("tcp", address, config)
+}
+
 func handleConnection(connection net.Conn){
 
 //Connessione in modalità listen
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"io/ioutil"
 	"net"
@@ -14,8 +13,8 @@ import (
 	"os"
 	"reflect"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
 )
 
 /*
@@ -42,8 +41,8 @@ var Topics = []string{						//Topic preimpostati
 
 //File di configurazione locale
 type LocalConfig struct {
-	LoggerHost 		string
-	AwsBroker 		string
+	LoggerHost 		string		//Indirizzo del logger remoto (host:porta, con "tls://" per usare TLS)
+	AwsBroker 		string		//Indirizzo dell'API REST del broker (host:porta, con "https://" per usare HTTPS)
 	RetryDelay  	int
 	PositDelay  	int
 	OpDelay  		int
@@ -52,9 +51,32 @@ type LocalConfig struct {
 	MaxRcvMessage	int64
 	PollingTime		int64
 	Region			string
+	SubscriberStore	string		//Storage dei subscriber usato dal broker ("dynamodb" o "memory")
+	DedupStore		string		//Storage dei messaggi già inoltrati usato dal broker ("memory", default, o "dynamodb")
+	Transport		string		//Sistema di code per lo scambio dei messaggi ("sqs", "memory" o "rest")
+	Mode			string		//Modalità di esecuzione: "aws" (default) oppure "local" (nessun servizio AWS, il broker gestisce configurazione, subscriber e code)
+	ConfigTableFile	string		//File con i parametri di configurazione usato dal broker in modalità locale (default conf_db.json)
+	ListenAddress	string		//Indirizzo su cui il broker espone l'API REST (default :80)
+	Profile			string		//Profilo delle credenziali AWS (~/.aws/credentials) da usare al posto delle variabili d'ambiente
+	DynamoDBEndpoint	string	//URL di DynamoDB (ad esempio di un emulatore locale), se vuoto quello di AWS per la regione
+	SQSEndpoint		string		//URL di SQS, se vuoto quello di AWS per la regione
+	HeartbeatDelay	int			//Intervallo (in secondi) tra due heartbeat del subscriber al broker (default 60)
+	AuthSecret		string		//Broker: chiave con cui vengono firmati i token dei subscriber (se vuota l'API REST non richiede autenticazione)
+	TokenTTL		int			//Broker: validità (in secondi) dei token dei subscriber, rinnovati ad ogni heartbeat (default 86400)
+	AdminKey		string		//Broker: chiave API del ruolo admin
+	PublisherKey	string		//Broker: chiave API del ruolo publisher
+	AllowedOrigins	string		//Broker: origini ammesse per le richieste cross-origin, separate da virgole (default "*")
+	ApiKey			string		//Publisher e dashboard: chiave API inviata al broker
+	TLSCertFile		string		//Certificato TLS (PEM): del server per il broker, del client per il mutual TLS di publisher e subscriber
+	TLSKeyFile		string		//Chiave privata (PEM) del certificato TLSCertFile
+	TLSRootCAFile	string		//Certificati (PEM) delle CA con cui verificare broker e logger remoto, in aggiunta a quelle di sistema
+	TLSClientCAFile	string		//Broker: certificati (PEM) delle CA dei client; abilita il mutual TLS per i publisher
 }
 
 var Config LocalConfig
+var authToken string				//Chiave API o token inviato al broker nell'header Authorization (vuoto se non richiesto)
+var authTokenMutex sync.RWMutex		//Il token del subscriber viene rinnovato dagli heartbeat in parallelo alle altre richieste
+var ConfigFile = "config.json"			//Percorso del file di configurazione locale (opzione --config di publisher e subscriber)
 
 var TestPositionSize int = 30			//Lato dell'area geografica utilizzata per i test (generazione randomica)
 
@@ -69,6 +91,11 @@ type ConfigUpdateRequest struct {
 type SubRegistrationResponse struct {
 	SubID     	string
 	QueueURL  	string
+	Token		string	`json:",omitempty"`	//Token del subscriber per le richieste successive (solo se il broker richiede autenticazione)
+}
+
+type SubHeartbeatResponse struct {
+	Token		string	`json:",omitempty"`	//Token rinnovato del subscriber (solo se il broker richiede autenticazione)
 }
 
 type PubRegistrationResponse struct {
@@ -78,6 +105,8 @@ type PubRegistrationResponse struct {
 type SubPositionUpdateRequest struct {
 	PositionX  	string
 	PositionY  	string
+	Latitude	string	//Latitudine WGS84 in gradi decimali (opzionale, se specificata sostituisce PositionX/PositionY)
+	Longitude	string	//Longitudine WGS84 in gradi decimali (opzionale)
 }
 
 type SubTopicSubscribeRequest struct {
@@ -91,6 +120,15 @@ type SubscriberEntry struct {
 	Topics    	[]string
 	PositionX 	int
 	PositionY 	int
+	Latitude	float64	`json:",omitempty" dynamodbav:",omitempty"`	//Posizione geografica WGS84 (0, 0 se il subscriber usa solo le coordinate a blocchi)
+	Longitude	float64	`json:",omitempty" dynamodbav:",omitempty"`
+	LastSeen	int64	`json:",omitempty" dynamodbav:",omitempty"`	//Ultima attività del subscriber (secondi Unix), usata dal broker per rimuovere i subscriber inattivi
+}
+
+// Pagina della lista dei subscriber (GET /subscriber?limit=&next=)
+type SubscriberPage struct {
+	Subscribers	[]SubscriberEntry
+	NextToken	string	//Cursore da passare come "next" per ottenere la pagina successiva ("" se è l'ultima pagina)
 }
 
 //Inizializza l'ambiente
@@ -102,6 +140,16 @@ func InitializeEnvironment() (retError error) {
 		return errors.New("error loading local configuration")
 	}
 
+	//Credenziali inviate al broker (il subscriber usa invece il token ottenuto alla registrazione)
+	SetAuthToken(Config.ApiKey)
+
+	//Connessioni cifrate verso broker e logger remoto (vedere tls.go)
+	err := initializeTLS()
+	if err != nil {
+		Fatal("Errore nella lettura dei certificati TLS. " + err.Error())
+		return err
+	}
+
 	//Inizializzazione del log
 	if initializeLog() != nil {
 		fmt.Println("Errore nell'inizializzazione del logger.")
@@ -109,42 +157,88 @@ func InitializeEnvironment() (retError error) {
 	}
 
 
-	//Creazione di parametri di sessione
-	var err error = nil
-	Sess, err = session.NewSession(&aws.Config{
-		Region:      aws.String(Config.Region),
-	})
+	//In modalità locale non viene creata nessuna sessione con AWS
+	if Config.Mode == "local" {
+		Info("Modalità locale: nessuna connessione con AWS.")
+	} else {
+
+		//Creazione di parametri di sessione (profilo ed endpoint dalla configurazione locale)
+		var err error = nil
+		Sess, err = newAwsSession()
+		if err != nil {
+			Fatal("Errore nella instaurazionde della connessione con AWS\n" + err.Error())
+			return err
+		}
+
+		Info("Parametri per la connessione con AWS creati.")
+	}
+
+	//Inizializzazione del sistema di code
+	err = initializeTransport()
 	if err != nil {
-		Fatal("Errore nella instaurazionde della connessione con AWS\n" + err.Error())
+		Fatal("Errore nell'inizializzazione del sistema di code\n" + err.Error())
 		return err
 	}
 
-
-	Info("Parametri per la connessione con AWS creati.")
-
 	return nil
 }
 
-//Legge il file di configurazione locale
+//Legge il file di configurazione locale e le variabili d'ambiente che lo sovrascrivono (vedere local_config.go)
 func readLocalConfig() (retErr error) {
 
-	jsonFile, err := os.Open("config.json")
-	if err != nil {
+	jsonFile, err := os.Open(ConfigFile)
+	if os.IsNotExist(err) {
+		Warning("File " + ConfigFile + " non presente, la configurazione locale viene letta dalle variabili d'ambiente")
+	} else if err != nil {
 		Fatal("Errore nell'ottenimento della configurazione locale. " + err.Error())
 		return err
+	} else {
+
+		defer jsonFile.Close()
+
+		byteValue, _ := ioutil.ReadAll(jsonFile)
+
+		err = json.Unmarshal(byteValue, &Config)
+		if err != nil {
+			Fatal("Errore nell'unmarshaling della configurazione locale. " + err.Error())
+			return err
+		}
 	}
 
-	defer jsonFile.Close()
+	problems := applyEnvironmentOverrides(&Config)
 
-	byteValue, _ := ioutil.ReadAll(jsonFile)
+	//Valori di default
+	if Config.Mode == "" {
+		Config.Mode = "aws"
+	}
+	if Config.ConfigTableFile == "" {
+		Config.ConfigTableFile = "conf_db.json"
+	}
+	if Config.ListenAddress == "" {
+		Config.ListenAddress = ":80"
+		if Config.TLSCertFile != "" {
+			Config.ListenAddress = ":443"
+		}
+	}
+	if Config.HeartbeatDelay == 0 {
+		Config.HeartbeatDelay = 60
+	}
+	if Config.TokenTTL == 0 {
+		Config.TokenTTL = 86400
+	}
+	if Config.AllowedOrigins == "" {
+		Config.AllowedOrigins = "*"
+	}
 
-	err = json.Unmarshal(byteValue, &Config)
-	if err != nil {
-		Fatal("Errore nell'unmarshaling della configurazione locale. " + err.Error())
+	//Tutti i valori mancanti o non validi vengono riportati insieme
+	problems = append(problems, validateLocalConfig(Config)...)
+	if len(problems) > 0 {
+		err = localConfigError(problems)
+		Fatal("Configurazione locale non valida. " + err.Error())
 		return err
 	}
 
-	Info(fmt.Sprintf("Configurazione Locale: \n%+v\n", Config))
+	Info(fmt.Sprintf("Configurazione Locale: \n%+v\n", maskedLocalConfig(Config)))
 
 	return nil
 }
@@ -176,7 +270,14 @@ func ReadInput(reader *bufio.Reader) (in string, retErr error){
 func GetRequest(resousce string, output interface{}) (responseCode int, r interface{}, retErr error) {
 
 
-	getResponse, err := http.Get("http://" + resousce)
+	request, err := http.NewRequest(http.MethodGet, requestURL(resousce), nil)
+	if err != nil {
+		Fatal("Errore nella creazione della richiesta GET. " + err.Error())
+		return 0, nil, err
+	}
+	setAuthorization(request)
+
+	getResponse, err := httpClient.Do(request)
 	if err != nil {
 		Fatal("Errore nella richiesta Get. " + err.Error())
 		return 0, nil, err
@@ -193,8 +294,6 @@ func PostRequest(resource string, input interface{}, output interface{}) (respon
 	var jsonInput []byte
 	var err error
 
-	client := &http.Client{}
-
 	if input != nil {
 		jsonInput, err = json.Marshal(input)
 		if err != nil {
@@ -203,15 +302,16 @@ func PostRequest(resource string, input interface{}, output interface{}) (respon
 		}
 	}
 
-	request, err := http.NewRequest(http.MethodPost, "http://"+resource, bytes.NewBuffer(jsonInput))
+	request, err := http.NewRequest(http.MethodPost, requestURL(resource), bytes.NewBuffer(jsonInput))
 	if err != nil {
 		Fatal("Errore nella creazione della richiesta POST JSON. " + err.Error())
 		return 0, nil, err
 	}
 
 	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	setAuthorization(request)
 
-	postResponse, err := client.Do(request)
+	postResponse, err := httpClient.Do(request)
 	if err != nil {
 		Fatal("Errore nell'esecuzione della richiesta POST JSON. " + err.Error())
 		return 0, nil, err
@@ -226,8 +326,6 @@ func PutRequest(resource string, input interface{}, output interface{}) (respons
 	var jsonInput []byte
 	var err error
 
-	client := &http.Client{}
-
 	if input != nil {
 		jsonInput, err = json.Marshal(input)
 		if err != nil {
@@ -236,15 +334,16 @@ func PutRequest(resource string, input interface{}, output interface{}) (respons
 		}
 	}
 
-	request, err := http.NewRequest(http.MethodPut, "http://" + resource, bytes.NewBuffer(jsonInput))
+	request, err := http.NewRequest(http.MethodPut, requestURL(resource), bytes.NewBuffer(jsonInput))
 	if err != nil {
 		Fatal("Errore nella creazione della richiesta PUT JSON. " + err.Error())
 		return 0, nil, err
 	}
 
 	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	setAuthorization(request)
 
-	putResponse, err := client.Do(request)
+	putResponse, err := httpClient.Do(request)
 	if err != nil {
 		Fatal("Errore nell'esecuzione della richiesta PUT JSON. " + err.Error())
 		return 0, nil, err
@@ -260,8 +359,6 @@ func DeleteRequest(resource string, input interface{}, output interface{}) (resp
 	var jsonInput []byte
 	var err error
 
-	client := &http.Client{}
-
 	if input != nil {
 		jsonInput, err = json.Marshal(input)
 		if err != nil {
@@ -270,14 +367,15 @@ func DeleteRequest(resource string, input interface{}, output interface{}) (resp
 		}
 	}
 
-	request, err := http.NewRequest(http.MethodDelete, "http://"+resource, bytes.NewBuffer(jsonInput))
+	request, err := http.NewRequest(http.MethodDelete, requestURL(resource), bytes.NewBuffer(jsonInput))
 	if err != nil {
 		Fatal("Errore nella creazione della richiesta DELETE JSON. " + err.Error())
 		return 0, nil, err
 	}
 	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	setAuthorization(request)
 
-	deleteResponse, err := client.Do(request)
+	deleteResponse, err := httpClient.Do(request)
 	if err != nil {
 		Fatal("Errore nell'esecuzione della richiesta DELETE JSON. " + err.Error())
 		return 0, nil, err
@@ -287,13 +385,34 @@ func DeleteRequest(resource string, input interface{}, output interface{}) (resp
 }
 
 
+//Imposta la chiave API o il token inviato al broker
+func SetAuthToken(token string) {
+	authTokenMutex.Lock()
+	defer authTokenMutex.Unlock()
+	authToken = token
+}
+
+//Chiave API o token attualmente inviato al broker
+func CurrentAuthToken() string {
+	authTokenMutex.RLock()
+	defer authTokenMutex.RUnlock()
+	return authToken
+}
+
+//Aggiunge alla richiesta le credenziali per il broker, se presenti
+func setAuthorization(request *http.Request) {
+	if token := CurrentAuthToken(); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
 //Funzione per estrapolare la risposta da una richiesta di tipo GET POST PUT DELETE
 func readResponse(response *http.Response, output interface{}) (responseCode int, r interface{}, retErr error){
 
-	if output == nil { return response.StatusCode, nil, nil}
-
 	defer response.Body.Close()
 
+	if output == nil { return response.StatusCode, nil, nil}
+
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		Fatal("Errore nella lettura del body della response. " + err.Error())
@@ -371,18 +490,6 @@ func ByteToString(bytes []byte) string {
 	return string(bytes[:n+1])
 }
 
-//Genera un SUB ID a partire da una lista di sub id già presente nel sistema
-func GenerateSubID(subsID []string, startFrom int) (subID string, retErr error) {
-
-	for i := startFrom; i > -1; i++ {
-		if StringListContains(subsID, strconv.Itoa(i)) == false {
-			return strconv.Itoa(i), nil
-		}
-	}
-
-	return "", errors.New("no id for subscriber found")
-}
-
 //Concatena array di stringhe in una sola stringa usando un certo separatore
 func ConcatenateArrayValues(arr []string, char string) (concat string) {
 
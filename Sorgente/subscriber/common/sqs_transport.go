@@ -0,0 +1,272 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"strconv"
+	"time"
+)
+
+/*
+			sqs_transport.go
+
+	Implementazione di Transport basata su code FIFO di Amazon SQS.
+	SQS accetta al massimo 10 attributi per messaggio: nei messaggi con più attributi (ad esempio quelli con
+		posizione geografica) gli attributi aggiunti dopo la versione 0 vengono inviati in un unico attributo
+		PackedAttributes in formato JSON, e vengono ricostruiti in ricezione. Gli attributi della versione 0
+		restano separati, in modo che i messaggi siano leggibili anche da subscriber e broker precedenti.
+
+*/
+
+const sqsMaxAttributes = 10                     //Numero massimo di attributi di un messaggio SQS
+const packedAttributesName = "PackedAttributes" //Attributo che contiene gli attributi in formato JSON
+
+type SqsTransport struct{}
+
+//Crea una coda FIFO su SQS
+func (transport *SqsTransport) CreateQueue(name string) (queueUrl string, retErr error) {
+
+	svc := sqs.New(Sess)
+
+	result, err := svc.CreateQueue(&sqs.CreateQueueInput{
+		QueueName: aws.String(name + ".fifo"),
+		Attributes: map[string]*string{
+			"MessageRetentionPeriod":        aws.String("345600"),
+			"ReceiveMessageWaitTimeSeconds": aws.String(strconv.FormatInt(Config.PollingTime, 10)),
+			"FifoQueue":                     aws.String("true"), //Coda FIFO
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *result.QueueUrl, nil
+}
+
+//Elimina una coda SQS
+func (transport *SqsTransport) DeleteQueue(queueUrl string) (retErr error) {
+
+	svc := sqs.New(Sess)
+
+	_, err := svc.DeleteQueue(&sqs.DeleteQueueInput{
+		QueueUrl: aws.String(queueUrl),
+	})
+
+	return err
+}
+
+//Elenca le code SQS il cui nome inizia con prefix (ListQueues ritorna al massimo 1000 code per pagina)
+func (transport *SqsTransport) ListQueues(prefix string) (queueUrls []string, retErr error) {
+
+	svc := sqs.New(Sess)
+
+	err := svc.ListQueuesPages(&sqs.ListQueuesInput{
+		QueueNamePrefix: aws.String(prefix),
+		MaxResults:      aws.Int64(1000),
+	}, func(page *sqs.ListQueuesOutput, lastPage bool) bool {
+		queueUrls = append(queueUrls, aws.StringValueSlice(page.QueueUrls)...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return queueUrls, nil
+}
+
+//Ritorna l'istante di creazione di una coda SQS (attributo CreatedTimestamp, in secondi)
+func (transport *SqsTransport) QueueCreatedAt(queueUrl string) (createdAt time.Time, retErr error) {
+
+	svc := sqs.New(Sess)
+
+	result, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueUrl),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameCreatedTimestamp)},
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	seconds, err := strconv.ParseInt(aws.StringValue(result.Attributes[sqs.QueueAttributeNameCreatedTimestamp]), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid creation timestamp of queue " + queueUrl)
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+//Invia un messaggio alla coda SQS
+func (transport *SqsTransport) SendMessage(queueUrl string, message QueueMessage) (retErr error) {
+
+	svc := sqs.New(Sess)
+
+	attributes, err := sqsAttributes(message.Attributes)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.SendMessage(&sqs.SendMessageInput{
+		MessageAttributes:      attributes,
+		MessageGroupId:         aws.String(message.GroupID),
+		MessageDeduplicationId: aws.String(message.DeduplicationID),
+		MessageBody:            aws.String(message.Body),
+		QueueUrl:               aws.String(queueUrl),
+	})
+
+	return err
+}
+
+//Invia un gruppo di messaggi (al massimo MaxBatchSize) alla coda SQS con una sola richiesta
+func (transport *SqsTransport) SendMessageBatch(queueUrl string, messages []QueueMessage) (failed []int, retErr error) {
+
+	if len(messages) > MaxBatchSize {
+		return nil, errors.New("too many messages in batch")
+	}
+
+	svc := sqs.New(Sess)
+
+	var entries []*sqs.SendMessageBatchRequestEntry
+
+	for i, message := range messages {
+
+		attributes, err := sqsAttributes(message.Attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		//L'identificativo della entry è l'indice del messaggio nel gruppo
+		entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                     aws.String(strconv.Itoa(i)),
+			MessageAttributes:      attributes,
+			MessageGroupId:         aws.String(message.GroupID),
+			MessageDeduplicationId: aws.String(message.DeduplicationID),
+			MessageBody:            aws.String(message.Body),
+		})
+	}
+
+	result, err := svc.SendMessageBatch(&sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: aws.String(queueUrl),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range result.Failed {
+		index, err := strconv.Atoi(aws.StringValue(entry.Id))
+		if err == nil {
+			failed = append(failed, index)
+		}
+		retErr = errors.New("batch send failed: " + aws.StringValue(entry.Message))
+	}
+
+	return failed, retErr
+}
+
+//Converte gli attributi di un messaggio nel formato SQS, impacchettando quelli successivi alla versione 0 se sono troppi
+func sqsAttributes(messageAttributes map[string]string) (attributes map[string]*sqs.MessageAttributeValue, retErr error) {
+
+	attributes = make(map[string]*sqs.MessageAttributeValue)
+	packed := make(map[string]string)
+
+	for name, value := range messageAttributes {
+		if len(messageAttributes) > sqsMaxAttributes && !StringListContains(legacyAttributes, name) {
+			packed[name] = value
+			continue
+		}
+		attributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+
+	if len(packed) > 0 {
+		packedValue, err := json.Marshal(packed)
+		if err != nil {
+			return nil, err
+		}
+		attributes[packedAttributesName] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(string(packedValue)),
+		}
+	}
+
+	return attributes, nil
+}
+
+//Ricostruisce gli attributi di un messaggio ricevuto da SQS, estraendo quelli impacchettati
+func messageAttributes(sqsAttributes map[string]*sqs.MessageAttributeValue) map[string]string {
+
+	attributes := make(map[string]string)
+
+	for name, value := range sqsAttributes {
+		if name == packedAttributesName {
+			//Attributi impacchettati in formato JSON (vedere sqsAttributes)
+			packed := make(map[string]string)
+			_ = json.Unmarshal([]byte(aws.StringValue(value.StringValue)), &packed)
+			for packedName, packedValue := range packed {
+				attributes[packedName] = packedValue
+			}
+			continue
+		}
+		attributes[name] = aws.StringValue(value.StringValue)
+	}
+
+	return attributes
+}
+
+//Riceve i messaggi dalla coda SQS con long polling
+func (transport *SqsTransport) ReceiveMessages(queueUrl string, maxMessages int64, waitSeconds int64) (messages []QueueMessage, retErr error) {
+
+	svc := sqs.New(Sess)
+
+	result, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		AttributeNames: []*string{
+			aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			aws.String(sqs.MessageSystemAttributeNameMessageGroupId),
+		},
+		MessageAttributeNames: []*string{
+			aws.String(sqs.QueueAttributeNameAll),
+		},
+		WaitTimeSeconds:     aws.Int64(waitSeconds), //Long polling
+		MaxNumberOfMessages: aws.Int64(maxMessages),
+		QueueUrl:            aws.String(queueUrl),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var messageList []QueueMessage
+
+	for _, mess := range result.Messages {
+
+		message := QueueMessage{
+			Body:          aws.StringValue(mess.Body),
+			Attributes:    messageAttributes(mess.MessageAttributes),
+			ReceiptHandle: aws.StringValue(mess.ReceiptHandle),
+			GroupID:       aws.StringValue(mess.Attributes[sqs.MessageSystemAttributeNameMessageGroupId]),
+		}
+
+		sent := aws.StringValue(mess.Attributes[sqs.MessageSystemAttributeNameSentTimestamp])
+		message.SentTimestamp, _ = strconv.ParseInt(sent, 10, 64)
+
+		messageList = append(messageList, message)
+	}
+
+	return messageList, nil
+}
+
+//Elimina un messaggio ricevuto dalla coda SQS
+func (transport *SqsTransport) DeleteMessage(queueUrl string, receiptHandle string) (retErr error) {
+
+	svc := sqs.New(Sess)
+
+	_, err := svc.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueUrl),
+		ReceiptHandle: aws.String(receiptHandle),
+	})
+
+	return err
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+			tls.go
+
+	Questo modulo gestisce le connessioni cifrate con TLS verso l'API REST del broker e il logger remoto:
+	 - AwsBroker con schema "https://" (ad esempio "https://broker.example.com:443") fa usare HTTPS alle richieste
+	   al broker; senza schema, o con "http://", viene usato HTTP
+	 - LoggerHost con schema "tls://" fa usare TLS alla connessione con il logger remoto; senza schema, o con
+	   "tcp://", viene usato TCP
+	 - TLSRootCAFile aggiunge i certificati delle CA con cui verificare broker e logger (ad esempio per certificati
+	   autofirmati) a quelli di sistema
+	 - TLSCertFile e TLSKeyFile sono il certificato e la chiave del broker per l'API REST; per publisher e
+	   subscriber sono il certificato presentato ai server che lo richiedono (mutual TLS)
+	 - TLSClientCAFile (solo broker) abilita il mutual TLS: le risorse dei publisher richiedono un certificato
+	   client firmato da una delle CA indicate (vedere broker-auth.go)
+
+*/
+
+var httpClient = &http.Client{}	//Client delle richieste all'API REST del broker
+var clientTLS *tls.Config		//Configurazione TLS delle connessioni verso broker e logger remoto
+
+//Prepara la configurazione TLS delle connessioni verso broker e logger remoto
+func initializeTLS() (retErr error) {
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if Config.TLSRootCAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		err = appendCertificates(pool, Config.TLSRootCAFile)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+	}
+
+	if Config.TLSCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(Config.TLSCertFile, Config.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	clientTLS = config
+	httpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}}
+
+	return nil
+}
+
+//Configurazione TLS del server dell'API REST del broker (nil se TLSCertFile non è impostato)
+func ServerTLSConfig() (config *tls.Config, retErr error) {
+
+	if Config.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(Config.TLSCertFile, Config.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{certificate}}
+
+	//Con il mutual TLS il certificato client viene verificato se presentato; è il broker a richiederlo per le
+	//risorse dei publisher, dato che subscriber e dashboard non ne hanno uno
+	if Config.TLSClientCAFile != "" {
+		pool := x509.NewCertPool()
+		err = appendCertificates(pool, Config.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+//Aggiunge ad un pool i certificati (in formato PEM) contenuti in un file
+func appendCertificates(pool *x509.CertPool, file string) (retErr error) {
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(content) {
+		return errors.New("no PEM certificate found in " + file)
+	}
+
+	return nil
+}
+
+//Separa lo schema (eventuale, in minuscolo) dall'indirizzo host:porta
+func splitScheme(address string) (scheme string, host string) {
+
+	separator := strings.Index(address, "://")
+	if separator < 0 {
+		return "", address
+	}
+
+	return strings.ToLower(address[:separator]), address[separator+3:]
+}
+
+//URL di una risorsa del broker (AwsBroker seguito dal percorso), con lo schema http se non specificato
+func requestURL(resource string) string {
+
+	scheme, host := splitScheme(resource)
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + host
+}
+
+//Apre la connessione con il logger remoto, con TLS se LoggerHost ha lo schema "tls://"
+func DialLogger() (connection net.Conn, retErr error) {
+
+	scheme, host := splitScheme(Config.LoggerHost)
+	if scheme == "tls" {
+
+		//In caso di errore la connessione va ritornata come nil, e non come *tls.Conn nil
+		connection, err := tls.Dial("tcp", host, clientTLS)
+		if err != nil {
+			return nil, err
+		}
+		return connection, nil
+	}
+
+	return net.Dial("tcp", host)
+}
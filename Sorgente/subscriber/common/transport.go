@@ -0,0 +1,79 @@
+package common
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+			transport.go
+
+	Questo modulo definisce l'interfaccia Transport, cioè il sistema di code usato per lo scambio di messaggi
+		tra publisher, broker e subscriber. L'implementazione viene scelta nella configurazione locale
+		(campo "Transport"): "sqs" per Amazon SQS, "memory" per delle code in memoria nello stesso processo oppure
+		"rest" per le code gestite dal broker ed esposte attraverso la sua API REST (default in modalità locale).
+
+*/
+
+//Messaggio scambiato attraverso una coda
+type QueueMessage struct {
+	Body            string            //Testo del messaggio
+	Attributes      map[string]string //Attributi del messaggio (ID, Topic, Positive, ...)
+	GroupID         string            //Gruppo del messaggio (code FIFO)
+	DeduplicationID string            //Identificativo per la deduplicazione (code FIFO)
+	ReceiptHandle   string            //Impostato in ricezione, necessario per confermare (eliminare) il messaggio
+	SentTimestamp   int64             //Impostato in ricezione, istante di invio in millisecondi
+}
+
+//Interfaccia del sistema di code
+type Transport interface {
+	CreateQueue(name string) (queueUrl string, retErr error)                                                        //Crea una coda FIFO con il nome dato
+	DeleteQueue(queueUrl string) (retErr error)                                                                     //Elimina una coda
+	ListQueues(prefix string) (queueUrls []string, retErr error)                                                    //Elenca le code il cui nome inizia con prefix
+	QueueCreatedAt(queueUrl string) (createdAt time.Time, retErr error)                                             //Ritorna l'istante di creazione di una coda
+	SendMessage(queueUrl string, message QueueMessage) (retErr error)                                               //Invia un messaggio alla coda
+	SendMessageBatch(queueUrl string, messages []QueueMessage) (failed []int, retErr error)                        //Invia fino a MaxBatchSize messaggi alla coda, ritornando gli indici di quelli non inviati
+	ReceiveMessages(queueUrl string, maxMessages int64, waitSeconds int64) (messages []QueueMessage, retErr error) //Riceve fino a maxMessages messaggi, attendendo al massimo waitSeconds (long polling)
+	DeleteMessage(queueUrl string, receiptHandle string) (retErr error)                                            //Conferma la ricezione di un messaggio, eliminandolo dalla coda
+}
+
+const MaxBatchSize = 10 //Numero massimo di messaggi inviati con una SendMessageBatch (lo stesso limite di SQS)
+
+var MessageTransport Transport //Sistema di code utilizzato dall'applicativo
+
+//Inizializza il sistema di code secondo la configurazione locale
+func initializeTransport() (retErr error) {
+
+	transportType := Config.Transport
+	if transportType == "" && Config.Mode == "local" {
+		transportType = "rest"
+	}
+
+	switch transportType {
+	case "", "sqs":
+		MessageTransport = &SqsTransport{}
+	case "memory":
+		MessageTransport = NewMemoryTransport()
+	case "rest":
+		MessageTransport = &RestTransport{}
+	default:
+		Fatal("Sistema di code \"" + Config.Transport + "\" non supportato")
+		return errors.New("unknown transport " + Config.Transport)
+	}
+
+	return nil
+}
+
+//Invio di un gruppo di messaggi uno alla volta, per i sistemi di code che non supportano l'invio a gruppi
+func sendMessagesOneByOne(transport Transport, queueUrl string, messages []QueueMessage) (failed []int, retErr error) {
+
+	for i, message := range messages {
+		err := transport.SendMessage(queueUrl, message)
+		if err != nil {
+			failed = append(failed, i)
+			retErr = err
+		}
+	}
+
+	return failed, retErr
+}
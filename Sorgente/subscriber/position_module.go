@@ -2,6 +2,7 @@ package main
 
 import (
 	"common"
+	"context"
 	"math/rand"
 	"strconv"
 	"time"
@@ -14,8 +15,8 @@ import (
 
 */
 
-//Simulazione di componente hardware/software che ottiene la posizione di un dispositvo
-func position_update(subId string, strPositionX string, strPositionY string) (){
+//Simulazione di componente hardware/software che ottiene la posizione di un dispositvo (fino all'annullamento del contesto)
+func position_update(ctx context.Context, subId string, strPositionX string, strPositionY string) (){
 
 	var positionX int
 	var positionY int
@@ -34,9 +35,7 @@ func position_update(subId string, strPositionX string, strPositionY string) (){
 
 
 	//Posizione mockata//
-	for {
-
-		time.Sleep(time.Second * time.Duration(common.Config.PositDelay))
+	for common.SleepContext(ctx, time.Second * time.Duration(common.Config.PositDelay)) {
 
 		newPosX, newPosY := getPosition()
 		positionX = newPosX
@@ -3,22 +3,24 @@ package main
 import (
 	"bufio"
 	"common"
+	"context"
+	"flag"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"net"
 )
 
 /*
 			subscriber.go
 
 	Questo è il modulo "start" del subscriber che orchestra il suo funzionamento. Può essere eseguito in modalità "interattiva" e non.
-	Come specificato nelle istruzioni, accetta parametri a riga di comando.
+	Come specificato nelle istruzioni, accetta parametri a riga di comando (vedere subscriber_flags.go).
+	Se l'identità del subscriber viene salvata (vedere subscriber_state.go), alla terminazione con un segnale il
+		subscriber resta registrato e viene ripreso all'avvio successivo.
 
 
 */
@@ -28,47 +30,20 @@ func main() {
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	//Recupero gli argomenti in ingresso (scartando il primo che contiene il nome del programma)
-	args := os.Args[1:]
-
-	//Se non si specificano parametri di ingresso, il programma di default sarà interattivo
-	interactive := true
-
-	//Se specifica almeno il primo argomento, ed esso è uguale ad "i", allora il programma sarà interattivo
-	if len(args) >= 1 {
-		if args[0] == "i" { interactive = true
-		} else { interactive = false }
+	//Lettura dei parametri a riga di comando (vedere subscriber_flags.go), scartando il primo che contiene il nome del programma
+	options, err := parseArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
 	}
-
-	//Se vengono specificati tutti i parametri si parte da una situazione di subscriber predefinita
-	if len(args) >= 6 {
-		subId := args[1]
-		receiveQueue := args[2]
-		positionX := args[3]
-		positionY := args[4]
-		topics := args[5:]
-
-		//Eseguo il subscriber
-		run(subId, receiveQueue, topics, positionX, positionY, interactive)
-
-	} else {
-
-		//Se non sono stati specificati tutti i parametri, il publisher viene eseguito impostando valori randomici
-		subId := ""
-		receiveQueue := ""
-		positionX := strconv.Itoa(rand.Intn(common.TestPositionSize))
-		positionY := strconv.Itoa(rand.Intn(common.TestPositionSize))
-
-		//Numero randomico di iscrizione ai topics
-		var topics []string
-		for i := 0; i < rand.Intn(len(common.Topics) - 1) + 1; i++ {
-			topics = append(topics, common.Topics[rand.Intn(len(common.Topics))])
-		}
-
-		//Eseguo il subscriber
-		run(subId, receiveQueue, topics, positionX, positionY, interactive)
+	if err != nil {
+		os.Exit(2)
 	}
 
+	common.ConfigFile = options.configFile
+	stateFile = options.stateFile
+
+	//Eseguo il subscriber
+	run(options)
 }
 
 
@@ -77,7 +52,11 @@ func main() {
 
 
 //Punti di inizio del subscriber
-func run(subId string, receiveQueue string, topics []string, positionX string, positionY string, interactive bool){
+func run(options subscriberOptions){
+
+	subId, receiveQueue := options.subId, options.receiveQueue
+	topics, positionX, positionY := options.topics, options.positionX, options.positionY
+	var latitude, longitude string
 
 	//Inizializzazione dell'ambienete
 	err := common.InitializeEnvironment()
@@ -86,36 +65,91 @@ func run(subId string, receiveQueue string, topics []string, positionX string, p
 		return
 	}
 
-	//Se non è stato fornito un subID o una coda, si esegue la registrazione
+	//Contesto annullato alla ricezione di SIGINT o SIGTERM
+	ctx, cancel := common.ShutdownContext()
+	defer cancel()
+	defer common.CloseLog()
+
+	//Se non è stato fornito un subID o una coda, si riprende l'identità salvata oppure si esegue la registrazione
 	if subId == "" || receiveQueue == "" {
 
-		//Registrazione come subscriber
+		saved, resuming, err := loadState()
+		if err != nil {
+			common.Warning("[SUB] Errore nella lettura dello stato del subscriber da " + stateFile + ", viene effettuata una nuova registrazione. " + err.Error())
+		}
+		restoring := resuming
+
 		for {
-			subId, receiveQueue, err = register()
+			if resuming {
+				common.SetAuthToken(saved.Token)
+				receiveQueue, err = resume(saved.SubID)
+				if err == errSubscriberNotRegistered || err == errSubscriberUnauthorized {
+					common.Warning("[SUB] Impossibile riprendere il subscriber " + saved.SubID + " (" + err.Error() + "), viene effettuata una nuova registrazione")
+					resuming = false
+					continue
+				}
+				subId = saved.SubID
+			} else {
+				subId, receiveQueue, err = register()
+			}
 			if err != nil {
 				common.Fatal("[SUB] Errore nella registrazione come subscriber. Tentativo di riconnessione tra " + strconv.Itoa(common.Config.RetryDelay) + "s\n" + err.Error())
 
 			} else { break }
 
 			//Ritenta dopo alcuni secondi se non è stato possibile registrarsi
-			time.Sleep(time.Second * time.Duration(common.Config.RetryDelay))
+			if !common.SleepContext(ctx, time.Second * time.Duration(common.Config.RetryDelay)) { return }
+		}
+
+		if resuming {
+			updateState(func(s *SubscriberState) { *s = saved; s.QueueURL = receiveQueue; s.Token = common.CurrentAuthToken() })
 		}
 
+		//Vengono ripristinati i topic salvati (insieme a quelli eventualmente specificati) e l'ultima posizione, a meno
+		//che non ne sia stata specificata una nuova, anche se il subscriber ha dovuto registrarsi di nuovo
+		if restoring {
+			if !options.explicitTopics {
+				topics = nil
+			}
+			for _, topic := range saved.Topics {
+				if !common.StringListContains(topics, topic) {
+					topics = append(topics, topic)
+				}
+			}
+			if !options.explicitPosition {
+				if saved.Latitude != "" {
+					latitude, longitude = saved.Latitude, saved.Longitude
+				} else if saved.PositionX != "" {
+					positionX, positionY = saved.PositionX, saved.PositionY
+				}
+			}
+		}
 
+	} else {
+		common.SetAuthToken(options.token)
+		updateState(func(s *SubscriberState) { *s = SubscriberState{SubID: subId, QueueURL: receiveQueue, Token: options.token} })
 	}
 	//Invio messaggio al logger remoto
 	sendLogMessage(subId, "Configurazione e registrazione completata")
 
+	//Heartbeat periodico, per non essere rimosso dal broker per inattività
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go sendHeartbeats(heartbeatCtx, subId)
+
 	//Sottoscrizione ai topics
-	err = subscribeTopic(subId, topics)
-	if err != nil {
-		common.Warning("[SUB] Errore nella sottoscrizione ad un topic. " + err.Error())
+	if len(topics) > 0 {
+		err = subscribeTopic(subId, topics)
+		if err != nil {
+			common.Warning("[SUB] Errore nella sottoscrizione ad un topic. " + err.Error())
+		}
 	}
 
-
+	//Alla terminazione con un segnale il subscriber resta registrato se la sua identità viene salvata
+	keepRegistration := false
 
 	//Se interattivo
-	if interactive {
+	if options.interactive {
 
 		//Se sono stati forniti valori validi per la posizione, vengono registrati, altrimenti viene impostato 0 come valore
 		intPositionX, err := strconv.Atoi(positionX)
@@ -129,28 +163,69 @@ func run(subId string, receiveQueue string, topics []string, positionX string, p
 			common.Fatal("[SUB] Errore nella conversione int intero della posizioneY. " + err.Error())
 			intPositionY = 0
 		}
-		//Aggiorna la posizione
-		err = updateSubscriberPosition(subId, intPositionX, intPositionY)
+		//Aggiorna la posizione (quella geografica se è stata ripristinata dallo stato salvato)
+		if latitude != "" {
+			floatLatitude, errLat := strconv.ParseFloat(latitude, 64)
+			floatLongitude, errLon := strconv.ParseFloat(longitude, 64)
+			if errLat == nil && errLon == nil {
+				err = updateSubscriberGeoPosition(subId, floatLatitude, floatLongitude)
+			}
+		} else {
+			err = updateSubscriberPosition(subId, intPositionX, intPositionY)
+		}
 		if err != nil { common.Warning("[SUB] Errore nell'aggiornamento della posizione. " + err.Error()) }
 
-		//Eseguo il subscriber in modalità interattiva
-		interactiveSubscriber(subId, receiveQueue)
+		//Eseguo il subscriber in modalità interattiva, fino alla sua uscita o alla terminazione
+		done := make(chan bool, 1)
+		go func() {
+			done <- interactiveSubscriber(subId, receiveQueue)
+		}()
+
+		select {
+		case keepRegistration = <-done:
+		case <-ctx.Done():
+			keepRegistration = persistentIdentity()
+		}
 
 	} else {
 
+		//Dopo Config.SimulationTime secondi, la simulazione termina
+		simulationCtx, stop := context.WithTimeout(ctx, time.Second * time.Duration(common.Config.SimulationTime))
+		defer stop()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
 		//position_update simula la variazione di cordinate GPS nei terminali (specialmente mobili) con una goroutine separata
-		go position_update(subId, positionX, positionY)
+		go func() {
+			defer wg.Done()
+			position_update(simulationCtx, subId, positionX, positionY)
+		}()
 
 		//Eseguo il subscriber
-		go subscriber(subId, receiveQueue)
-
-		//Dopo Config.SimulationTime secondi, la simulazione termina
-		time.Sleep(time.Second * time.Duration(common.Config.SimulationTime))
+		go func() {
+			defer wg.Done()
+			subscriber(simulationCtx, subId, receiveQueue)
+		}()
+
+		//Attesa del termine della simulazione e della ricezione in corso (prima di eliminare la coda)
+		<-simulationCtx.Done()
+		if !common.WaitTimeout(&wg, common.ShutdownTimeout) {
+			common.Warning("[SUB] Ricezione in corso non completata")
+		}
 
+		//Al termine naturale della simulazione il subscriber si deregistra comunque
+		keepRegistration = ctx.Err() != nil && persistentIdentity()
 
+	}
 
+	if keepRegistration {
+		common.Info("[SUB] Il subscriber " + subId + " resta registrato (coda " + receiveQueue + ")")
+		return
 	}
 
+	stopHeartbeat()
+
 	//Cleanup dell'ambniente rimuovendo il suibscriber
 	err = unsubscribe(subId)
 	if err != nil {
@@ -160,11 +235,26 @@ func run(subId string, receiveQueue string, topics []string, positionX string, p
 	return
 }
 
-//logica del subscriber (NON INTERATTIVO)
-func subscriber(subId string, receiveQueue string){
+//Invia un heartbeat al broker ogni Config.HeartbeatDelay secondi, fino all'annullamento del contesto
+func sendHeartbeats(ctx context.Context, subId string){
+
+	for common.SleepContext(ctx, time.Second * time.Duration(common.Config.HeartbeatDelay)) {
+
+		err := heartbeat(subId)
+		if err == errSubscriberNotRegistered {
+			common.Warning("[SUB] Il subscriber " + subId + " non è più registrato presso il broker (rimosso per inattività?)")
+		}
+		if err == errSubscriberUnauthorized {
+			common.Warning("[SUB] Il token del subscriber " + subId + " non è più valido (scaduto o subscriber rimosso)")
+		}
+	}
+}
+
+//logica del subscriber (NON INTERATTIVO), fino all'annullamento del contesto
+func subscriber(ctx context.Context, subId string, receiveQueue string){
 
 	//goroutine che emula l'interazione sell'utente
-	go handleRandomUserInteraction(subId)
+	go handleRandomUserInteraction(ctx, subId)
 
 	//Loop per la ricezione dei messaggi
 	for {
@@ -174,7 +264,9 @@ func subscriber(subId string, receiveQueue string){
 			common.Fatal("[SUB] Errore nella ricezione del messaggio. " + err.Error())
 		}
 
-		time.Sleep(time.Second * time.Duration(common.Config.RcvMessDelay))
+		if !common.SleepContext(ctx, time.Second * time.Duration(common.Config.RcvMessDelay)) {
+			return
+		}
 	}
 
 }
@@ -184,10 +276,12 @@ func subscriber(subId string, receiveQueue string){
 
 
 // >Metodo che emula interazione dell'utente con un comportamento randomico nel caso di una esecuzione non interattiva
-func handleRandomUserInteraction(subId string){
+func handleRandomUserInteraction(ctx context.Context, subId string){
 
 	//Aggiunto un ritardo per simulare una interazione dell'utente a tempo discreto
-	time.Sleep(time.Second * time.Duration(common.Config.OpDelay))
+	if !common.SleepContext(ctx, time.Second * time.Duration(common.Config.OpDelay)) {
+		return
+	}
 
 	//La variabile randomica "choice" emula un evento randomico che l'applicativo riceve. L'applicazione infatti si pone semplicemente come
 	// GATEWAY tra l'eventuale interfaccia utente del subscriber (es. app per smartphone) e il resto del sistema (BROKER).
@@ -220,7 +314,7 @@ func handleRandomUserInteraction(subId string){
 //Funzione per il subscriber interattivo. Questo permette di simulare un comportamento specifico dell'applicazione per testare le sue funzionalità
 // Nota: essendo un'applicativo per testare l'invio di messaggi, e quindi non facente veramente parte dell'infrastruttura, non è stato posta particolare
 //attenzione sulla validazione dell'input da linea di comando
-func interactiveSubscriber(subId string, receiveQueue string){
+func interactiveSubscriber(subId string, receiveQueue string) (keepRegistration bool){
 
 	reader := bufio.NewReader(os.Stdin)
 
@@ -233,10 +327,12 @@ func interactiveSubscriber(subId string, receiveQueue string){
 			"\n\t - 2: Iscriversi ad uno o più topic" +
 			"\n\t - 3: Disiscriversi ad uno o più topic" +
 			"\n\t - 4: Aggiornare la posizione del subscriber" +
+			"\n\t - 5: Aggiornare la posizione geografica (latitudine e longitudine) del subscriber" +
+			"\n\t - 6: Uscire restando registrati (il subscriber viene ripreso all'avvio successivo)" +
 			"\n\t - Qualsiasi carattere: Disiscriversi ed uscire\nInput: ")
 
 		input, err := common.ReadInput(reader)
-		if err != nil { return }
+		if err != nil { return false }
 
 
 		//Ricezione messaggio dalla coda
@@ -258,7 +354,7 @@ func interactiveSubscriber(subId string, receiveQueue string){
 			fmt.Print("[INPUT] Inserire i topics a cui ci si vuole iscrivere, separati da uno spazio (es. Ristorazione Farmacia ): ")
 
 			input, err = common.ReadInput(reader)
-			if err != nil { return }
+			if err != nil { return false }
 
 
 			//Ottenimento di tutti i topic separati da " "
@@ -277,7 +373,7 @@ func interactiveSubscriber(subId string, receiveQueue string){
 			fmt.Print("[INPUT] Inserire i topics a cui ci si vuole disiscrivere, separati da uno spazio (es. Ristorazione Farmacia ): ")
 
 			input, err = common.ReadInput(reader)
-			if err != nil { return }
+			if err != nil { return false }
 
 
 			topics := strings.Split(input, " ")
@@ -292,10 +388,10 @@ func interactiveSubscriber(subId string, receiveQueue string){
 		} else if strings.Compare(input, "4") == 0 {
 
 
-			fmt.Print("[INPUT*] Specificare la coordinata X [numero intero positivo] del subscriber: ")
+			fmt.Print("[INPUT*] Specificare la coordinata X [numero intero] del subscriber: ")
 
 			input, err = common.ReadInput(reader)
-			if err != nil { return }
+			if err != nil { return false }
 
 			positionX, err := strconv.Atoi(input)
 			if err != nil { common.Fatal("[SUB] Errore nell'input immesso. " + err.Error()) }
@@ -303,10 +399,10 @@ func interactiveSubscriber(subId string, receiveQueue string){
 
 
 
-			fmt.Print("[INPUT*] Specificare la coordinata Y [numero intero positivo] del subscriber: ")
+			fmt.Print("[INPUT*] Specificare la coordinata Y [numero intero] del subscriber: ")
 
 			input, err = common.ReadInput(reader)
-			if err != nil { return }
+			if err != nil { return false }
 
 			positionY, err := strconv.Atoi(input)
 			if err != nil { common.Fatal("[SUB] Errore nell'input immesso. " + err.Error()) }
@@ -317,7 +413,40 @@ func interactiveSubscriber(subId string, receiveQueue string){
 				common.Warning("[SUB] Errore nell'aggiornamento della posizione. " + err.Error())
 			}
 
-		} else { return }
+		//Aggiornamento della posizione geografica
+		} else if strings.Compare(input, "5") == 0 {
+
+
+			fmt.Print("[INPUT] Specificare la latitudine [gradi decimali, es. 41.8557] del subscriber: ")
+
+			input, err = common.ReadInput(reader)
+			if err != nil { return false }
+
+			latitude, err := strconv.ParseFloat(input, 64)
+			if err != nil { common.Fatal("[SUB] Errore nell'input immesso. " + err.Error()) }
+
+
+
+			fmt.Print("[INPUT] Specificare la longitudine [gradi decimali, es. 12.6208] del subscriber: ")
+
+			input, err = common.ReadInput(reader)
+			if err != nil { return false }
+
+			longitude, err := strconv.ParseFloat(input, 64)
+			if err != nil { common.Fatal("[SUB] Errore nell'input immesso. " + err.Error()) }
+
+
+			err = updateSubscriberGeoPosition(subId, latitude, longitude)
+			if err != nil {
+				common.Warning("[SUB] Errore nell'aggiornamento della posizione. " + err.Error())
+			}
+
+		//Uscita mantenendo la registrazione
+		} else if strings.Compare(input, "6") == 0 {
+
+			return true
+
+		} else { return false }
 
 	}
 
@@ -329,43 +458,28 @@ func interactiveSubscriber(subId string, receiveQueue string){
 
 
 //Ricezione del messaggio in coda
-func receiveQueueMessage(subid string, receiveQueue string) (messages []*sqs.Message, retErr error){
+func receiveQueueMessage(subid string, receiveQueue string) (messages []common.QueueMessage, retErr error){
 
 
-	svc := sqs.New(common.Sess)
-	var messagesList []*sqs.Message
+	var messagesList []common.QueueMessage
 
-	result, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
-		AttributeNames: []*string{
-			aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
-		},
-		MessageAttributeNames: []*string{
-			aws.String(sqs.QueueAttributeNameAll),
-		},
-		WaitTimeSeconds: aws.Int64(common.Config.PollingTime),
-		MaxNumberOfMessages: aws.Int64(common.Config.MaxRcvMessage),
-		QueueUrl: &receiveQueue,
-
-	})
+	result, err := common.MessageTransport.ReceiveMessages(receiveQueue, common.Config.MaxRcvMessage, common.Config.PollingTime)
 	if err != nil {
 		common.Warning("[SUB] Errore nell'ottenimento del messaggio. " + err.Error())
 		return nil, err
 	}
-	if len(result.Messages) == 0 {
+	if len(result) == 0 {
 		common.Info("[SUB] Nessun messaggio ricevuto")
 		return
 	} else {
 
-		sendLogMessage(subid, "Messaggi ricevuti: " + strconv.Itoa(len(result.Messages)))
-		common.Info("[SUB " + subid +"] Messaggi ricevuti: " + strconv.Itoa(len(result.Messages)))
+		sendLogMessage(subid, "Messaggi ricevuti: " + strconv.Itoa(len(result)))
+		common.Info("[SUB " + subid +"] Messaggi ricevuti: " + strconv.Itoa(len(result)))
 
 		//Ciclo per tutti i messaggi ricevuti
-		for _, mess := range result.Messages {
+		for _, mess := range result {
 
-			_, err := svc.DeleteMessage(&sqs.DeleteMessageInput{
-				QueueUrl:      &receiveQueue,
-				ReceiptHandle: mess.ReceiptHandle,
-			})
+			err := common.MessageTransport.DeleteMessage(receiveQueue, mess.ReceiptHandle)
 			if err != nil {
 				common.Info("[SUB] Errore nell'eliminazione del messaggio. " + err.Error())
 
@@ -373,23 +487,32 @@ func receiveQueueMessage(subid string, receiveQueue string) (messages []*sqs.Mes
 			} else {
 				messagesList = append(messagesList, mess)
 
-				id 				:= *mess.MessageAttributes["ID"].StringValue
-				topic 			:= *mess.MessageAttributes["Topic"].StringValue
-				positive		:= *mess.MessageAttributes["Positive"].StringValue
-				peopleNum	  	:= *mess.MessageAttributes["PeopleNum"].StringValue
-				mq		 		:= *mess.MessageAttributes["Mq"].StringValue
+				message, err := common.DecodeMessage(mess)
+				if err == nil {
+					err = message.Validate()
+				}
+				if err != nil {
+					common.Warning("[SUB] Messaggio non valido ricevuto. " + err.Error())
+					continue
+				}
+
+				id 				:= message.ID
+				topic 			:= message.Topic
+				positive		:= strconv.Itoa(message.Positive)
+				peopleNum	  	:= strconv.Itoa(message.PeopleNum)
+				mq		 		:= strconv.Itoa(message.Mq)
 
 
 				common.Info("[SUB] Messaggio Ricevuto:\n" +
-					"\t[Struttura: " + id + "; Metri quadri: " + mq + "]: \"" + *mess.Body + "\"\n" +
+					"\t[Struttura: " + id + "; Metri quadri: " + mq + "]: \"" + message.Text + "\"\n" +
 					"\t | Numero persone: " + peopleNum + " (Positivi: " + positive + ") \n" +
-					"\t | Topic \"" + topic + "\"\n" +
+					"\t | Tipo " + message.Type + ", Topic \"" + topic + "\"\n" +
 					"\t +-----------------------------------------------------------------------------\n")
 
 				sendLogMessage(subid, "Messaggio Ricevuto:\n" +
-					"\t[Struttura: " + id + "; Metri quadri: " + mq + "]: \"" + *mess.Body + "\"\n" +
+					"\t[Struttura: " + id + "; Metri quadri: " + mq + "]: \"" + message.Text + "\"\n" +
 					"\t | Numero persone: " + peopleNum + " (Positivi: " + positive + ") \n" +
-					"\t | Topic \"" + topic + "\"\n" +
+					"\t | Tipo " + message.Type + ", Topic \"" + topic + "\"\n" +
 					"\t +-----------------------------------------------------------------------------\n")
 
 				common.Info("[SUB] Messaggio eliminato con successo")
@@ -411,26 +534,7 @@ func sendLogMessage(id string, message string){
 
 	prefix := "[SUB " + id + "] "
 
-	err := common.SendMessage(common.RemoteLogConnection, prefix + message + "\n")
-	if err != nil {
-		common.Warning("Errore nel logging remoto")
-		
-		//Istanzio la connessione con il remote logger
-		common.RemoteLogConnection, err = net.Dial("tcp", common.Config.LoggerHost)
-		if err != nil {
-			fmt.Println("Errore in dial: " + err.Error())
-		}
-		err = common.SendMessage(common.RemoteLogConnection, "d\n")
-		if err != nil {
-			fmt.Println("Errore nell'inizializzazione della connessione: " + err.Error())
-		}
-
-
-	common.SendMessage(common.RemoteLogConnection, prefix + message + "\n")
-
-
-	}
-
+	common.SendRemoteLog(prefix + message + "\n")
 }
 
 
@@ -2,6 +2,8 @@ package main
 
 import (
 	"common"
+	"errors"
+	"net/http"
 	"strconv"
 )
 
@@ -12,9 +14,13 @@ import (
 		per effettuare registrazione, topic subscribe, topic unsubscribe e
 		deregistrazione dal sistema.
 	La comunicazione avviene attraverso API REST
+	Ogni operazione andata a buon fine aggiorna lo stato salvato del subscriber (vedere subscriber_state.go)
 
 */
 
+var errSubscriberNotRegistered = errors.New("subscriber not registered on the broker")
+var errSubscriberUnauthorized = errors.New("subscriber token rejected by the broker")
+
 
 
 func register() (id string, queue string, retErr error){
@@ -33,8 +39,13 @@ func register() (id string, queue string, retErr error){
 	subID := response.SubID
 	recvQueue := response.QueueURL
 
+	//Le richieste successive vengono autenticate con il token del subscriber
+	common.SetAuthToken(response.Token)
+
 	common.Info("[SUB] Subscriber registrato correttamente ( " + strconv.Itoa(statusCode) + " ): " + subID + "; Coda: " + recvQueue)
 
+	updateState(func(s *SubscriberState) { *s = SubscriberState{SubID: subID, QueueURL: recvQueue, Token: response.Token} })
+
 	return subID, recvQueue, nil
 
 
@@ -42,6 +53,62 @@ func register() (id string, queue string, retErr error){
 }
 
 
+//Riprende l'identità di un subscriber già registrato: il broker verifica che esista ancora e ritorna la sua coda,
+//ricreandola se è stata persa
+func resume(subId string) (queue string, retErr error){
+
+	common.Info("[SUB] Ripresa del subscriber " + subId)
+
+	statusCode, resp, err := common.PostRequest(common.Config.AwsBroker + "/subscriber/" + subId + "/resume", nil, common.SubRegistrationResponse{})
+	if statusCode == http.StatusNotFound {
+		return "", errSubscriberNotRegistered
+	}
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return "", errSubscriberUnauthorized
+	}
+	if err != nil {
+		common.Fatal("[SUB] Errore nella ripresa del subscriber ( " + strconv.Itoa(statusCode) + " ). " + err.Error())
+		return "", err
+	}
+	response := common.SubRegistrationResponse{}
+	common.FillStruct(&response, resp.(map[string]interface{}))
+
+	if response.Token != "" {
+		common.SetAuthToken(response.Token)
+	}
+
+	common.Info("[SUB] Subscriber ripreso correttamente ( " + strconv.Itoa(statusCode) + " ): " + subId + "; Coda: " + response.QueueURL)
+
+	return response.QueueURL, nil
+}
+
+
+//Rinnova la registrazione presso il broker, che rimuove i subscriber inattivi, e il token del subscriber
+func heartbeat(subId string) (retErr error){
+
+	statusCode, resp, err := common.PostRequest(common.Config.AwsBroker + "/subscriber/" + subId + "/heartbeat", nil, common.SubHeartbeatResponse{})
+	if statusCode == http.StatusNotFound {
+		return errSubscriberNotRegistered
+	}
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return errSubscriberUnauthorized
+	}
+	if err != nil {
+		common.Warning("[SUB] Errore nell'invio dell'heartbeat ( " + strconv.Itoa(statusCode) + " ). " + err.Error())
+		return err
+	}
+	response := common.SubHeartbeatResponse{}
+	common.FillStruct(&response, resp.(map[string]interface{}))
+
+	if response.Token != "" {
+		common.SetAuthToken(response.Token)
+		updateState(func(s *SubscriberState) { s.Token = response.Token })
+	}
+
+	return nil
+}
+
+
 func updateSubscriberPosition(subId string, positionX int, positionY int) (retErr error){
 
 	common.Info("[SUB] Aggiornamento posizione subscriber")
@@ -54,6 +121,11 @@ func updateSubscriberPosition(subId string, positionX int, positionY int) (retEr
 
 	common.Info("[SUB] Posizione aggiornata con successo ( " + strconv.Itoa(statusCode) + " ): " + subId + "; Posizione: [ " + strconv.Itoa(positionX) + ", " + strconv.Itoa(positionY) + "]")
 
+	updateState(func(s *SubscriberState) {
+		s.PositionX, s.PositionY = strconv.Itoa(positionX), strconv.Itoa(positionY)
+		s.Latitude, s.Longitude = "", ""
+	})
+
 	sendLogMessage(subId, "Posizione aggiornata con successo: [ " + strconv.Itoa(positionX) + ", " + strconv.Itoa(positionY) + "]")
 
 	return nil
@@ -61,6 +133,30 @@ func updateSubscriberPosition(subId string, positionX int, positionY int) (retEr
 }
 
 
+func updateSubscriberGeoPosition(subId string, latitude float64, longitude float64) (retErr error){
+
+	common.Info("[SUB] Aggiornamento posizione geografica subscriber")
+
+	strLatitude := strconv.FormatFloat(latitude, 'f', -1, 64)
+	strLongitude := strconv.FormatFloat(longitude, 'f', -1, 64)
+
+	statusCode, _, err := common.PostRequest(common.Config.AwsBroker + "/subscriber/" + subId + "/position", common.SubPositionUpdateRequest{Latitude: strLatitude, Longitude: strLongitude}, nil)
+	if err != nil {
+		common.Fatal("[SUB] Errore nell'aggiornamento della posizione' ( " + strconv.Itoa(statusCode) + " ). " + err.Error())
+		return err
+	}
+
+	common.Info("[SUB] Posizione aggiornata con successo ( " + strconv.Itoa(statusCode) + " ): " + subId + "; Posizione: [ lat " + strLatitude + ", lon " + strLongitude + "]")
+
+	updateState(func(s *SubscriberState) { s.Latitude, s.Longitude = strLatitude, strLongitude })
+
+	sendLogMessage(subId, "Posizione aggiornata con successo: [ lat " + strLatitude + ", lon " + strLongitude + "]")
+
+	return nil
+
+}
+
+
 
 
 func subscribeTopic(subId string, topics []string) (retErr error){
@@ -76,6 +172,14 @@ func subscribeTopic(subId string, topics []string) (retErr error){
 
 	common.Info("[SUB] Topic aggiunti con successo ( " + strconv.Itoa(statusCode) + " ): " + subId + "; Topics: [ " + common.ConcatenateArrayValues(topics, ", ") + " ]")
 
+	updateState(func(s *SubscriberState) {
+		for _, topic := range topics {
+			if !common.StringListContains(s.Topics, topic) {
+				s.Topics = append(s.Topics, topic)
+			}
+		}
+	})
+
 	sendLogMessage(subId, "Iscrizione ai topic con successo: [ " + common.ConcatenateArrayValues(topics, ", ") + " ]")
 
 
@@ -99,6 +203,16 @@ func unsubscribeTopic(subId string, topics []string) (retErr error){
 
 	common.Info("[SUB] Topic rimossi con successo ( " + strconv.Itoa(statusCode) + " ): " + subId + "; Topics: [ " + common.ConcatenateArrayValues(topics, ", ") + " ]")
 
+	updateState(func(s *SubscriberState) {
+		var remaining []string
+		for _, topic := range s.Topics {
+			if !common.StringListContains(topics, topic) {
+				remaining = append(remaining, topic)
+			}
+		}
+		s.Topics = remaining
+	})
+
 	sendLogMessage(subId, "Rimozione di topic con successo: [ " + common.ConcatenateArrayValues(topics, ", ") + " ]")
 
 	return nil
@@ -118,6 +232,8 @@ func unsubscribe(subId string) (retErr error){
 
 	common.Info("[SUB] Subscriber rimosso con successo ( " + strconv.Itoa(statusCode) + " ): " + subId + ".")
 
+	removeState()
+
 	sendLogMessage(subId, "Deregistrazione con successo.")
 
 	return nil
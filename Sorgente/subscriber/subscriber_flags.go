@@ -0,0 +1,180 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+			subscriber_flags.go
+
+	Questo modulo legge i parametri a riga di comando del subscriber (subscriber -help per la lista delle opzioni).
+		I parametri non specificati vengono impostati con valori casuali; se non vengono specificati subscriber ID e
+		coda, il subscriber riprende l'identità salvata nel file di stato (vedere subscriber_state.go) oppure si registra
+		presso il broker.
+	È ancora accettata, ma deprecata, la forma posizionale originale:
+		subscriber i|n subId coda x y topic1 [topic2 ...]
+
+*/
+
+//Parametri di avvio del subscriber
+type subscriberOptions struct {
+	interactive  bool
+	subId        string
+	receiveQueue string
+	token        string
+	positionX    string
+	positionY    string
+	topics       []string
+	configFile   string
+	stateFile    string
+
+	explicitTopics   bool //Topic specificati dall'utente (e non casuali)
+	explicitPosition bool //Posizione specificata dall'utente (e non casuale)
+}
+
+//Legge i parametri a riga di comando (nella forma con opzioni oppure in quella posizionale deprecata)
+func parseArgs(args []string) (options subscriberOptions, retErr error) {
+
+	options = randomSubscriberOptions()
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return parsePositionalArgs(args, options), nil
+	}
+
+	flags := flag.NewFlagSet("subscriber", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Uso: subscriber [opzioni]\nI parametri non specificati vengono impostati con valori casuali.\n\nOpzioni:")
+		flags.PrintDefaults()
+	}
+
+	flags.BoolVar(&options.interactive, "interactive", true, "esecuzione interattiva (--interactive=false per la simulazione)")
+	subId := flags.String("sub-id", "", "ID di un subscriber già registrato (insieme a --queue, altrimenti il subscriber si registra)")
+	queue := flags.String("queue", "", "URL della coda di ricezione del subscriber (insieme a --sub-id)")
+	token := flags.String("token", "", "token del subscriber, se il broker richiede autenticazione (insieme a --sub-id)")
+	x := flags.Int("x", 0, "coordinata X del blocco del subscriber")
+	y := flags.Int("y", 0, "coordinata Y del blocco del subscriber")
+	topics := flags.String("topics", "", "lista di topic separati da virgole ("+strings.Join(common.Topics, ",")+")")
+	flags.StringVar(&options.configFile, "config", options.configFile, "file di configurazione locale")
+	flags.StringVar(&options.stateFile, "state", options.stateFile, "file di stato con l'identità del subscriber, da non condividere con altri subscriber (se non indicato l'identità non viene mantenuta tra un avvio e l'altro)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return options, err
+	}
+
+	//Validazione dei soli parametri specificati
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var problems []string
+	if flags.NArg() > 0 {
+		problems = append(problems, "unexpected arguments: "+strings.Join(flags.Args(), " "))
+	}
+
+	if set["sub-id"] != set["queue"] {
+		problems = append(problems, "--sub-id and --queue must be specified together")
+	} else if set["sub-id"] {
+		if *subId == "" || *queue == "" {
+			problems = append(problems, "--sub-id and --queue must not be empty")
+		}
+		options.subId, options.receiveQueue = *subId, *queue
+	}
+	if set["token"] {
+		if !set["sub-id"] {
+			problems = append(problems, "--token requires --sub-id and --queue")
+		}
+		options.token = *token
+	}
+
+	//Le coordinate dei blocchi possono essere negative (a sud e ad ovest dell'origine della griglia)
+	for _, position := range []struct {
+		name   string
+		value  int
+		target *string
+	}{{"x", *x, &options.positionX}, {"y", *y, &options.positionY}} {
+		if !set[position.name] {
+			continue
+		}
+		*position.target = strconv.Itoa(position.value)
+		options.explicitPosition = true
+	}
+
+	if set["topics"] {
+		options.topics = nil
+		for _, topic := range strings.Split(*topics, ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				options.topics = append(options.topics, topic)
+			}
+		}
+		if len(options.topics) == 0 {
+			problems = append(problems, "--topics must contain at least one topic")
+		}
+		options.explicitTopics = true
+	}
+
+	if len(problems) > 0 {
+		return options, usageError(flags, strings.Join(problems, "; "))
+	}
+
+	return options, nil
+}
+
+//Parametri nella forma posizionale deprecata
+func parsePositionalArgs(args []string, options subscriberOptions) subscriberOptions {
+
+	fmt.Fprintln(os.Stderr, "Attenzione: i parametri posizionali sono deprecati, usare le opzioni (subscriber -help)")
+
+	//Se specifica il primo argomento, ed esso è uguale ad "i", allora il programma sarà interattivo
+	options.interactive = args[0] == "i"
+
+	if len(args) < 6 {
+		if len(args) > 1 {
+			fmt.Fprintln(os.Stderr, "Attenzione: parametri posizionali incompleti (ne servono almeno 6), vengono usati valori casuali")
+		}
+		return options
+	}
+
+	options.subId = args[1]
+	options.receiveQueue = args[2]
+	options.positionX = args[3]
+	options.positionY = args[4]
+	options.topics = args[5:]
+	options.explicitTopics = true
+	options.explicitPosition = true
+
+	return options
+}
+
+//Parametri casuali, usati per quelli non specificati
+func randomSubscriberOptions() subscriberOptions {
+
+	options := subscriberOptions{
+		interactive: true,
+		positionX:   strconv.Itoa(rand.Intn(common.TestPositionSize)),
+		positionY:   strconv.Itoa(rand.Intn(common.TestPositionSize)),
+		configFile:  common.ConfigFile,
+	}
+
+	//Numero randomico di iscrizione ai topics
+	for i := 0; i < rand.Intn(len(common.Topics) - 1) + 1; i++ {
+		options.topics = append(options.topics, common.Topics[rand.Intn(len(common.Topics))])
+	}
+
+	return options
+}
+
+//Errore di validazione dei parametri, preceduto dall'uso del programma
+func usageError(flags *flag.FlagSet, message string) error {
+
+	fmt.Fprintln(flags.Output(), "Parametri non validi: "+message)
+	flags.Usage()
+
+	return errors.New(message)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"common"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+			subscriber_state.go
+
+	Questo modulo mantiene l'identità del subscriber in un file di stato locale (--state): subscriber ID, URL della
+		coda di ricezione, token per le richieste al broker, topic sottoscritti e ultima posizione comunicata.
+	La persistenza è abilitata solo indicando il file di stato, che non deve essere condiviso tra più subscriber:
+		ognuno riprenderebbe l'identità (e la coda) degli altri.
+	All'avvio il subscriber riprende l'identità salvata chiedendo al broker di verificarla (ricreando la coda se è
+		stata persa); il file viene aggiornato ad ogni operazione andata a buon fine e rimosso alla deregistrazione.
+
+*/
+
+//Stato del subscriber salvato su file
+type SubscriberState struct {
+	SubID     string   //ID del subscriber
+	QueueURL  string   //URL della coda di ricezione
+	Topics    []string //Topic sottoscritti
+	PositionX string   `json:",omitempty"` //Ultima posizione a blocchi comunicata
+	PositionY string   `json:",omitempty"`
+	Latitude  string   `json:",omitempty"` //Ultima posizione geografica comunicata (ha la precedenza su quella a blocchi)
+	Longitude string   `json:",omitempty"`
+	Token     string   `json:",omitempty"` //Token per le richieste al broker (se il broker richiede autenticazione)
+}
+
+var stateFile string         //Percorso del file di stato ("" disabilita la persistenza)
+var state SubscriberState    //Stato corrente del subscriber
+var stateMutex sync.Mutex    //Protegge lo stato, aggiornato anche dalle goroutine della simulazione
+
+//Legge lo stato salvato (found è false se la persistenza è disabilitata o il file non esiste)
+func loadState() (saved SubscriberState, found bool, retErr error) {
+
+	if stateFile == "" {
+		return SubscriberState{}, false, nil
+	}
+
+	content, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return SubscriberState{}, false, nil
+	}
+	if err != nil {
+		return SubscriberState{}, false, err
+	}
+
+	err = json.Unmarshal(content, &saved)
+	if err != nil {
+		return SubscriberState{}, false, err
+	}
+	if saved.SubID == "" {
+		return SubscriberState{}, false, nil
+	}
+
+	return saved, true, nil
+}
+
+//Modifica lo stato corrente e lo salva su file
+func updateState(update func(s *SubscriberState)) {
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	update(&state)
+
+	if stateFile == "" {
+		return
+	}
+
+	err := writeState(state)
+	if err != nil {
+		common.Warning("[SUB] Errore nel salvataggio dello stato del subscriber su " + stateFile + ". " + err.Error())
+	}
+}
+
+//Scrive lo stato su un file temporaneo che sostituisce quello precedente, per non lasciare mai un file incompleto
+func writeState(s SubscriberState) (retErr error) {
+
+	content, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(stateFile), filepath.Base(stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), stateFile)
+}
+
+//Rimuove lo stato salvato, dopo la deregistrazione del subscriber
+func removeState() {
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	state = SubscriberState{}
+
+	if stateFile == "" {
+		return
+	}
+
+	err := os.Remove(stateFile)
+	if err != nil && !os.IsNotExist(err) {
+		common.Warning("[SUB] Errore nella rimozione dello stato del subscriber. " + err.Error())
+	}
+}
+
+//Indica se l'identità del subscriber viene mantenuta tra un avvio e l'altro
+func persistentIdentity() bool {
+	return stateFile != ""
+}
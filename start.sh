@@ -24,6 +24,8 @@ sleep 4
 
 aws dynamodb batch-write-item --request-items file://conf_db.json
 
+aws dynamodb create-table --table-name configuration-history --attribute-definitions AttributeName=FieldName,AttributeType=S AttributeName=Version,AttributeType=N --key-schema AttributeName=FieldName,KeyType=HASH AttributeName=Version,KeyType=RANGE --provisioned-throughput ReadCapacityUnits=5,WriteCapacityUnits=5
+
 
 echo "
 Creazione della tabella subscribers ...
@@ -31,6 +33,18 @@ Creazione della tabella subscribers ...
 
 aws dynamodb create-table --table-name subscriber --attribute-definitions AttributeName=SubID,AttributeType=S --key-schema AttributeName=SubID,KeyType=HASH --provisioned-throughput ReadCapacityUnits=5,WriteCapacityUnits=5 
 
+echo "
+Creazione della tabella dei messaggi non consegnati ...
+"
+
+aws dynamodb create-table --table-name dead-letter --attribute-definitions AttributeName=LetterID,AttributeType=S --key-schema AttributeName=LetterID,KeyType=HASH --provisioned-throughput ReadCapacityUnits=5,WriteCapacityUnits=5
+
+aws dynamodb create-table --table-name dedup --attribute-definitions AttributeName=MessageID,AttributeType=S --key-schema AttributeName=MessageID,KeyType=HASH --provisioned-throughput ReadCapacityUnits=5,WriteCapacityUnits=5
+
+aws dynamodb wait table-exists --table-name dedup
+
+aws dynamodb update-time-to-live --table-name dedup --time-to-live-specification "Enabled=true, AttributeName=ExpiresAt"
+
 echo "Esportazione logger remoto su Elastic Beanstalk
 
 --------------------------------------------
@@ -0,0 +1,53 @@
+#!/bin/bash
+
+# Avvio del sistema in modalità locale (nessun servizio AWS): vengono compilati remote logger, broker,
+# publisher e subscriber nella cartella "local" e vengono avviati in background logger e broker.
+# Le dipendenze (aws-sdk-go, gorilla/mux, rs/cors) devono essere già presenti nel GOPATH
+# (vedere i comandi "go get" nei Dockerfile).
+
+export GO111MODULE=off
+export GOPATH=${GOPATH:-$HOME/go}
+
+ROOT=$(cd "$(dirname "$0")" && pwd)
+OUT=$ROOT/local
+
+# Il pacchetto "common" di ogni componente viene copiato in un GOPATH temporaneo, che precede quello
+# dell'utente (da cui vengono lette le dipendenze) e viene rimosso al termine dello script
+BUILD_GOPATH=$(mktemp -d) || exit 1
+trap 'rm -rf "$BUILD_GOPATH"' EXIT
+
+mkdir -p "$OUT" "$BUILD_GOPATH/src"
+
+for component in remotelogger broker publisher subscriber; do
+
+	echo "Compilazione $component ..."
+
+	mkdir -p "$OUT/$component"
+	rm -rf "$BUILD_GOPATH/src/common"
+	if [ -d "$ROOT/Sorgente/$component/common" ]; then
+		cp -r "$ROOT/Sorgente/$component/common" "$BUILD_GOPATH/src/common"
+	fi
+
+	(cd "$ROOT/Sorgente/$component" && GOPATH="$BUILD_GOPATH:$GOPATH" go build -o "$OUT/$component/$component") || exit 1
+
+	cp "$ROOT/config_local.json" "$OUT/$component/config.json"
+done
+
+cp "$ROOT/conf_db.json" "$OUT/broker/"
+
+echo "
+Avvio del remote logger (porta 60001) ..."
+(cd "$OUT/remotelogger" && ./remotelogger > remotelogger.out 2>&1 &)
+
+sleep 1
+
+echo "Avvio del broker (vedere ListenAddress in config_local.json) ..."
+(cd "$OUT/broker" && ./broker > broker.out 2>&1 &)
+
+echo "
+Sistema avviato. Per eseguire publisher e subscriber:
+
+ $ cd $OUT/publisher && ./publisher --interactive
+ $ cd $OUT/subscriber && ./subscriber --interactive
+
+Per monitorare i messaggi: nc localhost 60001 (e poi inviare il carattere \"l\")"